@@ -0,0 +1,201 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 后端名称
+const (
+	backendQEMU  = "qemu"
+	backendFEX   = "fex"
+	backendBox64 = "box64"
+)
+
+// backend 结构体：描述一种用户态模拟器
+//
+// 不同的后端使用相同的 ELF 魔数注册，区别在于解释器的名称、需要的标志位和获取版本的方式。
+// 同一个架构同时只应该注册一个后端，否则内核使用最新注册的条目。
+type backend struct {
+	name string
+
+	// emulators 架构到条目名称和二进制文件名称的映射
+	// 为 nil 时使用 configs 中的 QEMU 二进制文件，支持所有架构
+	emulators map[string]backendEmulator
+
+	// flags 后端需要的额外标志位
+	flags string
+
+	// versionArg 输出版本的参数，versionRe 从输出中匹配版本号
+	versionArg string
+	versionRe  *regexp.Regexp
+}
+
+// backendEmulator 结构体：后端在一个架构上使用的条目名称和二进制文件名称
+type backendEmulator struct {
+	entry  string
+	binary string
+}
+
+// backends 映射：所有支持的后端
+var backends = map[string]backend{
+	// QEMU 用户态模拟，支持 configs 中的所有架构
+	backendQEMU: {
+		name:       backendQEMU,
+		versionArg: "-version",
+		versionRe:  versionRe,
+	},
+	// FEX-Emu：在 arm64 上运行 x86 和 x86_64 程序
+	// 同一个 FEXInterpreter 处理两个架构，需要 P 和 O 标志（与 FEX 自带的 binfmt 配置一致）
+	backendFEX: {
+		name: backendFEX,
+		emulators: map[string]backendEmulator{
+			"amd64": {entry: "FEX-x86_64", binary: "FEXInterpreter"},
+			"386":   {entry: "FEX-x86", binary: "FEXInterpreter"},
+		},
+		flags:      "PO",
+		versionArg: "--version",
+		versionRe:  regexp.MustCompile(`FEX-(\d+(?:\.\d+)*)`),
+	},
+	// Box64：在 arm64 等平台上运行 x86_64 程序
+	backendBox64: {
+		name: backendBox64,
+		emulators: map[string]backendEmulator{
+			"amd64": {entry: "box64", binary: "box64"},
+		},
+		versionArg: "--version",
+		versionRe:  regexp.MustCompile(`v(\d+(?:\.\d+)+)`),
+	},
+}
+
+// getBackend 返回指定名称的后端，名称为空时返回 QEMU
+func getBackend(name string) (backend, error) {
+	if name == "" {
+		name = backendQEMU
+	}
+	b, ok := backends[name]
+	if !ok {
+		return backend{}, errors.Errorf("unknown backend %q", name)
+	}
+	return b, nil
+}
+
+// selectedBackend 解析 -backend，返回架构使用的后端名称
+//
+// 参数:
+//
+//	arch: 架构名称（如 "amd64"）
+//
+// 返回值:
+//
+//	string: 后端名称
+//	bool: 是否通过 "arch=backend" 为该架构明确指定
+//	error: 如果 -backend 不合法返回错误
+//
+// 注意:
+//   - -backend 是用 "," 分隔的列表，每一项是后端名称或 "arch=backend"
+//   - 只写后端名称时作为默认值，只应用于该后端支持的架构，其他架构仍使用 QEMU
+func selectedBackend(arch string) (string, bool, error) {
+	name := backendQEMU
+	for _, v := range strings.Split(backendSpec, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		a, b, ok := strings.Cut(v, "=")
+		if !ok {
+			if _, err := getBackend(v); err != nil {
+				return "", false, err
+			}
+			name = v
+			continue
+		}
+		if _, err := getBackend(b); err != nil {
+			return "", false, err
+		}
+		if _, ok := configs[a]; !ok {
+			return "", false, errors.Errorf("unsupported architecture %q in backend %q", a, v)
+		}
+		if a == arch {
+			return b, true, nil
+		}
+	}
+	return name, false, nil
+}
+
+// archConfig 返回架构在选择的后端下的配置
+//
+// 参数:
+//
+//	arch: 架构名称（如 "amd64"）
+//
+// 返回值:
+//
+//	config: 架构配置，二进制文件名称、条目名称和标志位由后端决定
+//	error: 如果架构不支持，或明确指定的后端不支持该架构返回错误
+func archConfig(arch string) (config, error) {
+	cfg, ok := configs[arch]
+	if !ok {
+		return config{}, errors.Errorf("unsupported architecture: %v", arch)
+	}
+	name, explicit, err := selectedBackend(arch)
+	if err != nil {
+		return config{}, err
+	}
+	b, err := getBackend(name)
+	if err != nil {
+		return config{}, err
+	}
+	if b.emulators == nil {
+		return cfg, nil
+	}
+	em, ok := b.emulators[arch]
+	if !ok {
+		if explicit {
+			return config{}, errors.Errorf("backend %s does not support %s", name, arch)
+		}
+		return cfg, nil
+	}
+	cfg.backend = b.name
+	cfg.binary = em.binary
+	cfg.entry = em.entry
+	cfg.flags = b.flags
+	return cfg, nil
+}
+
+// entryBackend 根据条目名称判断其对应的后端和架构
+// 条目名称可能带有前缀（如 "buildkit-qemu-aarch64"），不属于任何后端时返回 false
+func entryBackend(name string) (backend, string, bool) {
+	match := func(entry string) bool {
+		return name == entry || strings.HasSuffix(name, "-"+entry)
+	}
+	for _, b := range backends {
+		if b.emulators == nil {
+			for arch, cfg := range configs {
+				if match(cfg.binary) {
+					return b, arch, true
+				}
+			}
+			continue
+		}
+		for arch, em := range b.emulators {
+			if match(em.entry) {
+				return b, arch, true
+			}
+		}
+	}
+	return backend{}, "", false
+}
+
+// backendNames 返回所有后端的名称，用于帮助信息
+func backendNames() []string {
+	out := make([]string, 0, len(backends))
+	for name := range backends {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestArchConfig 测试 -backend 为每个架构选择的条目名称和解释器，以及不支持的组合
+func TestArchConfig(t *testing.T) {
+	defer func(old string) { backendSpec = old }(backendSpec)
+
+	tests := []struct {
+		spec      string
+		arch      string
+		entry     string
+		binary    string
+		expectErr string
+	}{
+		{spec: "", arch: "amd64", entry: "qemu-x86_64", binary: "qemu-x86_64"},
+		{spec: "fex", arch: "amd64", entry: "FEX-x86_64", binary: "FEXInterpreter"},
+		{spec: "fex", arch: "386", entry: "FEX-x86", binary: "FEXInterpreter"},
+		// 默认后端不支持的架构仍使用 QEMU
+		{spec: "fex", arch: "riscv64", entry: "qemu-riscv64", binary: "qemu-riscv64"},
+		{spec: "fex,amd64=box64", arch: "amd64", entry: "box64", binary: "box64"},
+		{spec: "fex,amd64=box64", arch: "386", entry: "FEX-x86", binary: "FEXInterpreter"},
+		{spec: "box64,amd64=qemu", arch: "amd64", entry: "qemu-x86_64", binary: "qemu-x86_64"},
+		{spec: "386=box64", arch: "386", expectErr: "does not support"},
+		{spec: "rosetta", arch: "amd64", expectErr: "unknown backend"},
+		{spec: "sparc=qemu", arch: "amd64", expectErr: "unsupported architecture"},
+	}
+	for _, tc := range tests {
+		backendSpec = tc.spec
+		cfg, err := archConfig(tc.arch)
+		if tc.expectErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+				t.Errorf("%q %s: expected error %q, got %v", tc.spec, tc.arch, tc.expectErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q %s: %v", tc.spec, tc.arch, err)
+			continue
+		}
+		if cfg.entryName() != tc.entry || cfg.binary != tc.binary {
+			t.Errorf("%q %s: unexpected config %+v", tc.spec, tc.arch, cfg)
+		}
+		if cfg.magic != configs[tc.arch].magic {
+			t.Errorf("%q %s: magic changed", tc.spec, tc.arch)
+		}
+	}
+}
+
+// TestInstallBackend 测试通过 FEX 后端安装 x86 架构，其他架构仍然使用 QEMU
+func TestInstallBackend(t *testing.T) {
+	defer func(old string) { backendSpec = old }(backendSpec)
+	backendSpec = "fex"
+
+	f := newFakeFS(t, true)
+	dir := fakeInterpreters(t, "riscv64")
+	script := "#!/bin/sh\necho \"FEX-Emu (FEX-2409)\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "FEXInterpreter"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, arch := range []string{"amd64", "386", "riscv64"} {
+		if err := install(arch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"FEX-x86_64", "FEX-x86"} {
+		e, ok := f.entry(name)
+		if !ok {
+			t.Fatalf("%s not registered, have %v", name, f.names())
+		}
+		if e.interpreter != filepath.Join(dir, "FEXInterpreter") {
+			t.Errorf("%s: unexpected interpreter %s", name, e.interpreter)
+		}
+		for _, flag := range "POCF" {
+			if !strings.ContainsRune(e.flags, flag) {
+				t.Errorf("%s: missing flag %c in %q", name, flag, e.flags)
+			}
+		}
+	}
+	if _, ok := f.entry("qemu-riscv64"); !ok {
+		t.Fatal("qemu-riscv64 not registered")
+	}
+
+	versions := map[string]emulatorVersion{}
+	for _, ev := range getEmulatorVersions(f.names()) {
+		versions[ev.Name] = ev
+	}
+	if ev := versions["FEX-x86_64"]; ev.Backend != backendFEX || ev.Version != "2409" || ev.Mismatch {
+		t.Errorf("unexpected version %+v", ev)
+	}
+	if ev := versions["qemu-riscv64"]; ev.Backend != "" {
+		t.Errorf("unexpected version %+v", ev)
+	}
+
+	if b, arch, ok := entryBackend("buildkit-FEX-x86"); !ok || b.name != backendFEX || arch != "386" {
+		t.Errorf("unexpected backend %s %s %v", b.name, arch, ok)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// chrootChildEnv 是在新的挂载命名空间中重新执行自身时设置的环境变量
+const chrootChildEnv = "BINFMT_CHROOT_CHILD"
+
+// chrootMounts 是绑定挂载到根文件系统中的目录
+var chrootMounts = []string{"/proc", "/dev"}
+
+// runChroot 实现 binfmt chroot 子命令：在其他架构的根文件系统中通过模拟器运行命令
+//
+// 参数:
+//
+//	args: chroot 之后的命令行参数（如 ["--platform", "linux/arm64", "/crossarch", "--", "uname", "-m"]）
+//
+// 返回值:
+//
+//	error: 如果找不到模拟器、挂载或执行失败返回错误，成功时不返回
+//
+// 工作原理:
+// 1. 父进程以 CLONE_NEWNS 重新执行自身，之后的挂载不会影响宿主机
+// 2. 子进程将 /proc 和 /dev 绑定挂载到根文件系统中
+// 3. 子进程打开模拟器后 chroot 到根文件系统，通过 /proc/self/fd/N 执行模拟器
+//
+// 没有指定 --platform 时根据根文件系统中 /bin/sh 的 ELF 头检测架构。
+// 没有指定命令时运行 /bin/sh。
+//
+// 注意:
+//   - 需要 root 权限
+//   - 模拟器在根文件系统中运行，必须是静态链接的（本仓库构建的模拟器都是静态链接的）
+func runChroot(args []string) error {
+	fs := flag.NewFlagSet("chroot", flag.ExitOnError)
+	var platform, workdir string
+	fs.StringVar(&platform, "platform", "", "platform of the root filesystem (default detected from /bin/sh)")
+	fs.StringVar(&workdir, "workdir", "/", "working directory inside the root filesystem")
+	fs.StringVar(&profileSpec, "profile", "", "comma-separated QEMU settings, e.g. arm64.cpu=max")
+	fs.BoolVar(&useEmbedded, "embedded", false, "use the emulator embedded in this binary")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("chroot requires a root filesystem directory")
+	}
+	rootfs, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cmd := fs.Args()[1:]
+	if len(cmd) > 0 && cmd[0] == "--" {
+		cmd = cmd[1:]
+	}
+	if len(cmd) == 0 {
+		cmd = []string{"/bin/sh"}
+	}
+	if fi, err := os.Stat(rootfs); err != nil || !fi.IsDir() {
+		return errors.Errorf("root filesystem %s is not a directory", rootfs)
+	}
+
+	if os.Getenv(chrootChildEnv) == "" {
+		c := exec.Command("/proc/self/exe", os.Args[1:]...)
+		c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+		c.Env = append(os.Environ(), chrootChildEnv+"=1")
+		c.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+		if err := c.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.ExitCode())
+			}
+			return errors.Wrap(err, "cannot create mount namespace (chroot requires root)")
+		}
+		return nil
+	}
+	os.Unsetenv(chrootChildEnv)
+
+	if platform == "" {
+		arch, err := detectRootfsArch(rootfs)
+		if err != nil {
+			return errors.Wrap(err, "cannot detect the architecture, use --platform")
+		}
+		platform = "linux/" + arch
+	}
+	var p *profile
+	if parseArch(platform)[0] != runtime.GOARCH {
+		if p, err = platformProfile(platform); err != nil {
+			return err
+		}
+	}
+
+	// chroot 之后宿主机上的模拟器不再可见，先打开它再通过 /proc/self/fd/N 执行
+	// 内嵌的模拟器已经在 memfd 中
+	if p != nil && !strings.HasPrefix(p.Interpreter, procSelfFD) {
+		if isDynamicELF(p.Interpreter) {
+			return errors.Errorf("emulator %s is dynamically linked and cannot run inside %s", p.Interpreter, rootfs)
+		}
+		fd, err := syscall.Open(p.Interpreter, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return errors.Wrapf(err, "cannot open %s", p.Interpreter)
+		}
+		p.Interpreter = procSelfFD + strconv.Itoa(fd)
+	}
+
+	if err := setupChroot(rootfs); err != nil {
+		return err
+	}
+	if err := os.Chdir(workdir); err != nil {
+		return err
+	}
+	path, err := exec.LookPath(cmd[0])
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return syscall.Exec(path, cmd, os.Environ())
+	}
+	return runWrapper(p, wrapperArgs(p, path, cmd))
+}
+
+// setupChroot 在当前的挂载命名空间中准备根文件系统并 chroot 到其中
+func setupChroot(rootfs string) error {
+	// 避免挂载事件传播到父命名空间
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return errors.Wrap(err, "cannot make mounts private")
+	}
+	for _, m := range chrootMounts {
+		// 根文件系统中的 /proc 和 /dev 可能是符号链接，在根文件系统中解析，不会挂载到宿主机的目录上
+		target, err := mkdirAllInRoot(rootfs, m)
+		if err != nil {
+			return err
+		}
+		if err := syscall.Mount(m, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return errors.Wrapf(err, "cannot bind mount %s", m)
+		}
+	}
+	if err := syscall.Chroot(rootfs); err != nil {
+		return errors.Wrapf(err, "cannot chroot to %s", rootfs)
+	}
+	return os.Chdir("/")
+}
+
+// detectRootfsArch 根据根文件系统中 /bin/sh 的 ELF 头检测架构
+//
+// 参数:
+//
+//	rootfs: 根文件系统目录
+//
+// 返回值:
+//
+//	string: 架构名称（如 "arm64"）
+//	error: 如果 /bin/sh 不存在或不匹配任何已知架构返回错误
+//
+// 注意:
+//   - /bin/sh 通常是符号链接（如 busybox），绝对路径的链接相对于根文件系统解析
+func detectRootfsArch(rootfs string) (string, error) {
+	sh, err := resolveInRoot(rootfs, "/bin/sh")
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(sh)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hdr := make([]byte, 64)
+	n, err := io.ReadFull(f, hdr)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	if arch, ok := archForHeader(hdr[:n]); ok {
+		return arch, nil
+	}
+	return "", errors.Errorf("%s does not match any supported architecture", sh)
+}
+
+// archForHeader 返回魔数和掩码与文件头匹配的架构，与内核匹配条目的方式相同
+func archForHeader(hdr []byte) (string, bool) {
+	archs := make([]string, 0, len(configs))
+	for arch := range configs {
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+	for _, arch := range archs {
+		magic, err := unescape(configs[arch].magic)
+		if err != nil {
+			continue
+		}
+		mask, err := unescape(configs[arch].mask)
+		if err != nil || len(hdr) < len(magic) {
+			continue
+		}
+		match := true
+		for i := range magic {
+			if hdr[i]&mask[i] != magic[i]&mask[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return arch, true
+		}
+	}
+	return "", false
+}
+
+// resolveInRoot 在根文件系统中解析路径，符号链接不会跳出根文件系统
+func resolveInRoot(root, p string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(p, "/")
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 40 {
+			return "", errors.Errorf("too many levels of symbolic links in %s", p)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+	return filepath.Join(root, resolved), nil
+}
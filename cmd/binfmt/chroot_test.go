@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeRootfs 创建 /bin 指向 usr/bin、/bin/sh 指向 /bin/busybox 的根文件系统
+// busybox 的内容为指定架构的魔数
+func fakeRootfs(t *testing.T, arch string) string {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "usr/bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("usr/bin", filepath.Join(root, "bin")); err != nil {
+		t.Fatal(err)
+	}
+	var hdr []byte
+	if arch != "" {
+		var err error
+		if hdr, err = unescape(configs[arch].magic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdr = append(hdr, make([]byte, 64)...)
+	if err := os.WriteFile(filepath.Join(root, "usr/bin/busybox"), hdr, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/bin/busybox", filepath.Join(root, "usr/bin/sh")); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// TestDetectRootfsArch 测试根据 /bin/sh 的 ELF 头检测根文件系统的架构
+func TestDetectRootfsArch(t *testing.T) {
+	for _, arch := range []string{"arm64", "arm", "riscv64", "s390x"} {
+		got, err := detectRootfsArch(fakeRootfs(t, arch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != arch {
+			t.Errorf("expected %s, got %s", arch, got)
+		}
+	}
+	if _, err := detectRootfsArch(fakeRootfs(t, "")); err == nil {
+		t.Error("expected error for unknown header")
+	}
+	if _, err := detectRootfsArch(t.TempDir()); err == nil {
+		t.Error("expected error for missing /bin/sh")
+	}
+}
+
+// TestResolveInRoot 测试符号链接在根文件系统中解析，不会跳出根文件系统
+func TestResolveInRoot(t *testing.T) {
+	root := fakeRootfs(t, "arm64")
+	if err := os.Symlink("../../../../etc/passwd", filepath.Join(root, "usr/bin/escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc/passwd"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := resolveInRoot(root, "/bin/escape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(root, "etc/passwd"); got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+
+	if err := os.Symlink("loop", filepath.Join(root, "loop")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveInRoot(root, "/loop"); err == nil {
+		t.Fatal("expected error for symlink loop")
+	}
+}
@@ -5,8 +5,11 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 
 	"github.com/containerd/platforms"
 	"github.com/moby/buildkit/util/archutil"
@@ -22,6 +25,19 @@ type config struct {
 	binary string // QEMU 模拟器二进制文件名称（如 qemu-aarch64）
 	magic  string // ELF 文件的魔数（magic number），用于识别二进制文件类型
 	mask   string // 魔数掩码，用于匹配魔数的特定部分
+
+	// 以下字段由 archConfig 根据选择的后端填写，configs 中的配置使用 QEMU 后端
+	backend string // 后端名称，为空时为 QEMU
+	entry   string // 条目名称，为空时与 binary 相同
+	flags   string // 后端需要的额外标志位
+}
+
+// entryName 返回配置对应的条目名称（不含 QEMU_BINARY_PREFIX 前缀）
+func (c config) entryName() string {
+	if c.entry != "" {
+		return c.entry
+	}
+	return c.binary
 }
 
 // configs 映射：存储所有支持的架构及其对应的 binfmt 配置
@@ -115,7 +131,7 @@ func allArch() []string {
 			m[p.Architecture] = struct{}{}
 		} else {
 			// 如果解析失败，记录错误日志
-			log.Printf("error: %+v", err)
+			slog.Warn("cannot parse supported platform", "platform", pp, "error", err)
 		}
 	}
 
@@ -126,10 +142,15 @@ func allArch() []string {
 	for name := range configs {
 		// 如果该架构不在当前支持的平台列表中
 		if _, ok := m[name]; !ok {
-			// 尝试获取该架构的二进制文件路径
-			if _, fullPath, err := getBinaryNames(configs[name]); err == nil {
+			// 尝试获取该架构在选择的后端下的二进制文件路径
+			var fullPath string
+			cfg, err := archConfig(name)
+			if err == nil {
+				_, fullPath, err = getBinaryNames(cfg)
+			}
+			if err == nil {
 				// 检查二进制文件是否存在
-				if _, err := os.Stat(fullPath); err == nil {
+				if emulatorAvailable(cfg, fullPath) {
 					// 如果存在，将该架构添加到输出列表
 					out = append(out, name)
 				}
@@ -144,3 +165,82 @@ func allArch() []string {
 	// 返回需要配置的架构列表
 	return out
 }
+
+// allManagedArch 函数：获取守护进程模式下需要持续管理的架构列表
+// 返回值：架构名称的切片
+//
+// 与 allArch 不同，已经通过 binfmt_misc 注册的架构不会被排除：
+//   - 如果架构对应的条目已注册，说明它依赖模拟器，需要管理
+//   - 如果架构被系统支持但没有对应的条目，说明是原生支持，跳过
+//   - 其他架构只要 QEMU 二进制文件存在就需要管理
+func allManagedArch() []string {
+	m := map[string]struct{}{}
+	for _, pp := range formatPlatforms(archutil.SupportedPlatforms(true)) {
+		if p, err := platforms.Parse(pp); err == nil {
+			m[p.Architecture] = struct{}{}
+		}
+	}
+
+	out := make([]string, 0, len(configs))
+	for name := range configs {
+		var binaryBasename, fullPath string
+		cfg, err := archConfig(name)
+		if err == nil {
+			binaryBasename, fullPath, err = getBinaryNames(cfg)
+		}
+		if err != nil {
+			// 让守护进程报告错误
+			out = append(out, name)
+			continue
+		}
+		if _, err := fsys.Stat(filepath.Join(mount, binaryBasename)); err == nil {
+			out = append(out, name)
+			continue
+		}
+		if _, ok := m[name]; ok {
+			continue
+		}
+		if emulatorAvailable(cfg, fullPath) {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// isNativeArch 判断架构是否由本机原生执行
+//
+// 本机的架构，以及被系统支持但没有对应条目的架构（如 amd64 主机上的 386）都是原生架构，
+// 与 allManagedArch 的判断一致
+func isNativeArch(arch string) bool {
+	if arch == runtime.GOARCH {
+		return true
+	}
+	cfg, err := archConfig(arch)
+	if err != nil {
+		return false
+	}
+	binaryBasename, _, err := getBinaryNames(cfg)
+	if err != nil {
+		return false
+	}
+	if _, err := fsys.Stat(filepath.Join(mount, binaryBasename)); err == nil {
+		return false
+	}
+	for _, pp := range formatPlatforms(archutil.SupportedPlatforms(true)) {
+		if p, err := platforms.Parse(pp); err == nil && p.Architecture == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// emulatorAvailable 判断架构的模拟器是否可以安装
+// 指定了 -embedded 时检查是否内嵌了该模拟器，否则检查二进制文件是否存在
+func emulatorAvailable(cfg config, fullPath string) bool {
+	if useEmbedded {
+		return hasEmbedded(cfg.binary)
+	}
+	_, err := os.Stat(fullPath)
+	return err == nil
+}
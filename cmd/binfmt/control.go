@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// controlRequest 结构体：ensure 和 release 请求的内容
+type controlRequest struct {
+	Platforms []string `json:"platforms"`       // 平台或架构列表（如 "linux/riscv64" 或 "riscv64"）
+	Lease     string   `json:"lease,omitempty"` // 租约 ID，ensure 时为空则创建新的租约
+}
+
+// controlResult 结构体：单个架构的处理结果
+type controlResult struct {
+	Arch    string `json:"arch"`              // 架构名称
+	Name    string `json:"name,omitempty"`    // 条目名称
+	Action  string `json:"action"`            // 执行的操作
+	Refs    int    `json:"refs"`              // 处理后的租约数
+	Lease   string `json:"lease,omitempty"`   // ensure 使用的租约 ID，续约和 release 时传入
+	Expires string `json:"expires,omitempty"` // 租约的到期时间（RFC 3339）
+	Message string `json:"error,omitempty"`   // 处理失败时的错误
+}
+
+// controlStatus 结构体：status 请求的返回内容
+// 在 printStatus 的输出基础上增加了按需请求的架构及其引用计数
+type controlStatus struct {
+	status
+	Refs map[string]int `json:"refs"` // 按需请求的架构及其租约数
+}
+
+// serveControl 在 Unix 套接字上提供按需注册模拟器的控制接口，直到 ctx 被取消
+//
+// 参数:
+//
+//	ctx: 上下文，取消时关闭监听并删除套接字文件
+//	d: 守护进程
+//	path: 套接字文件路径
+//
+// 返回值:
+//
+//	error: 如果无法监听返回错误
+//
+// 接口（HTTP + JSON）:
+//   - GET  /status：返回状态和每个架构的租约数
+//   - POST /ensure：{"platforms": ["linux/riscv64"], "lease": "<id>"}，创建或续约租约并确保模拟器已注册，返回租约 ID
+//   - POST /release：{"platforms": ["linux/riscv64"], "lease": "<id>"}，释放租约，最后一个租约释放时卸载由守护进程注册的条目
+//
+// 示例:
+//
+//	curl --unix-socket /run/binfmt.sock -d '{"platforms":["linux/riscv64"]}' http://binfmt/ensure
+//
+// 注意:
+//   - 套接字权限为 0660，只有 root 和同组用户可以访问
+//   - 租约在 -control-lease 之后到期，到期时与 release 一样释放
+func serveControl(ctx context.Context, d *daemon, path string) error {
+	// 删除上次运行残留的套接字文件
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return err
+	}
+
+	srv := &http.Server{Handler: controlHandler(d), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+		os.Remove(path)
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			slog.Error("control server failed", "error", err)
+		}
+	}()
+	slog.Info("control: listening", "path", path)
+	return nil
+}
+
+// controlHandler 返回控制接口的 HTTP 处理器
+func controlHandler(d *daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeControlError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		st, err := getStatus()
+		if err != nil {
+			writeControlError(w, http.StatusInternalServerError, err)
+			return
+		}
+		d.mu.Lock()
+		refs := make(map[string]int, len(d.refs))
+		for k, v := range d.refs {
+			refs[k] = len(v)
+		}
+		d.mu.Unlock()
+		writeControlJSON(w, http.StatusOK, controlStatus{status: *st, Refs: refs})
+	})
+	mux.HandleFunc("/ensure", func(w http.ResponseWriter, r *http.Request) {
+		handleControl(w, r, func(arch string, req *controlRequest) controlResult {
+			// 同一个请求中的所有架构使用同一个租约
+			if req.Lease == "" {
+				req.Lease = newLeaseID()
+			}
+			res, refs, err := d.ensure(arch, req.Lease)
+			out := controlResult{Arch: arch, Name: res.name, Action: res.action, Refs: refs}
+			if err != nil {
+				out.Message = err.Error()
+			} else {
+				out.Lease = req.Lease
+				out.Expires = time.Now().Add(d.lease).UTC().Format(time.RFC3339)
+			}
+			return out
+		})
+	})
+	mux.HandleFunc("/release", func(w http.ResponseWriter, r *http.Request) {
+		handleControl(w, r, func(arch string, req *controlRequest) controlResult {
+			removed, refs, err := d.release(arch, req.Lease)
+			out := controlResult{Arch: arch, Action: actionOK, Refs: refs}
+			if removed {
+				out.Action = "uninstalled"
+			}
+			if err != nil {
+				out.Action, out.Message = actionFailed, err.Error()
+			}
+			return out
+		})
+	})
+	return mux
+}
+
+// handleControl 解析 ensure 和 release 请求，并对每个架构调用 fn
+//
+// 注意:
+//   - 任何一个架构处理失败时返回 409，但其他架构的结果仍然有效
+func handleControl(w http.ResponseWriter, r *http.Request, fn func(arch string, req *controlRequest) controlResult) {
+	if r.Method != http.MethodPost {
+		writeControlError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	var req controlRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeControlError(w, http.StatusBadRequest, errors.Wrap(err, "invalid request"))
+		return
+	}
+	if len(req.Platforms) == 0 {
+		writeControlError(w, http.StatusBadRequest, errors.New("no platforms specified"))
+		return
+	}
+
+	archs := map[string]struct{}{}
+	for _, p := range req.Platforms {
+		for _, arch := range parseArch(p) {
+			if _, ok := configs[arch]; !ok {
+				writeControlError(w, http.StatusBadRequest, errors.Errorf("unsupported architecture: %v", arch))
+				return
+			}
+			archs[arch] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(archs))
+	for arch := range archs {
+		sorted = append(sorted, arch)
+	}
+	sort.Strings(sorted)
+
+	code := http.StatusOK
+	results := make([]controlResult, 0, len(sorted))
+	for _, arch := range sorted {
+		res := fn(arch, &req)
+		if res.Message != "" {
+			code = http.StatusConflict
+		}
+		results = append(results, res)
+	}
+	writeControlJSON(w, code, struct {
+		Results []controlResult `json:"results"`
+	}{results})
+}
+
+// newLeaseID 返回随机的租约 ID
+func newLeaseID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// writeControlJSON 以 JSON 格式返回结果
+func writeControlJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeControlError 以 JSON 格式返回错误
+func writeControlError(w http.ResponseWriter, code int, err error) {
+	writeControlJSON(w, code, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestControlRefcount 测试按需注册的引用计数
+func TestControlRefcount(t *testing.T) {
+	f := newFakeFS(t, true)
+	fakeInterpreters(t, "arm64", "riscv64")
+
+	d := newDaemon([]string{"arm64"}, time.Hour)
+	d.reconcile()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sock := filepath.Join(t.TempDir(), "binfmt.sock")
+	if err := serveControl(ctx, d, sock); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+
+	call := func(op, body string) (int, []controlResult) {
+		t.Helper()
+		resp, err := client.Post("http://binfmt/"+op, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out struct {
+			Results []controlResult `json:"results"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, out.Results
+	}
+
+	code, res := call("ensure", `{"platforms":["linux/riscv64"]}`)
+	if code != http.StatusOK || res[0].Action != actionRegistered || res[0].Refs != 1 {
+		t.Fatalf("unexpected result %d %+v", code, res)
+	}
+	code, res = call("ensure", `{"platforms":["riscv64","linux/arm64"]}`)
+	if code != http.StatusOK || res[0].Action != actionOK || res[0].Refs != 1 || res[1].Refs != 2 {
+		t.Fatalf("unexpected result %d %+v", code, res)
+	}
+
+	resp, err := client.Get("http://binfmt/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st controlStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !reflect.DeepEqual(st.Refs, map[string]int{"arm64": 1, "riscv64": 2}) {
+		t.Fatalf("unexpected refs %v", st.Refs)
+	}
+
+	// 第一次释放只减少引用计数
+	if _, res = call("release", `{"platforms":["linux/riscv64"]}`); res[0].Action != actionOK || res[0].Refs != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	// 引用计数归零时卸载，但启动时指定的架构保留
+	if _, res = call("release", `{"platforms":["linux/riscv64","linux/arm64"]}`); res[0].Action != actionOK || res[1].Action != "uninstalled" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if got := f.names(); !reflect.DeepEqual(got, []string{"qemu-aarch64"}) {
+		t.Fatalf("unexpected entries %v", got)
+	}
+
+	code, res = call("release", `{"platforms":["riscv64"]}`)
+	if code != http.StatusConflict || res[0].Message == "" {
+		t.Fatalf("expected release without ensure to fail, got %d %+v", code, res)
+	}
+	code, _ = call("ensure", `{"platforms":["foo"]}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected unsupported architecture to fail, got %d", code)
+	}
+}
+
+// TestControlLease 测试租约的续约、按 ID 释放和到期释放，以及拒绝原生架构
+func TestControlLease(t *testing.T) {
+	f := newFakeFS(t, true)
+	fakeInterpreters(t, "riscv64", "s390x")
+	d := newDaemon(nil, time.Hour)
+
+	if _, _, err := d.ensure(runtime.GOARCH, "a"); err == nil || !strings.Contains(err.Error(), "native") {
+		t.Fatalf("expected native architecture to be rejected, got %v", err)
+	}
+	if len(f.names()) != 0 {
+		t.Fatalf("unexpected entries %v", f.names())
+	}
+
+	// 同一个租约再次 ensure 只续约
+	for i := 0; i < 2; i++ {
+		if _, refs, err := d.ensure("riscv64", "a"); err != nil || refs != 1 {
+			t.Fatalf("unexpected refs %d: %v", refs, err)
+		}
+	}
+	if _, refs, _ := d.ensure("riscv64", "b"); refs != 2 {
+		t.Fatalf("expected two leases, got %d", refs)
+	}
+	if _, _, err := d.release("riscv64", "c"); err == nil {
+		t.Fatal("expected error for unknown lease")
+	}
+	if removed, refs, err := d.release("riscv64", "b"); err != nil || removed || refs != 1 {
+		t.Fatalf("unexpected release %v %d: %v", removed, refs, err)
+	}
+
+	// 客户端没有 release 就退出时，租约到期后条目被卸载
+	d.lease = time.Millisecond
+	if _, _, err := d.ensure("s390x", "c"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	d.reconcile()
+	if got := f.names(); !reflect.DeepEqual(got, []string{"qemu-riscv64"}) {
+		t.Fatalf("unexpected entries %v", got)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.refs["s390x"]; ok {
+		t.Fatalf("expired lease not released: %v", d.refs)
+	}
+}
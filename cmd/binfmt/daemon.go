@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// 协调操作的结果
+const (
+	actionOK         = "ok"         // 条目与期望一致，无需处理
+	actionRegistered = "registered" // 条目缺失，已重新注册
+	actionReplaced   = "replaced"   // 条目与期望不一致，已删除并重新注册
+	actionEnabled    = "enabled"    // 条目被禁用，已重新启用
+	actionFailed     = "failed"     // 处理失败
+)
+
+// reconcileResult 结构体：单个架构的协调结果
+type reconcileResult struct {
+	arch   string // 架构名称（如 "arm64"）
+	name   string // 条目名称（如 "qemu-aarch64"）
+	action string // 执行的操作
+	reason string // 执行操作的原因
+	err    error  // 处理失败时的错误
+}
+
+// attrs 返回协调结果的日志字段
+func (res reconcileResult) attrs() []any {
+	attrs := []any{"action", res.action, "arch", res.arch, "handler", res.name, "reason", res.reason}
+	if res.err != nil {
+		attrs = append(attrs, "error", res.err)
+	}
+	return attrs
+}
+
+// daemon 结构体：持续运行的协调守护进程
+//
+// 守护进程定期比较 binfmt_misc 中实际注册的条目与期望的架构列表，
+// 重新注册缺失或被修改的条目，并记录每一次修正。
+// 适用于 Kubernetes DaemonSet 等需要长期保证注册存在的场景。
+type daemon struct {
+	mu       sync.Mutex
+	archs    []string                        // 期望注册的架构列表
+	interval time.Duration                   // 两次协调之间的间隔
+	owned    map[string]struct{}             // 由守护进程注册的条目名称
+	lease    time.Duration                   // 控制套接字的租约时长，到期没有续约的引用被释放
+	refs     map[string]map[string]time.Time // 通过控制套接字按需请求的架构，每个租约 ID 及其到期时间
+
+	// hooks 在每次协调完成后调用，参数为协调结果和协调后的状态
+	hooks []func([]reconcileResult, *status)
+}
+
+// newDaemon 创建守护进程
+//
+// 参数:
+//
+//	archs: 期望注册的架构列表
+//	interval: 两次协调之间的间隔
+//
+// 返回值:
+//
+//	*daemon: 守护进程
+func newDaemon(archs []string, interval time.Duration) *daemon {
+	return &daemon{
+		archs:    archs,
+		interval: interval,
+		owned:    map[string]struct{}{},
+		lease:    controlLease,
+		refs:     map[string]map[string]time.Time{},
+	}
+}
+
+// runDaemon 以守护进程模式运行，直到收到 SIGTERM 或 SIGINT
+//
+// 参数:
+//
+//	archs: 期望注册的架构列表
+//
+// 返回值:
+//
+//	error: 如果运行失败返回错误，正常退出返回 nil
+//
+// 注意:
+//   - 如果指定了 -metrics-addr，同时提供 /metrics、/healthz 和 /readyz
+//   - 如果指定了 -control-socket，同时提供按需注册模拟器的控制接口
+//   - 第一次协调完成后打印状态，输出格式与非守护进程模式一致
+//   - 只使用 Go 标准库和 binfmt_misc 挂载点，可以直接在基于 scratch 的镜像中运行
+func runDaemon(archs []string) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+
+	d := newDaemon(archs, daemonInterval)
+
+	// 如果指定了 -metrics-addr，在第一次协调之前开始提供指标和健康检查
+	if metricsAddr != "" {
+		m := newMetrics(archs, daemonInterval)
+		d.hooks = append(d.hooks, m.update)
+		if err := m.serve(ctx, metricsAddr); err != nil {
+			return errors.Wrapf(err, "cannot listen on %s", metricsAddr)
+		}
+	}
+
+	// 如果指定了 -labels-file 或 -nfd-features-file，每次协调后更新节点标签
+	if labelsFile != "" || nfdFeaturesFile != "" {
+		d.hooks = append(d.hooks, func(_ []reconcileResult, st *status) {
+			if err := writeNodeLabels(st); err != nil {
+				slog.Error("cannot write node labels", "error", err)
+			}
+		})
+	}
+
+	// 如果指定了 -control-socket，提供按需注册模拟器的控制接口
+	if controlSocket != "" {
+		if err := serveControl(ctx, d, controlSocket); err != nil {
+			return errors.Wrapf(err, "cannot listen on %s", controlSocket)
+		}
+	}
+
+	d.reconcile()
+	if err := printStatus(); err != nil {
+		return err
+	}
+	return d.run(ctx)
+}
+
+// run 定期执行协调，直到 ctx 被取消
+//
+// 参数:
+//
+//	ctx: 上下文，取消时守护进程退出
+//
+// 返回值:
+//
+//	error: 正常退出返回 nil
+//
+// 注意:
+//   - 如果设置了 -uninstall-on-exit，退出前会卸载由守护进程注册的条目
+func (d *daemon) run(ctx context.Context) error {
+	slog.Info("daemon: watching", "archs", d.archs, "interval", d.interval)
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("daemon: shutting down")
+			if daemonUninstallOnExit {
+				d.cleanup()
+			}
+			return nil
+		case <-ticker.C:
+			d.reconcile()
+		}
+	}
+}
+
+// reconcile 执行一次协调
+//
+// 返回值:
+//
+//	[]reconcileResult: 每个架构的协调结果
+//
+// 工作原理:
+// 1. 如果 binfmt_misc 被卸载或重新挂载，重新挂载
+// 2. 对每个期望的架构，读取实际的条目
+// 3. 条目缺失时重新注册
+// 4. 条目被禁用时重新启用
+// 5. 条目与期望不一致时（如解释器路径或标志位被修改）删除并重新注册
+//
+// 注意:
+//   - 通过控制套接字按需请求的架构也会被协调，先释放已经到期的租约
+func (d *daemon) reconcile() []reconcileResult {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expireLocked(time.Now())
+
+	if _, ok := isMounted(); !ok {
+		slog.Warn("daemon: binfmt_misc not mounted, mounting", "mount", mount)
+		if err := mountBinfmt(); err != nil {
+			slog.Error("daemon: cannot mount binfmt_misc", "mount", mount, "error", err)
+		}
+	}
+
+	archs := d.desiredLocked()
+	results := make([]reconcileResult, 0, len(archs))
+	for _, arch := range archs {
+		res := d.reconcileArch(arch)
+		switch res.action {
+		case actionOK:
+		case actionFailed:
+			slog.Error("reconcile failed", res.attrs()...)
+		default:
+			slog.Info("reconcile", res.attrs()...)
+		}
+		results = append(results, res)
+	}
+	if len(d.hooks) > 0 {
+		st, err := getStatus()
+		if err != nil {
+			slog.Error("daemon: cannot read status", "error", err)
+			st = &status{}
+		}
+		for _, h := range d.hooks {
+			h(results, st)
+		}
+	}
+	return results
+}
+
+// desiredLocked 返回当前期望注册的所有架构
+// 包括启动时指定的架构和通过控制套接字按需请求的架构，调用者必须持有 d.mu
+func (d *daemon) desiredLocked() []string {
+	archs := append([]string{}, d.archs...)
+	var extra []string
+	for arch := range d.refs {
+		if !d.isStatic(arch) {
+			extra = append(extra, arch)
+		}
+	}
+	sort.Strings(extra)
+	return append(archs, extra...)
+}
+
+// isStatic 判断架构是否在启动时指定的期望列表中
+func (d *daemon) isStatic(arch string) bool {
+	for _, a := range d.archs {
+		if a == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// ensure 为架构添加或续约一个租约，并确保其模拟器已注册
+//
+// 参数:
+//
+//	arch: 架构名称
+//	lease: 租约 ID，已经存在时续约
+//
+// 返回值:
+//
+//	reconcileResult: 协调结果
+//	int: 架构当前的租约数
+//	error: 如果架构是原生架构或注册失败返回错误，此时不会添加租约
+//
+// 注意:
+//   - 与 allArch 一样跳过原生架构，否则会为本机的程序注册模拟器
+//   - 租约在 -control-lease 之后到期，客户端需要在到期之前再次 ensure 续约，
+//     这样客户端在 release 之前崩溃时条目不会被永远保留
+func (d *daemon) ensure(arch, lease string) (reconcileResult, int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if isNativeArch(arch) {
+		return reconcileResult{arch: arch, action: actionFailed}, len(d.refs[arch]), errors.Errorf("%s is a native architecture", arch)
+	}
+	res := d.reconcileArch(arch)
+	if res.action == actionFailed {
+		return res, len(d.refs[arch]), errors.Wrap(res.err, res.reason)
+	}
+	if res.action != actionOK {
+		slog.Info("ensure", res.attrs()...)
+	}
+	if d.refs[arch] == nil {
+		d.refs[arch] = map[string]time.Time{}
+	}
+	d.refs[arch][lease] = time.Now().Add(d.lease)
+	return res, len(d.refs[arch]), nil
+}
+
+// release 释放架构的一个租约，最后一个租约释放时卸载由守护进程注册的条目
+//
+// 参数:
+//
+//	arch: 架构名称
+//	lease: 租约 ID，为空时释放最早到期的租约
+//
+// 返回值:
+//
+//	bool: 是否卸载了条目
+//	int: 释放后的租约数
+//	error: 如果没有对应的租约或卸载失败返回错误
+//
+// 注意:
+//   - 启动时指定的架构和不是由守护进程注册的条目不会被卸载
+func (d *daemon) release(arch, lease string) (bool, int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	leases := d.refs[arch]
+	if lease == "" {
+		for id, exp := range leases {
+			if lease == "" || exp.Before(leases[lease]) {
+				lease = id
+			}
+		}
+	}
+	if _, ok := leases[lease]; !ok {
+		return false, len(leases), errors.Errorf("%s was not ensured", arch)
+	}
+	delete(leases, lease)
+	if len(leases) > 0 {
+		return false, len(leases), nil
+	}
+	removed, err := d.dropLocked(arch)
+	return removed, 0, err
+}
+
+// expireLocked 释放已经到期的租约，调用者必须持有 d.mu
+func (d *daemon) expireLocked(now time.Time) {
+	for arch, leases := range d.refs {
+		for id, exp := range leases {
+			if !now.Before(exp) {
+				delete(leases, id)
+				slog.Warn("lease expired", "action", "release", "arch", arch, "lease", id)
+			}
+		}
+		if len(leases) > 0 {
+			continue
+		}
+		if _, err := d.dropLocked(arch); err != nil {
+			logResult("release", err, "arch", arch)
+		}
+	}
+}
+
+// dropLocked 在架构没有租约时停止管理它，并卸载由守护进程注册的条目，调用者必须持有 d.mu
+func (d *daemon) dropLocked(arch string) (bool, error) {
+	delete(d.refs, arch)
+	if d.isStatic(arch) {
+		return false, nil
+	}
+
+	r, err := getRegistration(arch)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := d.owned[r.name]; !ok {
+		return false, nil
+	}
+	if err := writeEntry(r.name, "-1"); err != nil {
+		return false, err
+	}
+	delete(d.owned, r.name)
+	logResult("release", nil, "arch", arch, "handler", r.name)
+	return true, nil
+}
+
+// reconcileArch 协调单个架构
+//
+// 参数:
+//
+//	arch: 架构名称
+//
+// 返回值:
+//
+//	reconcileResult: 协调结果
+//
+// 注意:
+//   - 调用者必须持有 d.mu
+func (d *daemon) reconcileArch(arch string) reconcileResult {
+	res := reconcileResult{arch: arch, action: actionOK}
+
+	r, err := getRegistration(arch)
+	if err != nil {
+		res.action, res.reason, res.err = actionFailed, "invalid configuration", err
+		return res
+	}
+	res.name = r.name
+
+	e, err := readEntry(r.name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		res.action, res.reason = actionRegistered, r.name+" missing"
+	case err != nil:
+		res.action, res.reason, res.err = actionFailed, "cannot read "+r.name, err
+		return res
+	case !e.matches(r):
+		res.action, res.reason = actionReplaced, r.name+" drifted, interpreter "+e.interpreter+" flags "+e.flags
+		// 通过临时条目替换，替换过程中该架构的程序仍然可以执行
+		if err := swapEntry(r); err != nil {
+			res.action, res.reason, res.err = actionFailed, "cannot replace "+r.name, err
+			return res
+		}
+		d.owned[r.name] = struct{}{}
+		return res
+	case !e.enabled:
+		if err := writeEntry(r.name, "1"); err != nil {
+			res.action, res.reason, res.err = actionFailed, "cannot enable "+r.name, err
+			return res
+		}
+		res.action, res.reason = actionEnabled, r.name+" disabled"
+		return res
+	default:
+		return res
+	}
+
+	if err := register(r); err != nil {
+		res.action, res.reason, res.err = actionFailed, "cannot register "+r.name, err
+		return res
+	}
+	d.owned[r.name] = struct{}{}
+	return res
+}
+
+// cleanup 卸载由守护进程注册的条目
+//
+// 注意:
+//   - 只卸载守护进程自己注册的条目，启动前已经存在且与期望一致的条目不会被卸载
+func (d *daemon) cleanup() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for name := range d.owned {
+		logResult("uninstall", writeEntry(name, "-1"), "handler", name)
+		delete(d.owned, name)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestDaemonReconcile 测试守护进程修正缺失、禁用和被修改的条目
+func TestDaemonReconcile(t *testing.T) {
+	f := newFakeFS(t, true)
+	dir := fakeInterpreters(t, "arm64", "riscv64", "s390x")
+
+	if err := install("s390x"); err != nil {
+		t.Fatal(err)
+	}
+	d := newDaemon([]string{"arm64", "riscv64", "s390x"}, time.Hour)
+
+	actions := func(results []reconcileResult) []string {
+		var out []string
+		for _, r := range results {
+			out = append(out, r.action)
+		}
+		return out
+	}
+
+	if got := actions(d.reconcile()); !reflect.DeepEqual(got, []string{actionRegistered, actionRegistered, actionOK}) {
+		t.Fatalf("unexpected actions %v", got)
+	}
+	if got := actions(d.reconcile()); !reflect.DeepEqual(got, []string{actionOK, actionOK, actionOK}) {
+		t.Fatalf("unexpected actions %v", got)
+	}
+
+	// 禁用一个条目，并用不同的解释器替换另一个条目
+	if err := writeEntry("qemu-aarch64", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeEntry("qemu-riscv64", "-1"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := getRegistration("riscv64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.interpreter = filepath.Join(dir, "qemu-s390x")
+	if err := register(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// 替换被修改的条目时，riscv64 的程序始终有已启用的条目可以处理
+	f.afterWrite = func() {
+		for _, name := range f.names() {
+			if e, ok := f.entry(name); ok && !e.disabled && name != "qemu-aarch64" && name != "qemu-s390x" {
+				return
+			}
+		}
+		t.Errorf("no handler for riscv64 after write, entries %v", f.names())
+	}
+	if got := actions(d.reconcile()); !reflect.DeepEqual(got, []string{actionEnabled, actionReplaced, actionOK}) {
+		t.Fatalf("unexpected actions %v", got)
+	}
+	f.afterWrite = nil
+	e, ok := f.entry("qemu-riscv64")
+	if !ok || e.interpreter != filepath.Join(dir, "qemu-riscv64") {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	// 退出时只卸载由守护进程注册的条目
+	defer func(old bool) { daemonUninstallOnExit = old }(daemonUninstallOnExit)
+	daemonUninstallOnExit = true
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.names(); !reflect.DeepEqual(got, []string{"qemu-s390x"}) {
+		t.Fatalf("unexpected entries %v", got)
+	}
+}
+
+// TestDaemonRemount 测试 binfmt_misc 被卸载后守护进程重新挂载并注册
+func TestDaemonRemount(t *testing.T) {
+	f := newFakeFS(t, true)
+	fakeInterpreters(t, "arm64")
+
+	d := newDaemon([]string{"arm64"}, time.Hour)
+	d.reconcile()
+	if err := f.WriteFile(filepath.Join(mount, "status"), []byte("-1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Unmount(mount, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	results := d.reconcile()
+	if f.mounts != 1 {
+		t.Fatalf("expected remount, got %d mounts", f.mounts)
+	}
+	if results[0].action != actionRegistered {
+		t.Fatalf("unexpected result %+v", results[0])
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// debugSuffix 是调试模式下包装程序名称的后缀，与正常的配置区分
+const debugSuffix = "-debug"
+
+// debugConfig 结构体：调试模式下包装程序使用的配置
+type debugConfig struct {
+	Match  []string `json:"match,omitempty"`  // 要调试的程序的路径模式，为空时调试所有程序
+	Port   int      `json:"port,omitempty"`   // gdbstub 监听的 TCP 端口
+	Socket string   `json:"socket,omitempty"` // gdbstub 监听的 Unix 套接字路径，其中的 %d 替换为进程 ID
+}
+
+// runDebug 通过调试包装程序重新注册一个架构，结束后恢复原来的条目
+//
+// 参数:
+//
+//	arch: 架构名称（如 "arm64"）
+//	d: 由 debugTarget 创建的调试配置
+//	args: 要运行的命令，为空时一直等待到收到中断信号
+//
+// 返回值:
+//
+//	error: 如果注册或恢复失败，或命令运行失败返回错误
+//
+// 匹配 -debug-match 的程序在 QEMU 的 gdbstub 下启动，暂停在第一条指令，
+// 等待 gdb 连接 -debug-socket 或 -debug-port。包装程序在程序的标准错误中打印连接方法。
+//
+// 注意:
+//   - QEMU 的 -g 端口在所有网络接口上监听且没有认证，任何能访问该端口的人都可以控制被调试的程序，
+//     因此默认使用 Unix 套接字，指定 -debug-port 时输出警告
+//   - 其他挂载命名空间（如容器）中通常没有套接字所在的目录，其中的程序照常运行但不调试
+func runDebug(arch string, d *debugConfig, args []string) error {
+	if d.Socket != "" {
+		if err := os.MkdirAll(filepath.Dir(d.Socket), 0755); err != nil {
+			return err
+		}
+	} else {
+		slog.Warn("debugging: the QEMU gdbstub listens on all interfaces without authentication, anyone who can reach the port can control the program",
+			"action", "debug", "arch", arch, "port", d.Port)
+	}
+	return wrapHandler("debug", arch, debugSuffix, func(p *profile) {
+		p.Debug = d
+	}, func(name string) error {
+		slog.Info("debugging: "+d.describeMatch()+" waits for gdb", "action", "debug", "arch", arch, "handler", name,
+			"address", d.address(0), "attach", d.attachCommand(0, "<program>"))
+		err := waitCommand(args, 0)
+		slog.Info("debugging: restoring handler", "action", "debug", "arch", arch, "handler", name)
+		return err
+	})
+}
+
+// debugTarget 检查 -debug 与其他参数的组合并创建调试配置
+//
+// 返回值:
+//
+//	string: 要调试的架构，没有指定 -debug 时为空
+//	*debugConfig: 调试配置
+//	error: 如果 -debug 与 -userns 或 -daemon 同时使用、没有指定恰好一个架构或调试参数无效返回错误
+//
+// 注意:
+//   - 在卸载、持久化、升级或安装之前调用，参数冲突时不修改任何条目
+func debugTarget() (string, *debugConfig, error) {
+	if debugArch == "" {
+		return "", nil, nil
+	}
+	if flUserNS {
+		return "", nil, errors.New("-debug cannot be used with -userns")
+	}
+	if flDaemon {
+		return "", nil, errors.New("-debug cannot be used with -daemon")
+	}
+	arch := parseArch(debugArch)
+	if len(arch) != 1 {
+		return "", nil, errors.Errorf("-debug accepts exactly one architecture, got %q", debugArch)
+	}
+	d, err := newDebugConfig(debugMatch, debugPort, debugSocket)
+	if err != nil {
+		return "", nil, err
+	}
+	return arch[0], d, nil
+}
+
+// newDebugConfig 根据命令行参数创建调试配置
+//
+// 参数:
+//
+//	match: 用 "," 分隔的路径模式（如 "*/myapp,/usr/bin/*"）
+//	port: TCP 端口，不为 0 时优先于 socket
+//	socket: Unix 套接字路径
+//
+// 返回值:
+//
+//	*debugConfig: 调试配置
+//	error: 如果模式无效、端口超出范围、套接字路径不是绝对路径或两者都没有指定返回错误
+func newDebugConfig(match string, port int, socket string) (*debugConfig, error) {
+	d := &debugConfig{}
+	for _, m := range strings.Split(match, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		if _, err := filepath.Match(m, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid debug pattern %q", m)
+		}
+		d.Match = append(d.Match, m)
+	}
+	if port != 0 {
+		if port < 0 || port > 65535 {
+			return nil, errors.Errorf("invalid debug port %d", port)
+		}
+		d.Port = port
+		return d, nil
+	}
+	if socket == "" {
+		return nil, errors.New("debugging requires a socket path or a port")
+	}
+	if !filepath.IsAbs(socket) {
+		return nil, errors.Errorf("debug socket %q must be an absolute path", socket)
+	}
+	d.Socket = socket
+	return d, nil
+}
+
+// matches 判断程序是否需要调试
+// 包含 "/" 的模式匹配完整路径，其他模式只匹配文件名
+func (d *debugConfig) matches(program string) bool {
+	if len(d.Match) == 0 {
+		return true
+	}
+	program = filepath.Clean(program)
+	for _, m := range d.Match {
+		name := filepath.Base(program)
+		if strings.Contains(m, "/") {
+			name = program
+		}
+		if ok, _ := filepath.Match(m, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// describeMatch 返回匹配的程序的描述，用于日志
+func (d *debugConfig) describeMatch() string {
+	if len(d.Match) == 0 {
+		return "every program"
+	}
+	return "programs matching " + strings.Join(d.Match, ",")
+}
+
+// address 返回进程的 gdbstub 地址
+// pid 为 0 时返回地址模板，用于在启动时打印
+func (d *debugConfig) address(pid int) string {
+	if d.Socket == "" {
+		return "localhost:" + strconv.Itoa(d.Port)
+	}
+	if pid == 0 {
+		return d.Socket
+	}
+	return strings.ReplaceAll(d.Socket, "%d", strconv.Itoa(pid))
+}
+
+// attachCommand 返回连接进程的 gdb-multiarch 命令
+// gdb 从程序文件中识别架构，因此不需要 set architecture
+func (d *debugConfig) attachCommand(pid int, program string) string {
+	return fmt.Sprintf("gdb-multiarch -ex 'target remote %s' %s", d.address(pid), program)
+}
+
+// debugArgs 在包装程序中返回让 QEMU 启动 gdbstub 的参数
+//
+// 参数:
+//
+//	d: 调试配置
+//	program: 要运行的程序路径
+//
+// 返回值:
+//
+//	[]string: QEMU 的 -g 参数，不调试时为空
+//
+// 注意:
+//   - 程序不匹配时不调试
+//   - TCP 端口同一时间只能被一个进程使用，端口被占用时不调试，程序照常运行
+//   - 程序的用户不能在套接字目录中创建文件时（默认目录只有 root 可写）不调试，程序照常运行
+func debugArgs(d *debugConfig, program string) []string {
+	if !d.matches(program) {
+		return nil
+	}
+	pid := os.Getpid()
+	if d.Socket != "" {
+		if err := unix.Access(filepath.Dir(d.Socket), unix.W_OK); err != nil {
+			fmt.Fprintf(os.Stderr, "binfmt: cannot create a gdb socket in %s, not debugging %s\n", filepath.Dir(d.Socket), program)
+			return nil
+		}
+	} else {
+		ln, err := net.Listen("tcp", ":"+strconv.Itoa(d.Port))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "binfmt: port %d is busy, not debugging %s\n", d.Port, program)
+			return nil
+		}
+		ln.Close()
+	}
+	fmt.Fprintf(os.Stderr, "binfmt: %s (pid %d) is waiting for gdb on %s\n", program, pid, d.address(pid))
+	fmt.Fprintf(os.Stderr, "binfmt: attach with: %s\n", d.attachCommand(pid, program))
+	if d.Socket == "" {
+		return []string{"-g", strconv.Itoa(d.Port)}
+	}
+	return []string{"-g", d.address(pid)}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestDebugConfig 测试调试参数的校验和程序的匹配
+func TestDebugConfig(t *testing.T) {
+	for _, tc := range []struct {
+		match  string
+		port   int
+		socket string
+	}{
+		{match: "[", port: 1234},
+		{port: 0},
+		{port: -1, socket: "/run/gdb.sock"},
+		{port: 70000},
+		{socket: "gdb.sock"},
+	} {
+		if _, err := newDebugConfig(tc.match, tc.port, tc.socket); err == nil {
+			t.Errorf("%+v: expected error", tc)
+		}
+	}
+
+	// 明确指定的端口优先于默认的套接字
+	d, err := newDebugConfig("myapp, /usr/bin/*", 1234, "/run/gdb-%d.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Port != 1234 || d.Socket != "" {
+		t.Fatalf("unexpected config %+v", d)
+	}
+	for program, expected := range map[string]bool{
+		"/opt/app/myapp":    true,
+		"./myapp":           true,
+		"/usr/bin/ls":       true,
+		"/usr/bin/x/ls":     false,
+		"/usr/local/bin/ls": false,
+	} {
+		if got := d.matches(program); got != expected {
+			t.Errorf("%s: expected %v, got %v", program, expected, got)
+		}
+	}
+}
+
+// TestDebugArgs 测试只有匹配的程序在 gdbstub 下启动，套接字路径中的 %d 替换为进程 ID
+func TestDebugArgs(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "gdb-%d.sock")
+	d, err := newDebugConfig("myapp", 0, sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := debugArgs(d, "/bin/ls"); args != nil {
+		t.Fatalf("expected no debugging for unmatched program, got %v", args)
+	}
+	expected := []string{"-g", filepath.Join(filepath.Dir(sock), "gdb-"+strconv.Itoa(os.Getpid())+".sock")}
+	if args := debugArgs(d, "/opt/myapp"); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("unexpected args %v", args)
+	}
+
+	// 套接字目录不可写时程序照常运行
+	d.Socket = filepath.Join(t.TempDir(), "missing", "gdb-%d.sock")
+	if args := debugArgs(d, "/opt/myapp"); args != nil {
+		t.Fatalf("expected no debugging without a writable socket directory, got %v", args)
+	}
+}
+
+// TestDebugTarget 测试 -debug 的参数冲突和无效的调试参数在安装、卸载等修改之前就被拒绝
+func TestDebugTarget(t *testing.T) {
+	defer func(debug, install, uninstall, socket string, port int, userns, daemon bool) {
+		debugArch, toInstall, toUninstall, debugSocket, debugPort, flUserNS, flDaemon = debug, install, uninstall, socket, port, userns, daemon
+	}(debugArch, toInstall, toUninstall, debugSocket, debugPort, flUserNS, flDaemon)
+
+	tests := []struct {
+		debug     string
+		socket    string
+		port      int
+		userns    bool
+		daemon    bool
+		expectErr string
+	}{
+		{debug: "arm64", socket: "/run/gdb.sock", userns: true, expectErr: "cannot be used with -userns"},
+		{debug: "arm64", socket: "/run/gdb.sock", daemon: true, expectErr: "cannot be used with -daemon"},
+		{debug: "arm64,riscv64", socket: "/run/gdb.sock", expectErr: "exactly one architecture"},
+		{debug: "arm64", socket: "gdb.sock", expectErr: "must be an absolute path"},
+		{debug: "arm64", port: 70000, expectErr: "invalid debug port"},
+	}
+	for _, tc := range tests {
+		f := newFakeFS(t, true)
+		fakeInterpreters(t, "arm64", "riscv64")
+		if err := install("riscv64"); err != nil {
+			t.Fatal(err)
+		}
+		debugArch, debugSocket, debugPort, flUserNS, flDaemon = tc.debug, tc.socket, tc.port, tc.userns, tc.daemon
+		toInstall, toUninstall = "arm64", "riscv64"
+
+		if _, _, err := debugTarget(); err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+			t.Errorf("%+v: expected error %q, got %v", tc, tc.expectErr, err)
+		}
+		// 同时指定的 -install 和 -uninstall 不会被执行
+		if err := run(); err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+			t.Errorf("%+v: expected error %q from run, got %v", tc, tc.expectErr, err)
+		}
+		if got := f.names(); len(got) != 1 || got[0] != "qemu-riscv64" {
+			t.Errorf("%+v: expected entries to be unchanged, got %v", tc, got)
+		}
+	}
+}
+
+// TestRunDebug 测试调试期间注册调试包装程序，默认使用 Unix 套接字，结束后恢复条目
+func TestRunDebug(t *testing.T) {
+	defer func(dir, match, socket string, port int) {
+		profileDir, debugMatch, debugSocket, debugPort = dir, match, socket, port
+	}(profileDir, debugMatch, debugSocket, debugPort)
+	profileDir = t.TempDir()
+	debugMatch = "myapp"
+	debugSocket = filepath.Join(t.TempDir(), "debug", "gdb-%d.sock")
+	debugPort = 0
+
+	f := newFakeFS(t, true)
+	dir := fakeInterpreters(t, "arm64")
+	if err := install("arm64"); err != nil {
+		t.Fatal(err)
+	}
+
+	wrapper := filepath.Join(profileDir, "qemu-aarch64"+debugSuffix)
+	var interpreters []string
+	var p *profile
+	f.afterWrite = func() {
+		if e, ok := f.entry("qemu-aarch64"); ok {
+			interpreters = append(interpreters, e.interpreter)
+			if e.interpreter == wrapper {
+				p, _ = readProfile(wrapper)
+			}
+		}
+	}
+	d, err := newDebugConfig(debugMatch, debugPort, debugSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runDebug("arm64", d, []string{"true"}); err != nil {
+		t.Fatal(err)
+	}
+	f.afterWrite = nil
+
+	var sawDebug bool
+	for _, p := range interpreters {
+		sawDebug = sawDebug || p == wrapper
+	}
+	if !sawDebug {
+		t.Fatalf("debug handler never registered, saw %v", interpreters)
+	}
+	if p == nil || p.Debug == nil || !reflect.DeepEqual(p.Debug.Match, []string{"myapp"}) || p.Debug.Port != 0 || p.Debug.Socket != debugSocket {
+		t.Fatalf("unexpected debug profile %+v", p)
+	}
+	if e, _ := f.entry("qemu-aarch64"); e.interpreter != filepath.Join(dir, "qemu-aarch64") {
+		t.Fatalf("handler not restored: %+v", e)
+	}
+	if fi, err := os.Stat(filepath.Dir(debugSocket)); err != nil || !fi.IsDir() {
+		t.Fatalf("socket directory not created: %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 查找 QEMU 二进制文件的默认设置
+const (
+	// defaultBinaryPath 是未设置 QEMU_BINARY_PATH 时的目录，即 binfmt 镜像中模拟器所在的目录
+	defaultBinaryPath = "/usr/bin"
+
+	// defaultBinaryPatterns 是未设置 QEMU_BINARY_PATTERNS 时的候选文件名
+	// "*" 代表带前缀的二进制文件名称（如 "qemu-aarch64"）
+	defaultBinaryPatterns = "*"
+
+	// fallbackBinaryPatterns 是没有设置任何环境变量时在默认设置之后尝试的候选文件名
+	fallbackBinaryPatterns = "*,*-static"
+)
+
+// fallbackBinaryPaths 是没有设置任何环境变量时在默认设置之后查找的目录
+// 发行版的软件包把模拟器安装为 qemu-aarch64-static 或放在 /usr/libexec/qemu-binfmt 中
+var fallbackBinaryPaths = []string{defaultBinaryPath, "/usr/libexec/qemu-binfmt"}
+
+// binaryCandidate 结构体：被拒绝的候选文件及其原因
+type binaryCandidate struct {
+	Path   string `json:"path"`   // 候选文件的路径
+	Reason string `json:"reason"` // 被拒绝的原因
+}
+
+// interpreterChoice 结构体：为一个架构选择的解释器
+type interpreterChoice struct {
+	Arch     string            `json:"arch"`               // 架构名称（如 "arm64"）
+	Name     string            `json:"name"`               // 条目名称（如 "qemu-aarch64"）
+	Backend  string            `json:"backend,omitempty"`  // 非 QEMU 后端的名称（如 "fex"）
+	Path     string            `json:"path,omitempty"`     // 选中的文件，没有可用的文件时为空
+	Rejected []binaryCandidate `json:"rejected,omitempty"` // 存在但被拒绝的候选文件
+
+	binary string // 带前缀的二进制文件名称，用于没有找到文件时的默认路径
+}
+
+// binarySearchPath 返回查找 QEMU 二进制文件的目录列表
+//
+// 注意:
+//   - QEMU_BINARY_SEARCH_PATH 是用 ":" 分隔的多个目录，设置时代替 QEMU_BINARY_PATH
+//   - QEMU_BINARY_PATH 总是单个目录，目录名称中可以包含 ":"
+func binarySearchPath() []string {
+	if p := os.Getenv("QEMU_BINARY_SEARCH_PATH"); p != "" {
+		var out []string
+		for _, dir := range filepath.SplitList(p) {
+			if dir != "" {
+				out = append(out, dir)
+			}
+		}
+		if len(out) > 0 {
+			return out
+		}
+	}
+	if p := os.Getenv("QEMU_BINARY_PATH"); p != "" {
+		return []string{p}
+	}
+	return []string{defaultBinaryPath}
+}
+
+// binaryPatterns 返回候选文件名的模式列表
+// QEMU_BINARY_PATTERNS 是用 "," 分隔的模式，"*" 代表二进制文件名称
+func binaryPatterns() []string {
+	p := os.Getenv("QEMU_BINARY_PATTERNS")
+	if p == "" {
+		p = defaultBinaryPatterns
+	}
+	var out []string
+	for _, pattern := range strings.Split(p, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			out = append(out, pattern)
+		}
+	}
+	return out
+}
+
+// fallbackBinarySearch 判断是否在默认设置之后继续查找发行版安装的模拟器
+// 设置了 QEMU_BINARY_SEARCH_PATH、QEMU_BINARY_PATH 或 QEMU_BINARY_PATTERNS 时只使用指定的设置
+func fallbackBinarySearch() bool {
+	for _, env := range []string{"QEMU_BINARY_SEARCH_PATH", "QEMU_BINARY_PATH", "QEMU_BINARY_PATTERNS"} {
+		if os.Getenv(env) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// binaryCandidates 按优先级返回二进制文件的候选路径
+//
+// 参数:
+//
+//	binary: 带前缀的二进制文件名称
+//
+// 返回值:
+//
+//	[]string: 候选路径，搜索路径和候选文件名的组合在前，发行版安装的位置在后
+//	error: 如果候选文件名中包含路径分隔符返回错误
+func binaryCandidates(binary string) ([]string, error) {
+	var out []string
+	seen := map[string]struct{}{}
+	add := func(dirs, patterns []string) error {
+		for _, dir := range dirs {
+			for _, pattern := range patterns {
+				base := strings.ReplaceAll(pattern, "*", binary)
+				if strings.ContainsRune(base, os.PathSeparator) {
+					return errors.Errorf("binary pattern %q must not contain path separator", pattern)
+				}
+				p := filepath.Join(dir, base)
+				if _, ok := seen[p]; !ok {
+					seen[p] = struct{}{}
+					out = append(out, p)
+				}
+			}
+		}
+		return nil
+	}
+	if err := add(binarySearchPath(), binaryPatterns()); err != nil {
+		return nil, err
+	}
+	if fallbackBinarySearch() {
+		if err := add(fallbackBinaryPaths, strings.Split(fallbackBinaryPatterns, ",")); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// findBinary 在搜索路径中查找架构的 QEMU 二进制文件
+//
+// 参数:
+//
+//	cfg: 架构配置信息
+//
+// 返回值:
+//
+//	interpreterChoice: 选中的文件和被拒绝的候选文件，Arch 由调用者填写
+//	error: 如果 QEMU_BINARY_PREFIX 或 QEMU_BINARY_PATTERNS 不合法返回错误
+//
+// 工作原理:
+//   - 按搜索路径中目录的顺序，在每个目录中依次尝试每个候选文件名
+//   - 没有设置任何环境变量时，最后尝试 qemu-*-static 和 /usr/libexec/qemu-binfmt 中的文件
+//   - 选择第一个存在且可用的文件
+//   - 不可执行的文件会被拒绝
+//   - 不使用 F 标志时，动态链接的文件会被拒绝：内核在执行程序时才打开解释器，
+//     那时动态链接器和库需要存在于程序所在的文件系统（如容器）中
+func findBinary(cfg config) (interpreterChoice, error) {
+	name, binary := cfg.entryName(), cfg.binary
+
+	// 环境变量 QEMU_BINARY_PREFIX 可以用于自定义二进制文件名
+	// 例如设置为 "custom-"，则最终名称为 "custom-qemu-aarch64"
+	if binaryPrefix := os.Getenv("QEMU_BINARY_PREFIX"); binaryPrefix != "" {
+		// 路径分隔符会导致安全问题，因此禁止使用
+		if strings.ContainsRune(binaryPrefix, os.PathSeparator) {
+			return interpreterChoice{}, errors.New("binary prefix must not contain path separator (Hint: set $QEMU_BINARY_PATH to specify the directory)")
+		}
+		name = binaryPrefix + name
+		binary = binaryPrefix + binary
+	}
+	choice := interpreterChoice{Name: name, Backend: cfg.backend, binary: binary}
+
+	candidates, err := binaryCandidates(binary)
+	if err != nil {
+		return choice, err
+	}
+	for _, p := range candidates {
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		if reason := rejectBinary(p, fi); reason != "" {
+			choice.Rejected = append(choice.Rejected, binaryCandidate{Path: p, Reason: reason})
+			continue
+		}
+		choice.Path = p
+		return choice, nil
+	}
+	return choice, nil
+}
+
+// fullPath 返回选中的文件，没有找到时返回搜索路径中第一个目录下的默认路径
+func (c interpreterChoice) fullPath() string {
+	if c.Path != "" {
+		return c.Path
+	}
+	return filepath.Join(binarySearchPath()[0], c.binary)
+}
+
+// err 在只找到被拒绝的候选文件时返回列出拒绝原因的错误
+func (c interpreterChoice) err() error {
+	if c.Path != "" || len(c.Rejected) == 0 {
+		return nil
+	}
+	reasons := make([]string, 0, len(c.Rejected))
+	for _, r := range c.Rejected {
+		reasons = append(reasons, r.Path+": "+r.Reason)
+	}
+	return errors.Errorf("no usable emulator for %s (%s)", c.Name, strings.Join(reasons, "; "))
+}
+
+// rejectBinary 检查候选文件是否可以用作解释器，返回拒绝的原因，可用时返回空字符串
+func rejectBinary(p string, fi os.FileInfo) string {
+	if !fi.Mode().IsRegular() {
+		return "not a regular file"
+	}
+	if fi.Mode().Perm()&0111 == 0 {
+		return "not executable"
+	}
+	if !fixBinary && isDynamicELF(p) {
+		return "dynamically linked, requires the F flag"
+	}
+	return ""
+}
+
+// isDynamicELF 判断文件是否为动态链接的 ELF 文件（包含 PT_INTERP 段）
+// 不是 ELF 文件或无法解析时返回 false
+func isDynamicELF(p string) bool {
+	f, err := elf.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return true
+		}
+	}
+	return false
+}
+
+// getInterpreterChoices 返回每个架构选择的解释器，用于在状态中报告
+// 只包含找到了候选文件的架构
+func getInterpreterChoices() []interpreterChoice {
+	archs := make([]string, 0, len(configs))
+	for arch := range configs {
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+
+	var out []interpreterChoice
+	for _, arch := range archs {
+		cfg, err := archConfig(arch)
+		if err != nil {
+			continue
+		}
+		choice, err := findBinary(cfg)
+		if err != nil || (choice.Path == "" && len(choice.Rejected) == 0) {
+			continue
+		}
+		choice.Arch = arch
+		out = append(out, choice)
+	}
+	return out
+}
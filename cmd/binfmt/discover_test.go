@@ -0,0 +1,189 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFindBinary 测试在搜索路径中按顺序查找可用的文件，并记录被拒绝的候选文件
+func TestFindBinary(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	t.Setenv("QEMU_BINARY_PATH", "")
+	t.Setenv("QEMU_BINARY_SEARCH_PATH", first+string(os.PathListSeparator)+second)
+	t.Setenv("QEMU_BINARY_PATTERNS", "*,*-static")
+
+	// 第一个目录中的文件不可执行，应该被拒绝并继续查找
+	if err := os.WriteFile(filepath.Join(first, "qemu-aarch64"), []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(second, "qemu-aarch64-static"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	choice, err := findBinary(configs["arm64"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if choice.Name != "qemu-aarch64" || choice.Path != filepath.Join(second, "qemu-aarch64-static") {
+		t.Fatalf("unexpected choice %+v", choice)
+	}
+	if len(choice.Rejected) != 1 || choice.Rejected[0].Reason != "not executable" {
+		t.Fatalf("unexpected rejected candidates %+v", choice.Rejected)
+	}
+
+	r, err := getRegistration("arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.name != "qemu-aarch64" || r.interpreter != choice.Path {
+		t.Fatalf("unexpected registration %+v", r)
+	}
+
+	// 没有找到任何文件时回退到第一个目录
+	basename, fullPath, err := getBinaryNames(configs["riscv64"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if basename != "qemu-riscv64" || fullPath != filepath.Join(first, "qemu-riscv64") {
+		t.Fatalf("unexpected fallback %s %s", basename, fullPath)
+	}
+
+	t.Setenv("QEMU_BINARY_PATTERNS", "../*")
+	if _, err := findBinary(configs["arm64"]); err == nil {
+		t.Fatal("expected error for pattern with path separator")
+	}
+}
+
+// TestFindBinaryRejectsDynamic 测试不使用 F 标志时拒绝动态链接的文件
+func TestFindBinaryRejectsDynamic(t *testing.T) {
+	var dynamic string
+	for _, p := range []string{"/bin/sh", "/bin/ls", "/usr/bin/env"} {
+		if isDynamicELF(p) {
+			dynamic = p
+			break
+		}
+	}
+	if dynamic == "" {
+		t.Skip("no dynamically linked executable found")
+	}
+	dt, err := os.ReadFile(dynamic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	t.Setenv("QEMU_BINARY_PATH", dir)
+	t.Setenv("QEMU_BINARY_SEARCH_PATH", "")
+	t.Setenv("QEMU_BINARY_PATTERNS", "*,*-static")
+	if err := os.WriteFile(filepath.Join(dir, "qemu-aarch64"), dt, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// 使用 F 标志时动态链接的文件可以使用
+	if _, err := getRegistration("arm64"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(v bool) { fixBinary = v }(fixBinary)
+	fixBinary = false
+
+	_, err = getRegistration("arm64")
+	if err == nil || !strings.Contains(err.Error(), "dynamically linked") {
+		t.Fatalf("expected dynamically linked error, got %v", err)
+	}
+
+	// 同一目录中的静态链接版本可以使用
+	if err := os.WriteFile(filepath.Join(dir, "qemu-aarch64-static"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	r, err := getRegistration("arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.interpreter != filepath.Join(dir, "qemu-aarch64-static") || strings.Contains(r.flags, "F") {
+		t.Fatalf("unexpected registration %+v", r)
+	}
+
+	choices := getInterpreterChoices()
+	if len(choices) != 1 || choices[0].Arch != "arm64" || len(choices[0].Rejected) != 1 {
+		t.Fatalf("unexpected interpreters %+v", choices)
+	}
+}
+
+// TestBinaryPathCompat 测试 QEMU_BINARY_PATH 仍然是单个目录，默认设置与之前一致
+func TestBinaryPathCompat(t *testing.T) {
+	t.Setenv("QEMU_BINARY_SEARCH_PATH", "")
+	t.Setenv("QEMU_BINARY_PATTERNS", "")
+
+	t.Setenv("QEMU_BINARY_PATH", "")
+	if got := binarySearchPath(); len(got) != 1 || got[0] != "/usr/bin" {
+		t.Fatalf("unexpected default search path %v", got)
+	}
+	if got := binaryPatterns(); len(got) != 1 || got[0] != "*" {
+		t.Fatalf("unexpected default patterns %v", got)
+	}
+
+	// 目录名称中的 ":" 不会被当作分隔符
+	dir := filepath.Join(t.TempDir(), "qemu:8.2")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "qemu-aarch64"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("QEMU_BINARY_PATH", dir)
+	choice, err := findBinary(configs["arm64"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if choice.Path != filepath.Join(dir, "qemu-aarch64") {
+		t.Fatalf("unexpected choice %+v", choice)
+	}
+}
+
+// TestFindBinaryFallback 测试没有设置环境变量时在默认设置之后查找发行版安装的模拟器
+func TestFindBinaryFallback(t *testing.T) {
+	if _, err := os.Stat(filepath.Join(defaultBinaryPath, "qemu-aarch64")); err == nil {
+		t.Skip("qemu-aarch64 is installed in the default path")
+	}
+	t.Setenv("QEMU_BINARY_PATH", "")
+	t.Setenv("QEMU_BINARY_SEARCH_PATH", "")
+	t.Setenv("QEMU_BINARY_PATTERNS", "")
+	t.Setenv("QEMU_BINARY_PREFIX", "")
+
+	usrBin, libexec := t.TempDir(), t.TempDir()
+	defer func(old []string) { fallbackBinaryPaths = old }(fallbackBinaryPaths)
+	fallbackBinaryPaths = []string{usrBin, libexec}
+
+	if err := os.WriteFile(filepath.Join(libexec, "qemu-aarch64"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	choice, err := findBinary(configs["arm64"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if choice.Path != filepath.Join(libexec, "qemu-aarch64") {
+		t.Fatalf("unexpected choice %+v", choice)
+	}
+
+	// -static 文件名在 /usr/libexec/qemu-binfmt 之前
+	if err := os.WriteFile(filepath.Join(usrBin, "qemu-aarch64-static"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if choice, err = findBinary(configs["arm64"]); err != nil {
+		t.Fatal(err)
+	}
+	if choice.Path != filepath.Join(usrBin, "qemu-aarch64-static") {
+		t.Fatalf("unexpected choice %+v", choice)
+	}
+
+	// 设置了环境变量时只使用指定的设置
+	t.Setenv("QEMU_BINARY_PATH", t.TempDir())
+	if choice, err = findBinary(configs["arm64"]); err != nil {
+		t.Fatal(err)
+	}
+	if choice.Path != "" {
+		t.Fatalf("expected no fallback with QEMU_BINARY_PATH set, got %+v", choice)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// procSelfFD 是通过文件描述符注册的解释器路径的前缀
+const procSelfFD = "/proc/self/fd/"
+
+// embeddedEmulators 是编译进 binfmt 的 gzip 压缩的模拟器，文件名为 "<binary>.gz"
+// 只有使用 embedemulators 构建标签时才不为 nil
+var embeddedEmulators fs.FS
+
+// hasEmbedded 判断是否内嵌了指定的模拟器
+func hasEmbedded(binary string) bool {
+	if embeddedEmulators == nil {
+		return false
+	}
+	_, err := fs.Stat(embeddedEmulators, binary+".gz")
+	return err == nil
+}
+
+// openEmbedded 将内嵌的模拟器解压到密封的 memfd 中
+//
+// 参数:
+//
+//	binary: 模拟器名称（如 "qemu-aarch64"）
+//
+// 返回值:
+//
+//	string: 可以用于注册的解释器路径（如 "/proc/self/fd/7"）
+//	func(): 注册完成后关闭 memfd 的函数
+//	error: 如果没有内嵌该模拟器或创建 memfd 失败返回错误
+//
+// 工作原理:
+// 1. 创建允许密封的 memfd，并解压模拟器到其中
+// 2. 密封 memfd，禁止之后再修改内容和大小
+// 3. 返回 /proc/self/fd/N 作为解释器路径
+//
+// 注意:
+//   - 只能与 F 标志一起使用：内核在注册时打开解释器并一直持有，
+//     memfd 在注册完成后就可以关闭，模拟器不需要存在于任何文件系统中
+func openEmbedded(binary string) (string, func(), error) {
+	zr, err := readEmbedded(binary)
+	if err != nil {
+		return "", nil, err
+	}
+	defer zr.Close()
+
+	mf, err := createMemfd(binary)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := io.Copy(mf, zr); err != nil {
+		mf.Close()
+		return "", nil, errors.Wrapf(err, "cannot decompress embedded %s", binary)
+	}
+	seals := unix.F_SEAL_SEAL | unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_WRITE
+	if _, err := unix.FcntlInt(mf.Fd(), unix.F_ADD_SEALS, seals); err != nil {
+		mf.Close()
+		return "", nil, errors.Wrap(err, "cannot seal memfd")
+	}
+	return procSelfFD + strconv.Itoa(int(mf.Fd())), func() { mf.Close() }, nil
+}
+
+// createMemfd 创建可执行、允许密封的 memfd
+// Linux 6.3 起 memfd 默认可能不可执行（vm.memfd_noexec），需要指定 MFD_EXEC
+func createMemfd(name string) (*os.File, error) {
+	fd, err := unix.MemfdCreate(name, unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING|unix.MFD_EXEC)
+	if errors.Is(err, unix.EINVAL) {
+		// Linux 6.3 之前的内核不支持 MFD_EXEC，memfd 默认可执行
+		fd, err = unix.MemfdCreate(name, unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create memfd")
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// readEmbedded 打开内嵌的模拟器，返回解压后的内容
+func readEmbedded(binary string) (io.ReadCloser, error) {
+	if embeddedEmulators == nil {
+		return nil, errors.New("binfmt was built without embedded emulators")
+	}
+	f, err := embeddedEmulators.Open(binary + ".gz")
+	if err != nil {
+		return nil, errors.Wrapf(err, "no embedded emulator for %s", binary)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "cannot decompress embedded %s", binary)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// isFDInterpreter 判断解释器是否是通过文件描述符注册的
+// 这样的解释器只存在于内核中，无法在其他进程中按路径访问
+func isFDInterpreter(interpreter string) bool {
+	return strings.HasPrefix(interpreter, procSelfFD)
+}
@@ -0,0 +1,21 @@
+//go:build embedemulators
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// emulatorsFS 包含构建时放入 emulators 目录的 gzip 压缩的模拟器
+//
+//go:embed emulators/*.gz
+var emulatorsFS embed.FS
+
+func init() {
+	sub, err := fs.Sub(emulatorsFS, "emulators")
+	if err != nil {
+		panic(err)
+	}
+	embeddedEmulators = sub
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeEmbedded 将模拟器内容压缩后设置为 embeddedEmulators，测试结束时恢复
+func fakeEmbedded(t *testing.T, files map[string]string) {
+	t.Helper()
+	m := fstest.MapFS{}
+	for name, content := range files {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		m[name+".gz"] = &fstest.MapFile{Data: buf.Bytes()}
+	}
+	old := embeddedEmulators
+	embeddedEmulators = m
+	t.Cleanup(func() { embeddedEmulators = old })
+}
+
+// TestOpenEmbedded 测试内嵌的模拟器解压到密封的 memfd 中，并通过 /proc/self/fd 路径访问
+func TestOpenEmbedded(t *testing.T) {
+	fakeEmbedded(t, map[string]string{"qemu-aarch64": "#!/bin/sh\necho embedded\n"})
+
+	p, closeFn, err := openEmbedded("qemu-aarch64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+	if !isFDInterpreter(p) {
+		t.Fatalf("unexpected interpreter path %s", p)
+	}
+	dt, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dt) != "#!/bin/sh\necho embedded\n" {
+		t.Fatalf("unexpected content %q", dt)
+	}
+
+	fd, err := fdFromPath(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seals, err := unix.FcntlInt(uintptr(fd), unix.F_GET_SEALS, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := unix.F_SEAL_SEAL | unix.F_SEAL_WRITE | unix.F_SEAL_GROW | unix.F_SEAL_SHRINK; seals&want != want {
+		t.Fatalf("memfd not sealed, seals %#x", seals)
+	}
+
+	if _, _, err := openEmbedded("qemu-riscv64"); err == nil {
+		t.Fatal("expected error for missing emulator")
+	}
+}
+
+// fdFromPath 从 /proc/self/fd/N 中取出文件描述符
+func fdFromPath(p string) (int, error) {
+	return strconv.Atoi(strings.TrimPrefix(p, procSelfFD))
+}
+
+// TestInstallEmbedded 测试使用内嵌的模拟器注册条目，守护进程不会把不同的文件描述符当作被修改
+func TestInstallEmbedded(t *testing.T) {
+	f := newFakeFS(t, true)
+	fakeInterpreters(t)
+	fakeEmbedded(t, map[string]string{"qemu-aarch64": "#!/bin/sh\n"})
+	defer func(old bool) { useEmbedded = old }(useEmbedded)
+	useEmbedded = true
+
+	if err := install("arm64"); err != nil {
+		t.Fatal(err)
+	}
+	e, ok := f.entry("qemu-aarch64")
+	if !ok || !isFDInterpreter(e.interpreter) || e.flags != "CF" {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if err := install("riscv64"); err == nil || !strings.Contains(err.Error(), "no embedded emulator") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// 守护进程不应把不同的文件描述符当作被修改
+	d := newDaemon([]string{"arm64"}, 0)
+	if res := d.reconcile(); len(res) != 1 || res[0].action != actionOK {
+		t.Fatalf("unexpected reconcile result %+v", res)
+	}
+}
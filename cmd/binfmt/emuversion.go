@@ -0,0 +1,242 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 安装策略：目标条目已经存在时的处理方式
+const (
+	// installPolicyKeep 保留已有的条目，不做任何修改
+	installPolicyKeep = "keep"
+	// installPolicyUpgrade 只在已注册的模拟器比要安装的旧时替换，拒绝用旧版本替换新版本
+	installPolicyUpgrade = "upgrade"
+	// installPolicyReplace 总是替换已有的条目
+	installPolicyReplace = "replace"
+)
+
+// versionRe 匹配 QEMU 版本输出中的版本号
+// 例如 "qemu-aarch64 version 8.1.5 (Debian 1:8.1.5+ds-1)" 中的 "8.1.5"
+var versionRe = regexp.MustCompile(`version\s+v?(\d+(?:\.\d+)*)`)
+
+// emulatorVersion 结构体：已注册模拟器的版本信息
+type emulatorVersion struct {
+	Name        string `json:"name"`               // 条目名称（如 "qemu-aarch64"）
+	Backend     string `json:"backend,omitempty"`  // 非 QEMU 后端的名称（如 "fex"）
+	Interpreter string `json:"interpreter"`        // 条目中注册的解释器路径
+	Version     string `json:"version,omitempty"`  // 解释器报告的版本号
+	Mismatch    bool   `json:"mismatch,omitempty"` // 版本号是否与 binfmt 构建时的 qemuVersion 不一致
+	Foreign     bool   `json:"foreign,omitempty"`  // 解释器不是 binfmt 安装的，没有运行它获取版本
+	Error       string `json:"error,omitempty"`    // 无法获取版本时的错误
+}
+
+// getEmulatorVersions 运行每个已注册模拟器条目的解释器，获取其版本
+//
+// 参数:
+//
+//	names: 条目名称列表
+//
+// 返回值:
+//
+//	[]emulatorVersion: 每个模拟器条目的版本信息，顺序与 names 一致
+//
+// 注意:
+//   - 只检查属于某个后端的条目，不运行其他条目的解释器
+//   - 默认只运行 binfmt 安装的解释器，其他工具注册的解释器标记为 foreign，指定 -all-versions 时也运行它们
+//   - 只有 QEMU 条目与 qemuVersion 比较，qemuVersion 未知（如开发构建）时不标记不一致
+func getEmulatorVersions(names []string) []emulatorVersion {
+	var out []emulatorVersion
+	for _, name := range names {
+		b, arch, ok := entryBackend(name)
+		if !ok {
+			continue
+		}
+		ev := emulatorVersion{Name: name}
+		if b.name != backendQEMU {
+			ev.Backend = b.name
+		}
+		e, err := readEntry(name)
+		if err != nil {
+			ev.Error = err.Error()
+			out = append(out, ev)
+			continue
+		}
+		ev.Interpreter = e.interpreter
+		if isFDInterpreter(e.interpreter) {
+			ev.Error = "interpreter registered from a file descriptor"
+			out = append(out, ev)
+			continue
+		}
+		if !allVersions && !isInstalledInterpreter(arch, e.interpreter) {
+			ev.Foreign = true
+			out = append(out, ev)
+			continue
+		}
+		v, err := interpreterVersion(b, e.interpreter)
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		ev.Version = v
+		if own := parseVersion(qemuVersion); own != nil && v != "" && b.name == backendQEMU {
+			ev.Mismatch = compareVersions(parseVersion(v), own) != 0
+		}
+		out = append(out, ev)
+	}
+	return out
+}
+
+// isInstalledInterpreter 判断条目中的解释器是否为 binfmt 安装的
+//
+// 参数:
+//
+//	arch: 条目对应的架构
+//	interpreter: 条目中注册的解释器路径
+//
+// 返回值:
+//
+//	bool: 解释器是 binfmt 的包装程序、搜索路径中为该架构选中的模拟器或持久化的模拟器时为 true
+func isInstalledInterpreter(arch, interpreter string) bool {
+	if _, ok := readProfile(interpreter); ok {
+		return true
+	}
+	if filepath.Dir(interpreter) == filepath.Clean(persistDir) {
+		return true
+	}
+	cfg, err := archConfig(arch)
+	if err != nil {
+		return false
+	}
+	choice, err := findBinary(cfg)
+	return err == nil && choice.Path == interpreter
+}
+
+// interpreterVersion 运行解释器的版本参数并解析出版本号
+//
+// 参数:
+//
+//	b: 解释器所属的后端，决定版本参数和版本号的格式
+//	interpreter: 解释器路径
+//
+// 返回值:
+//
+//	string: 版本号（如 "8.1.5"），无法识别时为空
+//	error: 如果运行失败或输出中没有版本号返回错误
+func interpreterVersion(b backend, interpreter string) (string, error) {
+	out, err := probeInterpreter(interpreter, b.versionArg)
+	if err != nil {
+		return "", err
+	}
+	m := b.versionRe.FindStringSubmatch(out)
+	if m == nil {
+		return "", errors.Errorf("cannot parse version from %s %s", interpreter, b.versionArg)
+	}
+	return m[1], nil
+}
+
+// parseVersion 将版本号解析为数字序列
+// 支持 "8.1.5"、"v8.1.5" 和 "v8.1.5-rc0" 等形式，无法解析时（如 "HEAD"、"unknown"）返回 nil
+func parseVersion(v string) []int {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+ "); i >= 0 {
+		v = v[:i]
+	}
+	if v == "" {
+		return nil
+	}
+	var out []int
+	for _, p := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// compareVersions 比较两个版本号
+// a < b 返回 -1，a == b 返回 0，a > b 返回 1，缺少的部分视为 0
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkInstallPolicy 根据 -install-policy 决定是否替换已有的条目
+//
+// 参数:
+//
+//	r: 要安装的注册信息
+//	e: 已注册的条目
+//
+// 返回值:
+//
+//	bool: 是否需要替换已有的条目
+//	error: 如果策略拒绝替换返回错误
+//
+// 注意:
+//   - upgrade 策略下，要安装的版本优先取解释器报告的版本，QEMU 无法获取时使用 qemuVersion
+//   - 任何一方的版本无法识别时拒绝替换，避免意外降级
+func checkInstallPolicy(r registration, e *entry) (bool, error) {
+	switch installPolicy {
+	case installPolicyKeep:
+		return false, errors.Errorf("%s already registered", r.name)
+	case installPolicyReplace:
+		return true, nil
+	case installPolicyUpgrade:
+	default:
+		return false, errors.Errorf("invalid install policy %q", installPolicy)
+	}
+
+	b, err := getBackend(r.backend)
+	if err != nil {
+		return false, err
+	}
+	if isFDInterpreter(e.interpreter) {
+		return false, errors.Errorf("cannot determine version of %s registered from a file descriptor", r.name)
+	}
+	current, err := interpreterVersion(b, e.interpreter)
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot determine version of registered %s", r.name)
+	}
+	// 内嵌的模拟器与 binfmt 一起构建，版本即为 qemuVersion
+	candidate := strings.TrimPrefix(qemuVersion, "v")
+	if r.embedded == "" {
+		interpreter := r.interpreter
+		if r.profile != nil {
+			interpreter = r.profile.Interpreter
+		}
+		if v, err := interpreterVersion(b, interpreter); err == nil {
+			candidate = v
+		} else if parseVersion(qemuVersion) == nil || b.name != backendQEMU {
+			return false, errors.Wrapf(err, "cannot determine version of %s", interpreter)
+		}
+	} else if parseVersion(candidate) == nil {
+		return false, errors.Errorf("cannot determine version of embedded %s", r.embedded)
+	}
+
+	switch compareVersions(parseVersion(current), parseVersion(candidate)) {
+	case 1:
+		return false, errors.Errorf("refusing to replace %s %s with older version %s", r.name, current, candidate)
+	case 0:
+		return false, errors.Errorf("%s %s already registered", r.name, current)
+	}
+	return true, nil
+}
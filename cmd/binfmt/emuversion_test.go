@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestParseVersion 测试版本号的解析，无法解析的版本返回 nil
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []int
+	}{
+		{"8.1.5", []int{8, 1, 5}},
+		{"v8.1.5", []int{8, 1, 5}},
+		{"v9.0.0-rc1", []int{9, 0, 0}},
+		{"HEAD", nil},
+		{"unknown", nil},
+		{"", nil},
+	}
+	for _, tc := range tests {
+		got := parseVersion(tc.in)
+		if compareVersions(got, tc.want) != 0 || (got == nil) != (tc.want == nil) {
+			t.Errorf("%q: expected %v, got %v", tc.in, tc.want, got)
+		}
+	}
+
+	if compareVersions([]int{8, 1}, []int{8, 1, 0}) != 0 {
+		t.Error("expected 8.1 == 8.1.0")
+	}
+	if compareVersions([]int{7, 2, 9}, []int{8}) != -1 {
+		t.Error("expected 7.2.9 < 8")
+	}
+	if compareVersions([]int{10}, []int{9, 9}) != 1 {
+		t.Error("expected 10 > 9.9")
+	}
+}
+
+// writeVersionedInterpreter 在 dir 中写入一个报告指定版本的模拟解释器
+func writeVersionedInterpreter(t *testing.T, dir, arch, version string) string {
+	t.Helper()
+	p := filepath.Join(dir, configs[arch].binary)
+	script := "#!/bin/sh\necho \"" + configs[arch].binary + " version " + version + "\"\n"
+	if err := os.WriteFile(p, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// TestInstallPolicy 测试每种安装策略在已注册的模拟器版本更高或更低时的处理
+func TestInstallPolicy(t *testing.T) {
+	defer func(old string) { installPolicy = old }(installPolicy)
+
+	tests := []struct {
+		policy     string
+		registered string
+		candidate  string
+		replaced   bool
+		expectErr  string
+	}{
+		{policy: installPolicyKeep, registered: "8.1.5", candidate: "9.0.0", expectErr: "already registered"},
+		{policy: installPolicyUpgrade, registered: "8.1.5", candidate: "9.0.0", replaced: true},
+		{policy: installPolicyUpgrade, registered: "9.0.0", candidate: "8.1.5", expectErr: "refusing to replace"},
+		{policy: installPolicyUpgrade, registered: "9.0.0", candidate: "9.0.0", expectErr: "already registered"},
+		{policy: installPolicyReplace, registered: "9.0.0", candidate: "8.1.5", replaced: true},
+		{policy: "bogus", registered: "9.0.0", candidate: "8.1.5", expectErr: "invalid install policy"},
+	}
+	for _, tc := range tests {
+		f := newFakeFS(t, true)
+		installPolicy = tc.policy
+
+		old := writeVersionedInterpreter(t, t.TempDir(), "arm64", tc.registered)
+		if err := f.write(filepath.Join(f.root, "register"), []byte(":qemu-aarch64:M::\\x7fELF::"+old+":CF")); err != nil {
+			t.Fatal(err)
+		}
+		dir := fakeInterpreters(t)
+		writeVersionedInterpreter(t, dir, "arm64", tc.candidate)
+
+		err := install("arm64")
+		if tc.expectErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+				t.Errorf("%s %s->%s: expected error %q, got %v", tc.policy, tc.registered, tc.candidate, tc.expectErr, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s %s->%s: %v", tc.policy, tc.registered, tc.candidate, err)
+		}
+
+		e, ok := f.entry("qemu-aarch64")
+		if !ok {
+			t.Fatalf("%s %s->%s: entry removed", tc.policy, tc.registered, tc.candidate)
+		}
+		if replaced := e.interpreter != old; replaced != tc.replaced {
+			t.Errorf("%s %s->%s: expected replaced=%v, interpreter %s", tc.policy, tc.registered, tc.candidate, tc.replaced, e.interpreter)
+		}
+	}
+}
+
+// TestEmulatorVersions 测试报告已注册模拟器的版本，并标记与附带的 QEMU 版本不一致的模拟器
+func TestEmulatorVersions(t *testing.T) {
+	f := newFakeFS(t, true)
+	defer func(old string) { qemuVersion = old }(qemuVersion)
+	qemuVersion = "v9.0.0"
+
+	dir := fakeInterpreters(t, "riscv64")
+	writeVersionedInterpreter(t, dir, "arm64", "8.1.5")
+	for _, arch := range []string{"arm64", "riscv64"} {
+		if err := install(arch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.write(filepath.Join(f.root, "register"), []byte(":python:M::#!::/usr/bin/python3:")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := getEmulatorVersions(f.names())
+	if len(got) != 2 {
+		t.Fatalf("expected versions for two qemu entries, got %+v", got)
+	}
+	for _, ev := range got {
+		switch ev.Name {
+		case "qemu-aarch64":
+			if ev.Version != "8.1.5" || !ev.Mismatch || ev.Error != "" {
+				t.Errorf("unexpected version %+v", ev)
+			}
+		case "qemu-riscv64":
+			if ev.Version != "" || ev.Mismatch || ev.Error == "" {
+				t.Errorf("unexpected version %+v", ev)
+			}
+		default:
+			t.Errorf("unexpected entry %+v", ev)
+		}
+	}
+}
+
+// TestEmulatorVersionsForeign 测试默认不运行其他工具注册的解释器，指定 -all-versions 时才运行
+func TestEmulatorVersionsForeign(t *testing.T) {
+	f := newFakeFS(t, true)
+	defer func(old bool) { allVersions = old }(allVersions)
+	fakeInterpreters(t)
+
+	other := t.TempDir()
+	p := writeVersionedInterpreter(t, other, "arm64", "8.1.5")
+	if err := f.write(filepath.Join(f.root, "register"), []byte(":qemu-aarch64:M::"+configs["arm64"].magic+":"+configs["arm64"].mask+":"+p+":F")); err != nil {
+		t.Fatal(err)
+	}
+
+	allVersions = false
+	got := getEmulatorVersions(f.names())
+	if len(got) != 1 || !got[0].Foreign || got[0].Version != "" || got[0].Interpreter != p {
+		t.Fatalf("expected foreign interpreter not to be run, got %+v", got)
+	}
+
+	allVersions = true
+	got = getEmulatorVersions(f.names())
+	if len(got) != 1 || got[0].Foreign || got[0].Version != "8.1.5" {
+		t.Fatalf("expected foreign interpreter to be run with -all-versions, got %+v", got)
+	}
+}
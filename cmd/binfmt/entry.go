@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// entry 结构体：binfmt_misc 条目文件的内容
+//
+// 条目文件格式（由内核生成）:
+//
+//	enabled
+//	interpreter /usr/bin/qemu-aarch64
+//	flags: OCF
+//	offset 0
+//	magic 7f454c460201010000000000000000000200b700
+//	mask ffffffffffffff00fffffffffffffffffeffffff
+type entry struct {
+	name        string // 条目名称（文件名）
+	enabled     bool   // 是否启用
+	interpreter string // 解释器路径
+	flags       string // 标志位，按 POCF 顺序排列
+	offset      int    // 魔数偏移量
+	magic       string // 十六进制编码的魔数
+	mask        string // 十六进制编码的掩码
+}
+
+// readEntry 读取并解析 binfmt_misc 条目文件
+//
+// 参数:
+//
+//	name: 条目名称（如 "qemu-aarch64"）
+//
+// 返回值:
+//
+//	*entry: 解析后的条目内容
+//	error: 如果条目不存在或无法解析返回错误
+//
+// 注意:
+//   - 条目不存在时返回的错误满足 errors.Is(err, os.ErrNotExist)
+func readEntry(name string) (*entry, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	dt, err := fsys.ReadFile(filepath.Join(mount, name))
+	if err != nil {
+		return nil, err
+	}
+	return parseEntry(name, dt)
+}
+
+// parseEntry 解析条目文件的内容
+//
+// 参数:
+//
+//	name: 条目名称
+//	dt: 条目文件的内容
+//
+// 返回值:
+//
+//	*entry: 解析后的条目内容
+//	error: 如果内容格式不正确返回错误
+func parseEntry(name string, dt []byte) (*entry, error) {
+	e := &entry{name: name}
+	lines := strings.Split(strings.TrimSpace(string(dt)), "\n")
+	switch lines[0] {
+	case "enabled":
+		e.enabled = true
+	case "disabled":
+	default:
+		return nil, errors.Errorf("invalid entry %s: unexpected status %q", name, lines[0])
+	}
+	for _, l := range lines[1:] {
+		k, v, _ := strings.Cut(l, " ")
+		switch k {
+		case "interpreter":
+			e.interpreter = v
+		case "flags:":
+			e.flags = normalizeFlags(v)
+		case "offset":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid entry %s: bad offset", name)
+			}
+			e.offset = n
+		case "magic":
+			e.magic = v
+		case "mask":
+			e.mask = v
+		}
+	}
+	return e, nil
+}
+
+// matches 判断条目是否与期望的注册信息一致
+//
+// 参数:
+//
+//	r: 期望的注册信息
+//
+// 返回值:
+//
+//	bool: 解释器、标志位、偏移量、魔数和掩码都一致时返回 true
+//
+// 注意:
+//   - 不检查条目是否启用，调用者需要单独检查 enabled 字段
+func (e *entry) matches(r registration) bool {
+	if e.flags != normalizeFlags(r.flags) || e.offset != r.offset {
+		return false
+	}
+	// 内嵌的模拟器每次注册时的文件描述符可能不同，只要求是通过文件描述符注册的
+	if r.embedded != "" {
+		if !isFDInterpreter(e.interpreter) {
+			return false
+		}
+	} else if e.interpreter != r.interpreter {
+		return false
+	}
+	magic, err := unescape(r.magic)
+	if err != nil || e.magic != hex.EncodeToString(magic) {
+		return false
+	}
+	mask, err := unescape(r.mask)
+	if err != nil || e.mask != hex.EncodeToString(mask) {
+		return false
+	}
+	return true
+}
+
+// normalizeFlags 按照内核显示的顺序（P、O、C、F）排列标志位
+func normalizeFlags(flags string) string {
+	var out string
+	for _, c := range "POCF" {
+		if strings.ContainsRune(flags, c) {
+			out += string(c)
+		}
+	}
+	return out
+}
+
+// writeEntry 向条目文件写入控制命令
+//
+// 参数:
+//
+//	name: 条目名称
+//	cmd: 控制命令（"1" 启用、"0" 禁用、"-1" 删除）
+//
+// 返回值:
+//
+//	error: 如果写入失败返回错误
+//
+// 注意:
+//   - 与 uninstall 不同，此函数只匹配完整的条目名称，不做后缀匹配
+func writeEntry(name, cmd string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	return fsys.WriteFile(filepath.Join(mount, name), []byte(cmd), 0600)
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// fakeFS 结构体：在临时目录中模拟内核 binfmt_misc 文件系统的 binfmtFS 实现
+//
+// 模拟的内核行为:
+//   - 挂载后目录中出现 register 和 status 文件
+//   - 向 register 写入注册字符串会解析并创建条目文件，重复名称返回 EEXIST
+//   - 带 F 标志注册时会检查解释器是否存在
+//   - 条目文件内容与内核格式一致（enabled/interpreter/flags/offset/magic/mask）
+//   - 向条目写入 "1"/"0"/"-1" 分别启用、禁用、删除条目
+//   - 向 status 写入 "1"/"0"/"-1" 分别全局启用、全局禁用、删除所有条目
+//
+// 读操作直接访问临时目录，写操作在修改内部状态后同步到临时目录
+type fakeFS struct {
+	root string
+
+	mu       sync.Mutex
+	mounted  bool
+	disabled bool
+	entries  map[string]*fakeEntry
+
+	// mountErr 如果不为 nil，Mount 会返回该错误
+	mountErr error
+	// mounts 和 unmounts 记录 Mount 和 Unmount 的调用次数
+	mounts   int
+	unmounts int
+	// readOnly 如果为 true，MountInfo 报告只读挂载，写入返回 EROFS
+	readOnly bool
+	// mountInfoErr 如果不为 nil，MountInfo 会返回该错误（模拟 /proc 不可用）
+	mountInfoErr error
+	// automount 如果为 true，挂载点是 systemd 的 autofs 自动挂载点，访问其中的文件时挂载 binfmt_misc
+	automount bool
+	// afterWrite 如果不为 nil，每次成功写入后调用，用于检查中间状态
+	afterWrite func()
+}
+
+// fakeEntry 结构体：模拟的 binfmt_misc 条目
+type fakeEntry struct {
+	disabled    bool
+	interpreter string
+	flags       string
+	offset      int
+	magic       []byte
+	mask        []byte
+}
+
+// newFakeFS 创建模拟的 binfmt_misc 文件系统，并将其设置为当前的 fsys 和 mount
+// 测试结束时会自动恢复原来的值
+func newFakeFS(t *testing.T, mounted bool) *fakeFS {
+	t.Helper()
+	f := &fakeFS{
+		root:    t.TempDir(),
+		entries: map[string]*fakeEntry{},
+	}
+	if mounted {
+		if err := f.Mount("binfmt_misc", f.root, "binfmt_misc", 0, ""); err != nil {
+			t.Fatal(err)
+		}
+		f.mounts = 0
+	}
+
+	oldFS, oldMount := fsys, mount
+	fsys, mount = f, f.root
+	t.Cleanup(func() {
+		fsys, mount = oldFS, oldMount
+	})
+	return f
+}
+
+func (f *fakeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (f *fakeFS) ReadFile(name string) ([]byte, error) {
+	if f.isControl(name, "register") {
+		return nil, &os.PathError{Op: "read", Path: name, Err: syscall.EINVAL}
+	}
+	return os.ReadFile(name)
+}
+
+func (f *fakeFS) Stat(name string) (fs.FileInfo, error) {
+	f.mu.Lock()
+	if f.automount && !f.mounted && filepath.Dir(filepath.Clean(name)) == f.root {
+		if err := f.mountLocked(); err != nil {
+			f.mu.Unlock()
+			return nil, err
+		}
+	}
+	f.mu.Unlock()
+	return os.Stat(name)
+}
+
+func (f *fakeFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (f *fakeFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	if _, err := os.Stat(name); err != nil {
+		return nil, err
+	}
+	return &fakeWriter{fs: f, name: name}, nil
+}
+
+func (f *fakeFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if _, err := os.Stat(name); err != nil {
+		return err
+	}
+	if err := f.write(name, data); err != nil {
+		return &os.PathError{Op: "write", Path: name, Err: err}
+	}
+	if f.afterWrite != nil {
+		f.afterWrite()
+	}
+	return nil
+}
+
+func (f *fakeFS) Mount(source, target, fstype string, flags uintptr, data string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mounts++
+	if f.mountErr != nil {
+		return f.mountErr
+	}
+	if filepath.Clean(target) != f.root || fstype != "binfmt_misc" {
+		return syscall.EINVAL
+	}
+	if f.mounted {
+		return syscall.EBUSY
+	}
+	return f.mountLocked()
+}
+
+// mountLocked 挂载模拟的 binfmt_misc，调用者必须持有 f.mu
+func (f *fakeFS) mountLocked() error {
+	f.mounted = true
+	if err := os.WriteFile(filepath.Join(f.root, "register"), nil, 0200); err != nil {
+		return err
+	}
+	return f.syncLocked()
+}
+
+func (f *fakeFS) Unmount(target string, flags int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unmounts++
+	if filepath.Clean(target) != f.root || !f.mounted {
+		return syscall.EINVAL
+	}
+	f.mounted = false
+	fis, err := os.ReadDir(f.root)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if err := os.Remove(filepath.Join(f.root, fi.Name())); err != nil {
+			return err
+		}
+	}
+	// 与内核一致，条目在卸载后仍然存在，重新挂载后可见
+	return nil
+}
+
+// MountInfo 返回模拟的 /proc/self/mountinfo，挂载时包含一行 binfmt_misc 挂载项
+func (f *fakeFS) MountInfo() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.mountInfoErr != nil {
+		return nil, f.mountInfoErr
+	}
+	dt := "25 1 0:22 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw\n"
+	if f.automount {
+		dt += fmt.Sprintf("30 25 0:40 / %s rw,relatime shared:14 - autofs systemd-1 rw,fd=32,pgrp=1,timeout=0,minproto=5,maxproto=5,direct\n", strings.ReplaceAll(f.root, " ", `\040`))
+	}
+	if f.mounted {
+		opts := "rw"
+		if f.readOnly {
+			opts = "ro"
+		}
+		dt += fmt.Sprintf("36 25 0:30 / %s %s,relatime shared:13 - binfmt_misc binfmt_misc %s\n", strings.ReplaceAll(f.root, " ", `\040`), opts, opts)
+	}
+	return []byte(dt), nil
+}
+
+// isControl 判断路径是否为挂载点中指定的控制文件
+func (f *fakeFS) isControl(name, ctl string) bool {
+	return filepath.Clean(name) == filepath.Join(f.root, ctl)
+}
+
+// write 处理对挂载点中文件的写入
+func (f *fakeFS) write(name string, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.mounted || filepath.Dir(filepath.Clean(name)) != f.root {
+		return syscall.EINVAL
+	}
+	if f.readOnly {
+		return syscall.EROFS
+	}
+	switch filepath.Base(name) {
+	case "register":
+		if err := f.register(string(data)); err != nil {
+			return err
+		}
+	case "status":
+		switch strings.TrimSpace(string(data)) {
+		case "1":
+			f.disabled = false
+		case "0":
+			f.disabled = true
+		case "-1":
+			f.entries = map[string]*fakeEntry{}
+		default:
+			return syscall.EINVAL
+		}
+	default:
+		e, ok := f.entries[filepath.Base(name)]
+		if !ok {
+			return syscall.ENOENT
+		}
+		switch strings.TrimSpace(string(data)) {
+		case "1":
+			e.disabled = false
+		case "0":
+			e.disabled = true
+		case "-1":
+			delete(f.entries, filepath.Base(name))
+		default:
+			return syscall.EINVAL
+		}
+	}
+	return f.syncLocked()
+}
+
+// register 按照内核的规则解析注册字符串并创建条目
+func (f *fakeFS) register(line string) error {
+	line = strings.TrimSuffix(line, "\n")
+	if len(line) < 11 || len(line) > maxRegisterLength {
+		return syscall.EINVAL
+	}
+	del := line[:1]
+	fields := strings.Split(line[1:], del)
+	if len(fields) != 7 {
+		return syscall.EINVAL
+	}
+	name, typ, offset, magic, mask, interpreter, flags := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], fields[6]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return syscall.EINVAL
+	}
+	if _, ok := f.entries[name]; ok {
+		return syscall.EEXIST
+	}
+	if typ != "M" {
+		return syscall.EINVAL
+	}
+	e := &fakeEntry{interpreter: interpreter}
+	if offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil {
+			return syscall.EINVAL
+		}
+		e.offset = n
+	}
+	var err error
+	if e.magic, err = fakeUnescape(magic); err != nil || len(e.magic) == 0 {
+		return syscall.EINVAL
+	}
+	if e.mask, err = fakeUnescape(mask); err != nil {
+		return syscall.EINVAL
+	}
+	if len(e.mask) != 0 && len(e.mask) != len(e.magic) {
+		return syscall.EINVAL
+	}
+	if e.offset+len(e.magic) > maxMagicLength {
+		return syscall.EINVAL
+	}
+	if interpreter == "" {
+		return syscall.EINVAL
+	}
+	for _, c := range flags {
+		if !strings.ContainsRune("POCF", c) {
+			return syscall.EINVAL
+		}
+	}
+	// 内核按照 P、O、C、F 的顺序显示标志位
+	for _, c := range "POCF" {
+		if strings.ContainsRune(flags, c) {
+			e.flags += string(c)
+		}
+	}
+	// F 标志要求注册时打开解释器
+	if strings.Contains(e.flags, "F") {
+		if _, err := os.Stat(interpreter); err != nil {
+			return syscall.ENOENT
+		}
+	}
+	f.entries[name] = e
+	return nil
+}
+
+// syncLocked 将内部状态同步到临时目录
+func (f *fakeFS) syncLocked() error {
+	if !f.mounted {
+		return nil
+	}
+	fis, err := os.ReadDir(f.root)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.Name() == "register" || fi.Name() == "status" {
+			continue
+		}
+		if _, ok := f.entries[fi.Name()]; !ok {
+			if err := os.Remove(filepath.Join(f.root, fi.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	st := "enabled\n"
+	if f.disabled {
+		st = "disabled\n"
+	}
+	if err := os.WriteFile(filepath.Join(f.root, "status"), []byte(st), 0644); err != nil {
+		return err
+	}
+	for name, e := range f.entries {
+		if err := os.WriteFile(filepath.Join(f.root, name), []byte(e.String()), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// names 返回所有已注册条目的名称（已排序）
+func (f *fakeFS) names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]string, 0, len(f.entries))
+	for name := range f.entries {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// entry 返回指定名称的条目
+func (f *fakeFS) entry(name string) (fakeEntry, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[name]
+	if !ok {
+		return fakeEntry{}, false
+	}
+	return *e, true
+}
+
+// String 返回与内核格式一致的条目文件内容
+func (e *fakeEntry) String() string {
+	st := "enabled"
+	if e.disabled {
+		st = "disabled"
+	}
+	s := fmt.Sprintf("%s\ninterpreter %s\nflags: %s\noffset %d\nmagic %s\n", st, e.interpreter, e.flags, e.offset, hex.EncodeToString(e.magic))
+	if len(e.mask) != 0 {
+		s += fmt.Sprintf("mask %s\n", hex.EncodeToString(e.mask))
+	}
+	return s
+}
+
+// fakeUnescape 解码 \xHH 转义的字符串
+// 与内核的 UNESCAPE_HEX 一样，其他反斜杠（包括 \\）原样保留
+func fakeUnescape(s string) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || (i+1 < len(s) && s[i+1] != 'x') {
+			out = append(out, s[i])
+			continue
+		}
+		if i+3 >= len(s) {
+			return nil, syscall.EINVAL
+		}
+		b, err := hex.DecodeString(s[i+2 : i+4])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+		i += 3
+	}
+	return out, nil
+}
+
+// fakeWriter 结构体：模拟打开的 register 等文件
+type fakeWriter struct {
+	fs   *fakeFS
+	name string
+}
+
+func (w *fakeWriter) Write(p []byte) (int, error) {
+	if err := w.fs.write(w.name, p); err != nil {
+		return 0, &os.PathError{Op: "write", Path: w.name, Err: err}
+	}
+	if w.fs.afterWrite != nil {
+		w.fs.afterWrite()
+	}
+	return len(p), nil
+}
+
+func (w *fakeWriter) Close() error {
+	return nil
+}
+
+// fakeInterpreters 在临时目录中创建模拟的 QEMU 二进制文件，并设置 QEMU_BINARY_PATH
+func fakeInterpreters(t *testing.T, archs ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, arch := range archs {
+		if err := os.WriteFile(filepath.Join(dir, configs[arch].binary), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("QEMU_BINARY_PATH", dir)
+	t.Setenv("QEMU_BINARY_SEARCH_PATH", "")
+	t.Setenv("QEMU_BINARY_PREFIX", "")
+	return dir
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// binfmtFS 接口：抽象对 binfmt_misc 文件系统的所有访问
+//
+// install、uninstall、printStatus 等函数都通过此接口访问挂载点，
+// 而不是直接调用 os 包和 syscall.Mount。
+// 这样在测试中可以替换为模拟内核行为的实现，无需 root 权限和真实的 binfmt_misc 挂载。
+//
+// 方法签名与 os、filepath、syscall 包中的同名函数保持一致
+type binfmtFS interface {
+	// ReadDir 读取目录中的所有条目
+	ReadDir(name string) ([]fs.DirEntry, error)
+	// ReadFile 读取文件的全部内容
+	ReadFile(name string) ([]byte, error)
+	// OpenFile 以写入方式打开文件（如 register 文件）
+	OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error)
+	// WriteFile 向文件写入数据（如向条目文件写入 "-1"）
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	// Stat 获取文件信息
+	Stat(name string) (fs.FileInfo, error)
+	// Glob 返回匹配模式的所有文件路径
+	Glob(pattern string) ([]string, error)
+	// Mount 挂载文件系统
+	Mount(source, target, fstype string, flags uintptr, data string) error
+	// Unmount 卸载文件系统
+	Unmount(target string, flags int) error
+	// MountInfo 读取当前进程的挂载信息（/proc/self/mountinfo 的内容）
+	MountInfo() ([]byte, error)
+}
+
+// fsys 是当前使用的 binfmt_misc 文件系统实现
+// 默认直接访问宿主机，测试时可替换为模拟实现
+var fsys binfmtFS = hostFS{}
+
+// hostFS 结构体：直接访问宿主机文件系统的 binfmtFS 实现
+type hostFS struct{}
+
+func (hostFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (hostFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (hostFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (hostFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (hostFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (hostFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (hostFS) Mount(source, target, fstype string, flags uintptr, data string) error {
+	return syscall.Mount(source, target, fstype, flags, data)
+}
+
+func (hostFS) Unmount(target string, flags int) error {
+	return syscall.Unmount(target, flags)
+}
+
+func (hostFS) MountInfo() ([]byte, error) {
+	return os.ReadFile("/proc/self/mountinfo")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containerd/platforms"
+	"github.com/pkg/errors"
+)
+
+// 平台的执行方式
+const (
+	modeNative   = "native"   // 由 CPU 直接执行
+	modeEmulated = "emulated" // 通过 binfmt_misc 注册的模拟器执行
+)
+
+// 节点标签的前缀
+const (
+	// nfdLabelPrefix 是 node-feature-discovery 本地特性文件使用的前缀
+	nfdLabelPrefix = "feature.node.kubernetes.io/binfmt-"
+
+	// platformLabelPrefix 是平台标签文件使用的前缀
+	platformLabelPrefix = "binfmt.io/"
+)
+
+// platformMode 结构体：平台及其执行方式
+type platformMode struct {
+	platform string // 平台（如 "linux/arm64"）
+	mode     string // 执行方式（native 或 emulated）
+	emulator string // 执行该平台的模拟器条目名称，原生平台为空
+}
+
+// classifyPlatforms 将系统支持的平台分为原生和模拟两类
+//
+// 参数:
+//
+//	st: getStatus 收集的状态
+//
+// 返回值:
+//
+//	[]platformMode: 每个支持的平台及其执行方式，顺序与 st.Supported 一致
+//
+// 工作原理:
+//   - 如果平台的架构有对应的已启用模拟器条目（如 qemu-aarch64、buildkit-qemu-aarch64 或 FEX-x86_64），则为模拟执行
+//   - 否则为原生执行（如 amd64 主机上的 386，或 arm64 主机上的 arm）
+func classifyPlatforms(st *status) []platformMode {
+	out := make([]platformMode, 0, len(st.Supported))
+	for _, pp := range st.Supported {
+		pm := platformMode{platform: pp, mode: modeNative}
+		if p, err := platforms.Parse(pp); err == nil {
+			for _, name := range st.Emulators {
+				if _, arch, ok := entryBackend(name); ok && arch == p.Architecture {
+					pm.mode, pm.emulator = modeEmulated, name
+					break
+				}
+			}
+		}
+		out = append(out, pm)
+	}
+	return out
+}
+
+// platformLabelName 将平台转换为可以用作标签名称的形式
+// 例如 "linux/arm/v7" 转换为 "linux-arm-v7"
+func platformLabelName(p string) string {
+	return strings.ReplaceAll(p, "/", "-")
+}
+
+// writeNodeLabels 根据状态写入节点标签文件
+//
+// 参数:
+//
+//	st: getStatus 收集的状态
+//
+// 返回值:
+//
+//	error: 如果写入失败返回错误
+//
+// 写入的文件:
+//   - -nfd-features-file: node-feature-discovery 本地特性文件
+//     格式: feature.node.kubernetes.io/binfmt-linux-arm64=emulated
+//   - -labels-file: 平台标签文件，格式由 -labels-format 指定（json 或 env）
+//     格式: binfmt.io/linux-arm64=emulated
+//
+// 注意:
+//   - 文件先写入临时文件再重命名，读取方不会看到写了一半的内容
+func writeNodeLabels(st *status) error {
+	modes := classifyPlatforms(st)
+
+	if nfdFeaturesFile != "" {
+		var buf bytes.Buffer
+		fmt.Fprintln(&buf, "# generated by binfmt")
+		for _, pm := range modes {
+			fmt.Fprintf(&buf, "%s%s=%s\n", nfdLabelPrefix, platformLabelName(pm.platform), pm.mode)
+		}
+		if err := writeFileAtomic(nfdFeaturesFile, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	if labelsFile != "" {
+		labels := make(map[string]string, len(modes))
+		keys := make([]string, 0, len(modes))
+		for _, pm := range modes {
+			k := platformLabelPrefix + platformLabelName(pm.platform)
+			labels[k] = pm.mode
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var dt []byte
+		switch labelsFormat {
+		case "json":
+			var err error
+			if dt, err = json.MarshalIndent(labels, "", "  "); err != nil {
+				return err
+			}
+			dt = append(dt, '\n')
+		case "env":
+			var buf bytes.Buffer
+			for _, k := range keys {
+				fmt.Fprintf(&buf, "%s=%s\n", k, labels[k])
+			}
+			dt = buf.Bytes()
+		default:
+			return errors.Errorf("unsupported labels format %q", labelsFormat)
+		}
+		if err := writeFileAtomic(labelsFile, dt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic 通过临时文件和重命名原子地写入文件
+func writeFileAtomic(path string, dt []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(dt); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
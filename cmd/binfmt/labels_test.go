@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteNodeLabels 测试平台分类和标签文件的格式
+func TestWriteNodeLabels(t *testing.T) {
+	st := &status{
+		Supported: []string{"linux/amd64", "linux/386", "linux/arm64", "linux/arm/v7"},
+		Emulators: []string{"buildkit-qemu-aarch64", "qemu-arm"},
+	}
+
+	dir := t.TempDir()
+	defer func(a, b, c string) { nfdFeaturesFile, labelsFile, labelsFormat = a, b, c }(nfdFeaturesFile, labelsFile, labelsFormat)
+	nfdFeaturesFile = filepath.Join(dir, "binfmt")
+	labelsFile = filepath.Join(dir, "labels")
+
+	labelsFormat = "env"
+	if err := writeNodeLabels(st); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, nfdFeaturesFile, `# generated by binfmt
+feature.node.kubernetes.io/binfmt-linux-amd64=native
+feature.node.kubernetes.io/binfmt-linux-386=native
+feature.node.kubernetes.io/binfmt-linux-arm64=emulated
+feature.node.kubernetes.io/binfmt-linux-arm-v7=emulated
+`)
+	expectFile(t, labelsFile, `binfmt.io/linux-386=native
+binfmt.io/linux-amd64=native
+binfmt.io/linux-arm-v7=emulated
+binfmt.io/linux-arm64=emulated
+`)
+
+	labelsFormat = "json"
+	if err := writeNodeLabels(st); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, labelsFile, `{
+  "binfmt.io/linux-386": "native",
+  "binfmt.io/linux-amd64": "native",
+  "binfmt.io/linux-arm-v7": "emulated",
+  "binfmt.io/linux-arm64": "emulated"
+}
+`)
+
+	labelsFormat = "xml"
+	if err := writeNodeLabels(st); err == nil {
+		t.Fatal("expected error for unsupported format")
+	}
+}
+
+// expectFile 检查文件内容
+func expectFile(t *testing.T, path, expected string) {
+	t.Helper()
+	dt, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dt) != expected {
+		t.Fatalf("unexpected content of %s:\n%s", path, dt)
+	}
+}
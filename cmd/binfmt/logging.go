@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 日志格式
+const (
+	logFormatText = "text" // key=value 格式，不包含时间戳
+	logFormatJSON = "json" // 每行一个 JSON 对象，便于日志系统索引
+)
+
+// setupLogging 根据 -log-format 和 -log-level 设置默认的 slog 日志记录器
+//
+// 参数:
+//
+//	w: 日志输出（通常为标准错误）
+//	format: 日志格式（text 或 json）
+//	level: 最低日志级别（debug、info、warn 或 error）
+//
+// 返回值:
+//
+//	error: 如果格式或级别无效返回错误
+//
+// 注意:
+//   - 设置后 log 包的输出也通过 slog 以 info 级别记录
+//   - 所有事件使用一致的字段：action、arch、handler、interpreter 和 error
+func setupLogging(w io.Writer, format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return errors.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch format {
+	case logFormatText:
+		// 与之前的输出一样不显示时间戳，使输出更简洁
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+		h = slog.NewTextHandler(w, opts)
+	case logFormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return errors.Errorf("invalid log format %q", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// logResult 记录一次操作的结果，成功时为 info 级别，失败时为 error 级别
+//
+// 参数:
+//
+//	action: 操作名称（如 "install"）
+//	err: 操作的错误
+//	attrs: 其他字段（如 archAttrs 的返回值）
+func logResult(action string, err error, attrs ...any) {
+	attrs = append([]any{"action", action}, attrs...)
+	if err != nil {
+		slog.Error(action+" failed", append(attrs, "error", err)...)
+		return
+	}
+	slog.Info(action+" ok", attrs...)
+}
+
+// logError 记录导致 binfmt 退出的错误，debug 级别下附带调用栈
+func logError(err error) {
+	attrs := []any{"error", err}
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		attrs = append(attrs, "stack", strings.TrimSpace(fmt.Sprintf("%+v", err)))
+	}
+	slog.Error("binfmt failed", attrs...)
+}
+
+// archAttrs 返回架构及其条目的日志字段
+func archAttrs(arch string) []any {
+	attrs := []any{"arch", arch}
+	cfg, err := archConfig(arch)
+	if err != nil {
+		return attrs
+	}
+	name, _, err := getBinaryNames(cfg)
+	if err != nil {
+		return attrs
+	}
+	return append(attrs, handlerAttrs(name)...)
+}
+
+// handlerAttrs 返回条目名称和已注册的解释器的日志字段，条目不存在时只有名称
+func handlerAttrs(name string) []any {
+	attrs := []any{"handler", name}
+	if e, err := readEntry(name); err == nil {
+		attrs = append(attrs, "interpreter", e.interpreter)
+	}
+	return attrs
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// captureLogs 将默认的日志记录器替换为写入缓冲区的 JSON 记录器，测试结束时恢复
+func captureLogs(t *testing.T, level string) *bytes.Buffer {
+	t.Helper()
+	prev := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	var buf bytes.Buffer
+	if err := setupLogging(&buf, logFormatJSON, level); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// logRecords 解析每行一个 JSON 对象的日志
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var out []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// TestSetupLogging 测试日志格式和级别的校验，以及低于级别的日志被过滤
+func TestSetupLogging(t *testing.T) {
+	prev := slog.Default()
+	defer slog.SetDefault(prev)
+	var buf bytes.Buffer
+	if err := setupLogging(&buf, "xml", "info"); err == nil {
+		t.Error("expected error for invalid format")
+	}
+	if err := setupLogging(&buf, logFormatText, "verbose"); err == nil {
+		t.Error("expected error for invalid level")
+	}
+
+	if err := setupLogging(&buf, logFormatText, "warn"); err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("hidden")
+	slog.Warn("shown", "arch", "arm64")
+	if got := buf.String(); got != "level=WARN msg=shown arch=arm64\n" {
+		t.Fatalf("unexpected output %q", got)
+	}
+}
+
+// TestLogResult 测试操作结果的日志包含架构、条目和解释器，错误的堆栈只在 debug 级别输出
+func TestLogResult(t *testing.T) {
+	newFakeFS(t, true)
+	dir := fakeInterpreters(t, "arm64")
+	if err := install("arm64"); err != nil {
+		t.Fatal(err)
+	}
+	buf := captureLogs(t, "debug")
+
+	logResult("install", nil, archAttrs("arm64")...)
+	logResult("uninstall", errors.New("boom"), handlerAttrs("qemu-riscv64")...)
+	logError(errors.New("fatal"))
+
+	records := logRecords(t, buf)
+	if len(records) != 3 {
+		t.Fatalf("unexpected records %v", records)
+	}
+	expected := map[string]interface{}{
+		"level":       "INFO",
+		"msg":         "install ok",
+		"action":      "install",
+		"arch":        "arm64",
+		"handler":     "qemu-aarch64",
+		"interpreter": filepath.Join(dir, "qemu-aarch64"),
+	}
+	for k, v := range expected {
+		if records[0][k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, records[0][k])
+		}
+	}
+	if r := records[1]; r["level"] != "ERROR" || r["action"] != "uninstall" || r["handler"] != "qemu-riscv64" || r["error"] != "boom" {
+		t.Errorf("unexpected record %v", r)
+	}
+	if _, ok := records[1]["interpreter"]; ok {
+		t.Errorf("unexpected interpreter for missing handler: %v", records[1])
+	}
+	if stack, _ := records[2]["stack"].(string); !strings.Contains(stack, "TestLogResult") {
+		t.Errorf("expected stack at debug level, got %v", records[2])
+	}
+}
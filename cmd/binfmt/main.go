@@ -18,15 +18,16 @@
 package main
 
 import (
-	"encoding/json" // JSON 编解码库
 	"flag"          // 命令行参数解析库
 	"fmt"           // 格式化输出库
 	"log"           // 日志输出库
+	"log/slog"      // 结构化日志库
 	"os"            // 操作系统接口库
 	"path/filepath" // 文件路径操作库
 	"runtime"       // 运行时信息库
 	"strings"       // 字符串操作库
 	"syscall"       // 系统调用库
+	"time"          // 时间库
 
 	"github.com/containerd/platforms"                           // containerd 平台解析库
 	"github.com/moby/buildkit/util/archutil"                    // BuildKit 架构工具库
@@ -39,11 +40,84 @@ var (
 	// 默认为 "/proc/sys/fs/binfmt_misc"，这是 Linux 内核中 binfmt_misc 的标准挂载位置
 	mount string
 
+	// toPersist 和 toUnpersist 指定需要持久化到宿主机和从宿主机删除的架构列表
+	// 特殊值 "all" 分别表示所有可以安装的架构和所有已持久化的模拟器
+	toPersist   string
+	toUnpersist string
+
+	// persistRoot 宿主机根目录在当前进程中的路径（如在容器中挂载的 /host）
+	// persistDir、binfmtDDir 和 systemdUnit 都是宿主机上的路径
+	persistRoot string
+	persistDir  string
+	binfmtDDir  string
+	systemdUnit string
+
+	// ociLayoutDir 指定包含 QEMU 模拟器的本地 OCI 镜像布局目录
+	// ociTarget 指定解压模拟器的目录，为空时使用临时目录，退出时删除
+	ociLayoutDir string
+	ociTarget    string
+
+	// useEmbedded 是否注册内嵌在 binfmt 中的模拟器，而不是 QEMU_BINARY_PATH 中的文件
+	useEmbedded bool
+
+	// fixBinary 是否使用 F 标志注册，在注册时打开解释器
+	// 为 false 时只接受静态链接的模拟器
+	fixBinary bool
+
+	// profileSpec 指定每个架构传给 QEMU 的设置（如 "arm64.cpu=max,arm64.sysroot=/crossarch"）
+	// profileDir 是每个条目的包装程序所在的目录
+	profileSpec string
+	profileDir  string
+
+	// traceArch 指定通过跟踪包装程序重新注册的架构，traceDir 是日志目录
+	// traceFlags 是传给 QEMU -d 的日志项
+	// traceMaxSize 和 traceMaxProcs 限制每个日志的大小和跟踪的进程数
+	// traceDuration 为 0 时跟踪到命令结束或收到中断信号
+	traceArch     string
+	traceDir      string
+	traceFlags    string
+	traceMaxSize  int64
+	traceMaxProcs int
+	traceDuration time.Duration
+	// traceAllUsers 允许以任何用户运行的程序连接跟踪套接字
+	traceAllUsers bool
+
+	// debugArch 指定通过调试包装程序重新注册的架构，debugMatch 选择要调试的程序
+	// debugPort 和 debugSocket 是 gdbstub 监听的地址，debugPort 不为 0 时改为监听 TCP 端口
+	debugArch   string
+	debugMatch  string
+	debugPort   int
+	debugSocket string
+
+	// backendSpec 指定每个架构使用的模拟器后端（如 "fex" 或 "amd64=box64,386=qemu"）
+	backendSpec string
+
+	// installPolicy 指定目标条目已经存在时的处理方式（keep、upgrade 或 replace）
+	installPolicy string
+
+	// allVersions 是否在状态中也运行其他工具注册的解释器获取版本
+	allVersions bool
+
+	// mountMode 指定如何处理 binfmt_misc 的挂载（auto、require-existing 或 persistent）
+	mountMode string
+
+	// logFormat 指定日志格式（text 或 json），logLevel 指定最低日志级别
+	logFormat string
+	logLevel  string
+
+	// outputFormat 指定状态的输出格式（json、compact、yaml、table 或 platform）
+	// 默认为缩进的 JSON，与之前的输出一致
+	outputFormat string
+
 	// toInstall 指定需要安装的架构列表
 	// 可以是单个架构（如 "arm64"）或多个架构（如 "arm64,arm,amd64"）
 	// 特殊值 "all" 表示安装所有支持的架构
 	toInstall string
 
+	// toUpgrade 指定需要不中断地升级的架构列表
+	// 特殊值 "all" 表示升级所有已注册的架构
+	toUpgrade string
+
 	// toUninstall 指定需要卸载的架构列表
 	// 可以是架构名称或 QEMU 模拟器名称（如 "qemu-aarch64"）
 	toUninstall string
@@ -51,6 +125,42 @@ var (
 	// flVersion 是否显示版本信息
 	// 为 true 时打印程序版本、QEMU 版本和 Go 版本
 	flVersion bool
+
+	// flDaemon 是否以守护进程模式运行
+	// 为 true 时持续运行，定期重新注册 -install 指定的架构中缺失或被修改的条目
+	flDaemon bool
+
+	// daemonInterval 守护进程模式下两次协调之间的间隔
+	daemonInterval time.Duration
+
+	// daemonUninstallOnExit 守护进程退出时是否卸载由它注册的条目
+	daemonUninstallOnExit bool
+
+	// metricsAddr 守护进程模式下提供指标和健康检查的监听地址
+	// 为空时不提供
+	metricsAddr string
+
+	// controlSocket 守护进程模式下控制接口的 Unix 套接字路径
+	// 为空时不提供
+	controlSocket string
+	// controlLease 控制接口中 ensure 的租约时长
+	controlLease time.Duration
+
+	// nfdFeaturesFile node-feature-discovery 本地特性文件的路径
+	// 为空时不写入
+	nfdFeaturesFile string
+
+	// labelsFile 平台标签文件的路径，labelsFormat 指定其格式（json 或 env）
+	// 为空时不写入
+	labelsFile   string
+	labelsFormat string
+
+	// flUserNS 是否在新的用户命名空间中挂载独有的 binfmt_misc 实例并在其中运行
+	flUserNS bool
+
+	// targetPID 指定目标进程，操作该进程所在的 binfmt_misc 实例
+	// 为 0 时操作当前进程所在的实例
+	targetPID int
 )
 
 // init 函数在程序启动时自动执行
@@ -60,17 +170,138 @@ func init() {
 	// -mount: 指定 binfmt_misc 的挂载点，默认为 /proc/sys/fs/binfmt_misc
 	flag.StringVar(&mount, "mount", "/proc/sys/fs/binfmt_misc", "binfmt_misc mount point")
 
+	// -mount-mode: 指定如何处理挂载点
+	//   - auto: 未挂载时临时挂载，退出时卸载
+	//   - require-existing: 未挂载时返回错误
+	//   - persistent: 未挂载时挂载，退出时保留挂载
+	flag.StringVar(&mountMode, "mount-mode", mountModeAuto, "how to handle the binfmt_misc mount (auto, require-existing, persistent)")
+
+	// -log-format: 日志格式，json 时每行一个 JSON 对象，便于日志系统按字段索引
+	// -log-level: 最低日志级别（debug、info、warn、error）
+	// 示例: -log-format json -log-level warn
+	flag.StringVar(&logFormat, "log-format", logFormatText, "log format (text, json)")
+	flag.StringVar(&logLevel, "log-level", "info", "minimum log level (debug, info, warn, error)")
+
+	// -output: 状态的输出格式
+	//   - json: 缩进的 JSON（默认）
+	//   - compact: 单行 JSON
+	//   - yaml: YAML
+	//   - table: 每个平台一行的表格
+	//   - platform: 用 "," 分隔的平台列表，可以直接用于 buildx 的 --platform
+	// 示例: -output table
+	flag.StringVar(&outputFormat, "output", outputJSON, "status output format (json, compact, yaml, table, platform)")
+
 	// -install: 指定要安装的架构，多个架构用逗号分隔
 	// 示例: -install arm64,amd64 或 -install all
 	flag.StringVar(&toInstall, "install", "", "architectures to install")
 
+	// -persist、-unpersist: 将模拟器复制到宿主机并写入 binfmt.d 文件，使注册在重启后恢复
+	// 示例: -persist all -persist-root /host -systemd-unit /etc/systemd/system/binfmt-verify.service
+	flag.StringVar(&toPersist, "persist", "", "architectures to persist onto the host for registration at boot")
+	flag.StringVar(&toUnpersist, "unpersist", "", "architectures to remove from the host")
+	flag.StringVar(&persistRoot, "persist-root", "/", "path of the host root filesystem")
+	flag.StringVar(&persistDir, "persist-dir", "/usr/local/lib/binfmt", "host directory to persist emulators to")
+	flag.StringVar(&binfmtDDir, "binfmt-d", "/etc/binfmt.d", "host binfmt.d directory")
+	flag.StringVar(&systemdUnit, "systemd-unit", "", "host path of a systemd unit that verifies persisted emulators at boot")
+
+	// -oci-layout: 从本地的 OCI 镜像布局中解压与主机平台匹配的模拟器并注册
+	// 示例: -oci-layout /mnt/binfmt-oci -oci-target /usr/local/lib/binfmt -install all
+	flag.StringVar(&ociLayoutDir, "oci-layout", "", "install emulators from a local OCI image layout directory")
+	flag.StringVar(&ociTarget, "oci-target", "", "directory to extract emulators from the OCI image layout to (default: temporary directory)")
+
+	// -embedded: 注册内嵌在 binfmt 中的模拟器（需要使用 embedemulators 构建标签编译）
+	// 示例: -embedded -install all
+	flag.BoolVar(&useEmbedded, "embedded", false, "register emulators embedded in the binfmt binary through memfd")
+
+	// -fix-binary: 是否使用 F 标志在注册时打开解释器
+	// 关闭后解释器在执行程序时才打开，必须使用静态链接的模拟器（如 qemu-aarch64-static）
+	// 示例: -fix-binary=false -install arm64
+	flag.BoolVar(&fixBinary, "fix-binary", true, "register with the F flag so the interpreter is opened at registration time")
+
+	// -backend: 指定模拟器后端，可以是默认后端或用 "arch=backend" 为单个架构指定
+	// 示例: -backend fex -install amd64,386 或 -backend amd64=box64 -install amd64
+	flag.StringVar(&backendSpec, "backend", backendQEMU, "emulator backend, either a default or per architecture as arch=backend ("+strings.Join(backendNames(), ", ")+")")
+
+	// -profile: 为架构指定 QEMU 设置，注册时使用 binfmt 作为包装程序设置环境变量后执行 QEMU
+	// 可用的键: cpu (QEMU_CPU)、stack-size (QEMU_STACK_SIZE)、reserved-va (QEMU_RESERVED_VA)、guest-base (QEMU_GUEST_BASE)、
+	// sysroot (QEMU_LD_PREFIX)
+	// 示例: -profile arm64.cpu=max,arm64.sysroot=/crossarch -install arm64,amd64
+	flag.StringVar(&profileSpec, "profile", "", "per-architecture QEMU settings as arch.key=value (keys: cpu, stack-size, reserved-va, guest-base, sysroot)")
+	flag.StringVar(&profileDir, "profile-dir", "/usr/local/lib/binfmt/profiles", "directory for the per-handler wrappers used with -profile")
+
+	// -trace: 临时通过跟踪包装程序重新注册一个架构，记录每个被模拟进程的 QEMU 日志，结束后恢复原来的条目
+	// 剩余参数作为命令运行，没有命令时跟踪到收到中断信号或 -trace-duration 到期
+	// 跟踪期间其他挂载命名空间（如容器）中的程序无法运行
+	// 示例: -trace arm64 -trace-dir /run/binfmt-trace -- chroot /srv/arm64-rootfs /bin/ls
+	flag.StringVar(&traceArch, "trace", "", "temporarily re-register an architecture through a tracing wrapper")
+	flag.StringVar(&traceDir, "trace-dir", "/run/binfmt-trace", "directory for per-process trace logs, must be owned by root and not writable by others")
+	flag.StringVar(&traceFlags, "trace-flags", "strace", "QEMU -d log items to enable while tracing")
+	flag.Int64Var(&traceMaxSize, "trace-max-size", 10<<20, "maximum size of each trace log in bytes (0 for unlimited)")
+	flag.IntVar(&traceMaxProcs, "trace-max-procs", 100, "maximum number of processes to trace (0 for unlimited)")
+	flag.DurationVar(&traceDuration, "trace-duration", 0, "stop tracing after this duration")
+	// -trace-all-users: 允许以任何用户运行的程序发送日志，默认只跟踪与 binfmt 相同用户（root）的程序
+	flag.BoolVar(&traceAllUsers, "trace-all-users", false, "trace programs running as any user")
+
+	// -debug: 临时通过调试包装程序重新注册一个架构，匹配的程序在 QEMU 的 gdbstub 下启动，结束后恢复原来的条目
+	// 剩余参数作为命令运行，没有命令时一直等待到收到中断信号
+	// 调试期间其他挂载命名空间（如容器）中的程序无法运行
+	// 示例: -debug arm64 -debug-match '*/myapp' -- chroot /srv/arm64-rootfs /opt/myapp
+	flag.StringVar(&debugArch, "debug", "", "temporarily re-register an architecture so that matching programs wait for gdb")
+	flag.StringVar(&debugMatch, "debug-match", "", "comma-separated path patterns of programs to debug (default all)")
+	// -debug-port: QEMU 的 gdbstub 在所有网络接口上监听该端口且没有认证，只在明确指定时使用
+	flag.IntVar(&debugPort, "debug-port", 0, "TCP port for the QEMU gdbstub instead of -debug-socket, listens on all interfaces without authentication")
+	flag.StringVar(&debugSocket, "debug-socket", "/run/binfmt-debug/gdb-%d.sock", "Unix socket path for the QEMU gdbstub, %d is replaced with the process ID")
+
+	// -all-versions: 状态中也运行其他工具注册的解释器获取版本，默认只运行 binfmt 安装的解释器
+	// 示例: -all-versions -output table
+	flag.BoolVar(&allVersions, "all-versions", false, "also run interpreters registered by other tools to report their versions")
+
+	// -install-policy: 指定条目已经存在时的处理方式
+	//   - keep: 保留已有的条目
+	//   - upgrade: 只替换比要安装的版本旧的模拟器
+	//   - replace: 总是替换
+	flag.StringVar(&installPolicy, "install-policy", installPolicyKeep, "what to do when a handler is already registered (keep, upgrade, replace)")
+
 	// -uninstall: 指定要卸载的架构，多个架构用逗号分隔
 	// 示例: -uninstall arm64 或 -uninstall qemu-aarch64
 	flag.StringVar(&toUninstall, "uninstall", "", "architectures to uninstall")
 
+	// -upgrade: 将已注册的模拟器不中断地替换为当前的解释器
+	// 示例: -upgrade arm64 或 -upgrade all
+	flag.StringVar(&toUpgrade, "upgrade", "", "architectures to re-register with the current interpreter without downtime")
+
 	// -version: 显示版本信息
 	flag.BoolVar(&flVersion, "version", false, "display version")
 
+	// -daemon: 以守护进程模式运行，持续保证 -install 指定的架构已注册
+	// 示例: -install all -daemon -interval 1m
+	flag.BoolVar(&flDaemon, "daemon", false, "keep running and re-register missing or drifted handlers")
+	flag.DurationVar(&daemonInterval, "interval", 30*time.Second, "reconcile interval in daemon mode")
+	flag.BoolVar(&daemonUninstallOnExit, "uninstall-on-exit", false, "uninstall handlers registered by the daemon on exit")
+
+	// -metrics-addr: 守护进程模式下提供 /metrics、/healthz 和 /readyz 的地址
+	// 示例: -metrics-addr 127.0.0.1:9253
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "address to serve metrics and health checks on in daemon mode")
+
+	// -control-socket: 守护进程模式下提供 status、ensure、release 控制接口的 Unix 套接字
+	// 示例: -control-socket /run/binfmt.sock
+	flag.StringVar(&controlSocket, "control-socket", "", "unix socket to serve on-demand install requests on in daemon mode")
+	// -control-lease: ensure 的租约时长，客户端需要在到期之前再次 ensure 续约
+	flag.DurationVar(&controlLease, "control-lease", 10*time.Minute, "how long an ensure request holds an emulator unless renewed")
+
+	// -nfd-features-file、-labels-file: 写入供 Kubernetes 调度使用的节点标签
+	// 示例: -nfd-features-file /etc/kubernetes/node-feature-discovery/features.d/binfmt
+	flag.StringVar(&nfdFeaturesFile, "nfd-features-file", "", "write node-feature-discovery local features to file")
+	flag.StringVar(&labelsFile, "labels-file", "", "write platform labels to file")
+	flag.StringVar(&labelsFormat, "labels-format", "json", "format of the labels file (json, env)")
+
+	// -userns: 在新的用户命名空间中运行（需要 Linux 6.7+），剩余参数作为命令在其中执行
+	// 示例: -userns -install arm64 -- make test
+	flag.BoolVar(&flUserNS, "userns", false, "mount a private binfmt_misc instance in a new user namespace and run remaining args in it")
+
+	// -pid: 操作指定进程所在的 binfmt_misc 实例
+	flag.IntVar(&targetPID, "pid", 0, "operate on the binfmt_misc instance of the given process")
+
 	// 完全禁用 archutil.SupportedPlatforms 的缓存
 	// CacheMaxAge = 0 表示每次都重新查询支持的平台
 	// 这样可以确保获取最新的平台支持信息，避免缓存过期导致的问题
@@ -98,9 +329,14 @@ func init() {
 // - 卸载后，该架构的二进制文件将无法直接运行
 // - 如果找不到匹配的配置，返回 "not found" 错误
 func uninstall(arch string) error {
+	// 校验卸载目标，确保只会写入挂载点目录中的文件
+	if err := validateName(arch); err != nil {
+		return err
+	}
+
 	// 读取 binfmt_misc 挂载点目录中的所有文件
 	// 每个文件代表一个已注册的 binfmt 配置
-	fis, err := os.ReadDir(mount)
+	fis, err := fsys.ReadDir(mount)
 	if err != nil {
 		return err
 	}
@@ -123,7 +359,7 @@ func uninstall(arch string) error {
 			// 向配置文件写入 "-1" 来禁用该配置
 			// 这是 binfmt_misc 的标准卸载方式
 			// 文件权限设置为 0600（仅所有者可读写）
-			return os.WriteFile(filepath.Join(mount, fi.Name()), []byte("-1"), 0600)
+			return fsys.WriteFile(filepath.Join(mount, fi.Name()), []byte("-1"), 0600)
 		}
 	}
 
@@ -139,53 +375,32 @@ func uninstall(arch string) error {
 //
 // 返回值:
 //
-//	string: 二进制文件的基本名称（如 "qemu-aarch64"）
+//	string: 二进制文件的基本名称（如 "qemu-aarch64"），也是条目名称
 //	string: 二进制文件的完整路径（如 "/usr/bin/qemu-aarch64"）
 //	error: 如果路径配置错误返回错误
 //
 // 工作原理:
-// 1. 从环境变量 QEMU_BINARY_PATH 获取二进制文件目录，默认为 /usr/bin
-// 2. 从配置中获取二进制文件基本名称（如 "qemu-aarch64"）
-// 3. 检查环境变量 QEMU_BINARY_PREFIX，如果存在则添加前缀
-// 4. 拼接目录和文件名得到完整路径
+// 1. 从配置中获取二进制文件基本名称（如 "qemu-aarch64"）
+// 2. 检查环境变量 QEMU_BINARY_PREFIX，如果存在则添加前缀
+// 3. 通过 findBinary 在搜索路径中查找可用的文件
+// 4. 没有找到时返回搜索路径中第一个目录下的路径
 //
 // 环境变量:
 //
-//	QEMU_BINARY_PATH: 指定 QEMU 二进制文件的目录路径
+//	QEMU_BINARY_PATH: QEMU 二进制文件所在的目录，默认为 /usr/bin
+//	QEMU_BINARY_SEARCH_PATH: 查找 QEMU 二进制文件的多个目录，用 ":" 分隔，设置时代替 QEMU_BINARY_PATH
+//	QEMU_BINARY_PATTERNS: 候选文件名的模式，用 "," 分隔，"*" 代表二进制文件名称
 //	QEMU_BINARY_PREFIX: 指定 QEMU 二进制文件的前缀（不能包含路径分隔符）
 //
 // 注意:
 // - QEMU_BINARY_PREFIX 不能包含路径分隔符，否则返回错误
-// - 这允许用户自定义 QEMU 二进制文件的位置和命名
+// - 条目名称总是带前缀的二进制文件名称，与实际选中的文件名（如 "qemu-aarch64-static"）无关
 func getBinaryNames(cfg config) (string, string, error) {
-	// 获取 QEMU 二进制文件目录
-	// 默认为 /usr/bin，可通过环境变量 QEMU_BINARY_PATH 覆盖
-	binaryPath := "/usr/bin"
-	if v := os.Getenv("QEMU_BINARY_PATH"); v != "" {
-		binaryPath = v
-	}
-
-	// 获取二进制文件的基本名称
-	// 从配置中读取，如 "qemu-aarch64"
-	binaryBasename := cfg.binary
-
-	// 检查是否需要添加前缀
-	// 环境变量 QEMU_BINARY_PREFIX 可以用于自定义二进制文件名
-	// 例如设置为 "custom-"，则最终名称为 "custom-qemu-aarch64"
-	if binaryPrefix := os.Getenv("QEMU_BINARY_PREFIX"); binaryPrefix != "" {
-		// 检查前缀是否包含路径分隔符
-		// 路径分隔符会导致安全问题，因此禁止使用
-		if strings.ContainsRune(binaryPrefix, os.PathSeparator) {
-			return "", "", errors.New("binary prefix must not contain path separator (Hint: set $QEMU_BINARY_PATH to specify the directory)")
-		}
-		binaryBasename = binaryPrefix + binaryBasename
+	choice, err := findBinary(cfg)
+	if err != nil {
+		return "", "", err
 	}
-
-	// 拼接完整路径
-	// 使用 filepath.Join 确保路径格式正确（处理不同操作系统的路径分隔符）
-	binaryFullpath := filepath.Join(binaryPath, binaryBasename)
-
-	return binaryBasename, binaryFullpath, nil
+	return choice.Name, choice.fullPath(), nil
 }
 
 // install 安装指定架构的 binfmt 配置
@@ -199,10 +414,119 @@ func getBinaryNames(cfg config) (string, string, error) {
 //	error: 如果安装失败返回错误，成功返回 nil
 //
 // 工作原理:
+// 1. 通过 getRegistration 获取该架构的注册信息
+// 2. 通过 register 将注册信息写入 register 文件
+func install(arch string) error {
+	r, err := getRegistration(arch)
+	if err != nil {
+		return err
+	}
+
+	// 条目已经存在时，根据 -install-policy 决定是否替换
+	e, err := readEntry(r.name)
+	if err == nil {
+		replace, err := checkInstallPolicy(r, e)
+		if err != nil {
+			return err
+		}
+		if replace {
+			return swapEntry(r)
+		}
+		return nil
+	}
+	return register(r)
+}
+
+// getRegistration 获取指定架构的注册信息
+//
+// 参数:
+//
+//	arch: 架构名称（如 "arm64"）
+//
+// 返回值:
+//
+//	registration: 注册信息（名称、魔数、掩码、解释器路径、标志位）
+//	error: 如果架构不支持或二进制文件路径配置错误返回错误
+//
+// 工作原理:
 // 1. 检查架构是否支持
-// 2. 打开 binfmt_misc 的 register 文件
-// 3. 构建注册字符串（包含二进制路径、魔数、掩码、标志等）
-// 4. 将注册字符串写入 register 文件
+// 2. 根据环境变量确定标志位
+// 3. 获取 QEMU 二进制文件的名称和路径
+//
+// 注意:
+//   - 守护进程模式使用此函数计算期望的注册信息并与实际条目比较
+func getRegistration(arch string) (registration, error) {
+	// 检查架构是否支持
+	// 从 configs 映射中查找对应的配置，并应用 -backend 选择的后端
+	cfg, err := archConfig(arch)
+	if err != nil {
+		return registration{}, err
+	}
+
+	// 设置标志位
+	// C: 清除标志，表示在注册前清除现有配置
+	// F: 固定标志，表示在注册时打开解释器，可以通过 -fix-binary=false 关闭
+	flags := "C"
+	if fixBinary || useEmbedded {
+		flags += "F"
+	}
+
+	// 检查是否需要保留 argv0
+	// 环境变量 QEMU_PRESERVE_ARGV0 设置为非空值时启用
+	// P: 保留 argv0 标志，保持程序名称不变
+	// 这对于某些依赖程序名称的应用很重要
+	if v := os.Getenv("QEMU_PRESERVE_ARGV0"); v != "" {
+		flags += "P"
+	}
+
+	// 添加后端需要的标志位（如 FEX 需要 P 和 O）
+	for _, f := range cfg.flags {
+		if !strings.ContainsRune(flags, f) {
+			flags += string(f)
+		}
+	}
+
+	// 在搜索路径中查找模拟器二进制文件
+	choice, err := findBinary(cfg)
+	if err != nil {
+		return registration{}, err
+	}
+	binaryBasename := choice.Name
+
+	// 如果指定了 -embedded，使用内嵌在 binfmt 中的模拟器
+	// 解释器在注册时才解压到 memfd 中
+	if useEmbedded {
+		if !hasEmbedded(cfg.binary) {
+			return registration{}, errors.Errorf("no embedded emulator for %s", arch)
+		}
+		r := newRegistration(cfg, binaryBasename, "", flags)
+		r.embedded = cfg.binary
+		return applyProfile(arch, r)
+	}
+
+	// 只找到被拒绝的候选文件时报告原因，而不是注册一个无法使用的解释器
+	if err := choice.err(); err != nil {
+		return registration{}, err
+	}
+
+	// 如果 -profile 为该架构指定了配置，注册包装程序而不是模拟器本身
+	return applyProfile(arch, newRegistration(cfg, binaryBasename, choice.fullPath(), flags))
+}
+
+// register 将注册信息写入 binfmt_misc 的 register 文件
+//
+// 参数:
+//
+//	r: 注册信息
+//
+// 返回值:
+//
+//	error: 如果注册失败返回错误，成功返回 nil
+//
+// 工作原理:
+// 1. 打开 binfmt_misc 的 register 文件
+// 2. 构建注册字符串（包含二进制路径、魔数、掩码、标志等）
+// 3. 将注册字符串写入 register 文件
 //
 // 注册字符串格式:
 //
@@ -219,12 +543,36 @@ func getBinaryNames(cfg config) (string, string, error) {
 // - 如果 binfmt_misc 未挂载，返回 ENOENT 错误
 // - 如果权限不足，返回 EPERM 错误
 // - 如果配置已存在，返回 EEXIST 错误
-func install(arch string) error {
-	// 检查架构是否支持
-	// 从 configs 映射中查找对应的配置
-	cfg, ok := configs[arch]
-	if !ok {
-		return errors.Errorf("unsupported architecture: %v", arch)
+func register(r registration) error {
+	// 内嵌的模拟器在注册时解压到 memfd 中，注册完成后关闭
+	// 必须使用 F 标志，否则内核在执行程序时才打开解释器，而那时 memfd 已经不存在
+	if r.embedded != "" {
+		if !strings.Contains(r.flags, "F") {
+			return errors.Errorf("embedded emulator %s requires the F flag", r.embedded)
+		}
+		interpreter, closeFn, err := openEmbedded(r.embedded)
+		if err != nil {
+			return err
+		}
+		defer closeFn()
+		r.interpreter = interpreter
+	}
+
+	// 使用配置时，包装程序和配置文件需要在注册之前写入
+	// 使用 F 标志时内核在注册时就打开解释器
+	if r.profile != nil {
+		if err := writeProfile(r); err != nil {
+			return errors.Wrapf(err, "cannot write profile for %s", r.name)
+		}
+	}
+
+	// 构建注册字符串
+	// 格式: :name:M:offset:magic:mask:interpreter:flags
+	// 示例: :qemu-aarch64:M:0:\x7fELF...\xff\xff...:/usr/bin/qemu-aarch64:CFP
+	// 如果路径中包含 ":"，会自动选择其他分隔符；不合法的字段会直接返回错误
+	line, err := r.line()
+	if err != nil {
+		return errors.Wrapf(err, "invalid registration for %s", r.name)
 	}
 
 	// 构造 register 文件的完整路径
@@ -233,7 +581,7 @@ func install(arch string) error {
 
 	// 以只写模式打开 register 文件
 	// 不需要创建文件，因为 register 文件已经存在
-	file, err := os.OpenFile(register, os.O_WRONLY, 0)
+	file, err := fsys.OpenFile(register, os.O_WRONLY, 0)
 	if err != nil {
 		var pathErr *os.PathError
 		ok := errors.As(err, &pathErr)
@@ -255,30 +603,6 @@ func install(arch string) error {
 	}
 	defer file.Close()
 
-	// 设置标志位
-	// C: 清除标志，表示在注册前清除现有配置
-	// F: 固定标志，表示配置不能被覆盖
-	flags := "CF"
-
-	// 检查是否需要保留 argv0
-	// 环境变量 QEMU_PRESERVE_ARGV0 设置为非空值时启用
-	// P: 保留 argv0 标志，保持程序名称不变
-	// 这对于某些依赖程序名称的应用很重要
-	if v := os.Getenv("QEMU_PRESERVE_ARGV0"); v != "" {
-		flags += "P"
-	}
-
-	// 获取 QEMU 二进制文件的名称和路径
-	binaryBasename, binaryFullpath, err := getBinaryNames(cfg)
-	if err != nil {
-		return err
-	}
-
-	// 构建注册字符串
-	// 格式: :name:M:offset:magic:mask:interpreter:flags
-	// 示例: :qemu-aarch64:M:0:\x7fELF...\xff\xff...:/usr/bin/qemu-aarch64:CFP
-	line := fmt.Sprintf(":%s:M:0:%s:%s:%s:%s", binaryBasename, cfg.magic, cfg.mask, binaryFullpath, flags)
-
 	// 将注册字符串写入 register 文件
 	// sysfs 不支持部分写入，写入失败时无法恢复
 	_, err = file.Write([]byte(line))
@@ -288,28 +612,44 @@ func install(arch string) error {
 		// 检查是否是已存在错误
 		// 这意味着该配置已经被注册过了
 		if errors.As(err, &pathErr) && errors.Is(pathErr.Err, syscall.EEXIST) {
-			return errors.Errorf("%s already registered", binaryBasename)
+			return errors.Errorf("%s already registered", r.name)
+		}
+
+		// 检查是否是只读文件系统错误
+		// 这意味着 binfmt_misc 以只读方式挂载（如容器中的 /proc/sys）
+		if errors.Is(err, syscall.EROFS) {
+			return errors.Errorf("cannot register %s: %s is mounted read-only", r.name, mount)
 		}
 
 		// 其他错误
-		return errors.Errorf("cannot register %q to %s: %s", binaryFullpath, register, err)
+		return errors.Errorf("cannot register %q to %s: %s", r.interpreter, register, err)
 	}
 
 	return nil
 }
 
-// printStatus 打印当前系统的 binfmt 配置状态
+// status 结构体：描述当前系统的 binfmt 配置状态
+// 字段顺序和 JSON 标签决定了 printStatus 的输出格式
+type status struct {
+	Supported []string `json:"supported"` // 系统支持的架构列表
+	Emulators []string `json:"emulators"` // 已安装的模拟器列表
+	Instance  instance `json:"instance"`  // 被检查的 binfmt_misc 实例
+
+	Qemu     string            `json:"qemu"`               // binfmt 构建时附带的 QEMU 版本
+	Versions []emulatorVersion `json:"versions,omitempty"` // 已注册的 QEMU 模拟器报告的版本
+
+	Interpreters []interpreterChoice `json:"interpreters,omitempty"` // 每个架构在搜索路径中选中的模拟器
+	Profiles     []handlerProfile    `json:"profiles,omitempty"`     // 通过包装程序注册的条目使用的配置
+	Variants     []platformVariant   `json:"variants,omitempty"`     // 原生和模拟执行的平台支持的变体
+}
+
+// getStatus 收集当前系统的 binfmt 配置状态
 //
 // 返回值:
 //
+//	*status: 系统支持的架构列表和已启用的模拟器列表
 //	error: 如果读取状态失败返回错误，成功返回 nil
 //
-// 输出格式:
-//
-//	JSON 格式，包含两个字段：
-//	- supported: 系统支持的架构列表
-//	- emulators: 已安装的模拟器列表
-//
 // 工作原理:
 // 1. 读取 binfmt_misc 挂载点目录中的所有文件
 // 2. 跳过系统保留文件
@@ -317,16 +657,18 @@ func install(arch string) error {
 // 4. 检查配置是否启用（以 "enabled" 开头）
 // 5. 收集所有启用的模拟器名称
 // 6. 获取系统支持的架构列表
-// 7. 以 JSON 格式输出结果
 //
 // 注意:
-// - 输出为 JSON 格式，便于程序解析
-// - 只有状态为 "enabled" 的配置才会被包含在输出中
-func printStatus() error {
+// - 只有状态为 "enabled" 的配置才会被包含在结果中
+func getStatus() (*status, error) {
 	// 读取 binfmt_misc 挂载点目录中的所有文件
-	fis, err := os.ReadDir(mount)
-	if err != nil {
-		return err
+	// 只查询状态且未挂载时没有已注册的条目
+	var fis []os.DirEntry
+	if !statusUnmounted {
+		var err error
+		if fis, err = fsys.ReadDir(mount); err != nil {
+			return nil, err
+		}
 	}
 
 	// 收集已启用的模拟器
@@ -339,9 +681,9 @@ func printStatus() error {
 
 		// 读取配置文件的内容
 		// 内容通常为 "enabled" 或 "disabled"
-		dt, err := os.ReadFile(filepath.Join(mount, f.Name()))
+		dt, err := fsys.ReadFile(filepath.Join(mount, f.Name()))
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// 检查配置是否启用
@@ -350,26 +692,56 @@ func printStatus() error {
 		}
 	}
 
-	// 构建输出结构
-	// 使用匿名结构体定义 JSON 输出格式
-	out := struct {
-		Supported []string `json:"supported"` // 系统支持的架构列表
-		Emulators []string `json:"emulators"` // 已安装的模拟器列表
-	}{
+	st := &status{
 		Supported: formatPlatforms(archutil.SupportedPlatforms(true)),
 		Emulators: emulators,
+		Instance:  detectInstance(),
+		Qemu:      qemuVersion,
+		Versions:  getEmulatorVersions(emulators),
+		Profiles:  getHandlerProfiles(emulators),
+	}
+	// 使用内嵌的模拟器时不在搜索路径中查找
+	if !useEmbedded {
+		st.Interpreters = getInterpreterChoices()
 	}
+	st.Variants = getPlatformVariants(st)
+	return st, nil
+}
 
-	// 将结构体序列化为 JSON
-	// 使用缩进格式化，便于人类阅读
-	dt, err := json.MarshalIndent(out, "", "  ")
+// printStatus 打印当前系统的 binfmt 配置状态
+//
+// 返回值:
+//
+//	error: 如果读取状态失败返回错误，成功返回 nil
+//
+// 输出格式:
+//
+//	默认为缩进的 JSON 格式，包含以下字段（-output 可以选择其他格式，见 writeStatus）：
+//	- supported: 系统支持的架构列表
+//	- emulators: 已安装的模拟器列表
+//	- instance: 被检查的 binfmt_misc 实例
+//	- qemu: binfmt 构建时附带的 QEMU 版本
+//	- versions: 已注册的 QEMU 模拟器报告的版本，与 qemu 不一致时标记 mismatch
+//	- interpreters: 每个架构在搜索路径中选中的模拟器和被拒绝的候选文件
+//	- profiles: 通过 -profile 注册的条目使用的 QEMU 设置
+//	- variants: 原生和模拟执行的平台支持的变体（如 linux/amd64 的 v1、v2、v3）
+//
+// 注意:
+// - 默认的 JSON 格式保持不变，便于已有的脚本用 jq 解析 .supported 和 .emulators
+// - 状态数据由 getStatus 收集
+// - 如果指定了 -labels-file 或 -nfd-features-file，同时写入节点标签
+func printStatus() error {
+	out, err := getStatus()
 	if err != nil {
 		return err
 	}
 
-	// 输出 JSON
-	fmt.Printf("%s\n", dt)
-	return nil
+	if err := writeNodeLabels(out); err != nil {
+		return errors.Wrap(err, "cannot write node labels")
+	}
+
+	// 按 -output 指定的格式输出
+	return writeStatus(os.Stdout, out, outputFormat)
 }
 
 // formatPlatforms 格式化平台信息列表
@@ -480,6 +852,7 @@ func parseArch(in string) (out []string) {
 // 注意:
 //   - 支持使用 glob 模式匹配（如 "qemu-*"）
 //   - 会查找所有匹配的配置文件
+//   - 包含路径分隔符的目标不会被展开，匹配结果被限制在挂载点目录内
 func parseUninstall(in string) (out []string) {
 	// 如果输入为空，返回空列表
 	if in == "" {
@@ -498,9 +871,16 @@ func parseUninstall(in string) (out []string) {
 			}
 		}
 
+		// 不合法的名称（如包含 "../"）不进行 glob 匹配
+		// 原样保留，由 uninstall() 报告错误
+		if err := validateName(v); err != nil {
+			out = append(out, v)
+			continue
+		}
+
 		// 使用 glob 模式匹配查找配置文件
 		// 这允许使用通配符进行匹配
-		fis, err := filepath.Glob(filepath.Join(mount, v))
+		fis, err := fsys.Glob(filepath.Join(mount, v))
 		if err != nil || len(fis) == 0 {
 			// 没有找到匹配的文件，直接使用原始字符串
 			out = append(out, v)
@@ -508,6 +888,10 @@ func parseUninstall(in string) (out []string) {
 
 		// 收集所有匹配的配置文件名称
 		for _, fi := range fis {
+			// 只接受挂载点目录中的文件
+			if filepath.Dir(fi) != filepath.Clean(mount) {
+				continue
+			}
 			// 提取文件名（去掉路径）
 			out = append(out, filepath.Base(fi))
 		}
@@ -520,28 +904,72 @@ func parseUninstall(in string) (out []string) {
 //
 // 工作流程:
 // 1. 设置日志格式（不显示时间戳）
-// 2. 解析命令行参数
+// 2. 解析命令行参数，根据 -log-format 和 -log-level 设置结构化日志
 // 3. 调用 run 函数执行主要逻辑
 // 4. 如果发生错误，输出错误信息
 //
 // 注意:
-//   - 日志不显示时间戳，使输出更简洁
-//   - 错误信息使用 %+v 格式，包含完整的错误堆栈
+//   - text 格式的日志不显示时间戳，使输出更简洁
+//   - 错误的完整堆栈只在 -log-level debug 时输出
 func main() {
 	// 设置日志格式
 	// 不显示时间戳，使输出更简洁
 	log.SetFlags(0)
 
+	// 作为包装程序被内核执行时，自身末尾内嵌了配置和真正的模拟器
+	// 此时不解析命令行参数，直接执行内嵌的模拟器；读取配置失败时退出，不运行命令行
+	if p, ok, err := loadWrapper(); ok {
+		if err != nil {
+			log.Fatalf("error: %+v", err)
+		}
+		log.Fatalf("error: %+v", runWrapper(p, os.Args))
+	}
+
+	// binfmt run 子命令有自己的参数，不注册条目，直接在模拟器下执行命令
+	// binfmt chroot 子命令在其他架构的根文件系统中通过模拟器运行命令
+	// binfmt smoke-test 子命令在模拟器下运行本地 OCI 镜像布局中每个平台的镜像
+	if len(os.Args) > 1 {
+		subcommands := map[string]func([]string) error{
+			"run":        runCommand,
+			"chroot":     runChroot,
+			"smoke-test": runSmokeTest,
+		}
+		if fn, ok := subcommands[os.Args[1]]; ok {
+			if err := fn(os.Args[2:]); err != nil {
+				log.Fatalf("error: %+v", err)
+			}
+			return
+		}
+	}
+
 	// 解析命令行参数
 	flag.Parse()
+	if err := setupLogging(os.Stderr, logFormat, logLevel); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if err := checkOutputFormat(outputFormat); err != nil {
+		log.Fatalf("error: %v", err)
+	}
 
 	// 执行主要逻辑
-	if err := run(); err != nil {
+	// 如果指定了 -userns，在新的用户命名空间中执行
+	runFn := run
+	if flUserNS {
+		runFn = runUserNS
+	}
+	if err := runFn(); err != nil {
 		// 如果发生错误，输出错误信息
-		log.Printf("error: %+v", err)
+		logError(err)
 	}
 }
 
+// isStatusOnly 判断命令行是否只查询状态，不安装、卸载、持久化、升级或替换任何条目
+func isStatusOnly() bool {
+	return toInstall == "" && toUninstall == "" && toUpgrade == "" &&
+		toPersist == "" && toUnpersist == "" && ociLayoutDir == "" &&
+		traceArch == "" && debugArch == "" && !flDaemon
+}
+
 // run 执行程序的主要逻辑
 //
 // 返回值:
@@ -555,9 +983,11 @@ func main() {
 // 4. 执行安装操作（如果指定了 -install 参数）
 // 5. 打印当前状态
 //
+// 如果指定了 -daemon 参数，第 4 步之后进入守护进程模式，直到收到 SIGTERM
+//
 // 注意:
-//   - 如果 binfmt_misc 未挂载，程序会尝试挂载它
-//   - 程序退出时会自动卸载 binfmt_misc（如果是由程序挂载的）
+//   - 如果 binfmt_misc 未挂载，程序会尝试挂载它（-mount-mode require-existing 时返回错误）
+//   - 程序退出时会自动卸载 binfmt_misc（如果是由程序挂载的，-mount-mode persistent 时保留）
 //   - 安装和卸载操作会分别报告每个操作的结果
 func run() error {
 	// 检查是否需要显示版本信息
@@ -565,46 +995,120 @@ func run() error {
 		// 输出版本信息
 		// 格式: binfmt/{revision} qemu/{version} go/{version}
 		// runtime.Version()[2:] 用于去掉 "go" 前缀
-		log.Printf("binfmt/%s qemu/%s go/%s", revision, qemuVersion, runtime.Version()[2:])
+		goVersion := runtime.Version()[2:]
+		slog.Info(fmt.Sprintf("binfmt/%s qemu/%s go/%s", revision, qemuVersion, goVersion),
+			"binfmt", revision, "qemu", qemuVersion, "go", goVersion)
 		return nil
 	}
 
-	// 检查 binfmt_misc 是否已挂载
-	// 通过检查 status 文件是否存在来判断
-	if _, err := os.Stat(filepath.Join(mount, "status")); err != nil {
-		// binfmt_misc 未挂载，尝试挂载
-		// syscall.Mount 参数:
-		//   - "binfmt_misc": 源设备名称
-		//   - mount: 目标挂载点
-		//   - "binfmt_misc": 文件系统类型
-		//   - 0: 挂载标志
-		//   - "": 挂载选项
-		if err := syscall.Mount("binfmt_misc", mount, "binfmt_misc", 0, ""); err != nil {
-			return errors.Wrapf(err, "cannot mount binfmt_misc filesystem at %s", mount)
-		}
+	// 在修改任何条目之前检查参数的组合
+	traceTo, err := traceTarget()
+	if err != nil {
+		return err
+	}
+	debugTo, debugCfg, err := debugTarget()
+	if err != nil {
+		return err
+	}
 
-		// 注册 defer 函数，在程序退出时卸载 binfmt_misc
-		// 这样可以确保不会在系统中留下挂载点
-		defer syscall.Unmount(mount, 0)
+	// 如果指定了 -pid，通过 /proc/<pid>/root 操作目标进程所在的实例
+	// 不会在目标进程的命名空间中挂载 binfmt_misc
+	if targetPID != 0 {
+		mount = targetMount(targetPID, mount)
+		if _, err := fsys.Stat(filepath.Join(mount, "status")); err != nil {
+			return errors.Wrapf(err, "binfmt_misc is not mounted in process %d", targetPID)
+		}
+	} else {
+		// 根据 -mount-mode 复用已有的挂载或挂载 binfmt_misc
+		// auto 模式下如果是由程序挂载的，退出时会卸载；只查询状态时不挂载
+		unmount, err := ensureMount(isStatusOnly())
+		if err != nil {
+			return err
+		}
+		defer unmount()
 	}
 
 	// 执行卸载操作
 	// 遍历所有需要卸载的架构
 	for _, name := range parseUninstall(toUninstall) {
 		// 尝试卸载
-		err := uninstall(name)
-		if err == nil {
-			// 卸载成功
-			log.Printf("uninstalling: %s OK", name)
-		} else {
-			// 卸载失败
-			log.Printf("uninstalling: %s %v", name, err)
+		// 卸载前记录解释器，卸载后条目不再存在
+		attrs := handlerAttrs(name)
+		logResult("uninstall", uninstall(name), attrs...)
+	}
+
+	// 如果指定了 -oci-layout，先解压镜像中的模拟器，之后从解压的目录中注册
+	if ociLayoutDir != "" {
+		target := ociTarget
+		if target == "" {
+			// 使用 F 标志注册后内核会一直持有解释器，临时目录可以在退出时删除
+			dir, err := os.MkdirTemp("", "binfmt-oci-")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+			target = dir
+		}
+		names, err := extractEmulators(ociLayoutDir, target)
+		if err != nil {
+			return errors.Wrapf(err, "cannot extract emulators from %s", ociLayoutDir)
 		}
+		slog.Info("extracted emulators", "action", "extract", "emulators", names, "layout", ociLayoutDir, "dir", target)
+		os.Setenv("QEMU_BINARY_PATH", target)
+		os.Unsetenv("QEMU_BINARY_SEARCH_PATH")
+	}
+
+	// 执行持久化操作
+	p := newPersister()
+	unpersistNames := parseArch(toUnpersist)
+	if toUnpersist == "all" {
+		names, err := p.persisted()
+		if err != nil {
+			return err
+		}
+		unpersistNames = names
+	}
+	for _, name := range unpersistNames {
+		logResult("unpersist", p.unpersist(name), "arch", name)
+	}
+	// 变体通过包装程序设置 CPU 型号，而包装程序不会被持久化
+	if variants, err := parseVariants(toPersist); err != nil {
+		return err
+	} else if len(variants) > 0 {
+		return errors.Errorf("cannot persist platform variants (%s), the QEMU CPU model is set by a wrapper that is not persisted", toPersist)
+	}
+	persistArchs := parseArch(toPersist)
+	if toPersist == "all" {
+		persistArchs = allArch()
+	}
+	for _, name := range persistArchs {
+		logResult("persist", p.persist(name), archAttrs(name)...)
+	}
+
+	// 记录 -install 和 -upgrade 中指定的平台变体（如 linux/amd64/v3）
+	// 注册时据此选择 QEMU 的 CPU 型号
+	variants, err := parseVariants(toUpgrade + "," + toInstall)
+	if err != nil {
+		return err
+	}
+	installVariants = variants
+
+	// 执行升级操作
+	upgradeArchs := parseArch(toUpgrade)
+	if toUpgrade == "all" {
+		upgradeArchs = registeredArch()
+	}
+	for _, name := range upgradeArchs {
+		err := upgrade(name)
+		logResult("upgrade", err, archAttrs(name)...)
 	}
 
 	// 确定要安装的架构列表
 	var installArchs []string
-	if toInstall == "all" {
+	if toInstall == "all" && flDaemon {
+		// 守护进程模式需要持续管理已经注册的架构，不能排除它们
+		installArchs = allManagedArch()
+	} else if toInstall == "all" {
 		// 如果指定了 "all"，安装所有支持的架构
 		installArchs = allArch()
 	} else {
@@ -612,18 +1116,27 @@ func run() error {
 		installArchs = parseArch(toInstall)
 	}
 
+	// 守护进程模式：持续协调，代替一次性的安装操作
+	if flDaemon {
+		return runDaemon(installArchs)
+	}
+
 	// 执行安装操作
 	// 遍历所有需要安装的架构
 	for _, name := range installArchs {
-		// 尝试安装
+		// 尝试安装，记录结果以及注册的条目和解释器
 		err := install(name)
-		if err == nil {
-			// 安装成功
-			log.Printf("installing: %s OK", name)
-		} else {
-			// 安装失败
-			log.Printf("installing: %s %v", name, err)
-		}
+		logResult("install", err, archAttrs(name)...)
+	}
+
+	// 跟踪模式：临时替换一个架构的条目，结束后恢复
+	if traceTo != "" {
+		return runTrace(traceTo, flag.Args())
+	}
+
+	// 调试模式：临时替换一个架构的条目，结束后恢复
+	if debugTo != "" {
+		return runDebug(debugTo, debugCfg, flag.Args())
 	}
 
 	// 打印当前状态
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// TestInstall 测试注册成功后条目的内容
+func TestInstall(t *testing.T) {
+	f := newFakeFS(t, true)
+	dir := fakeInterpreters(t, "arm64", "riscv64")
+	t.Setenv("QEMU_PRESERVE_ARGV0", "1")
+
+	if err := install("arm64"); err != nil {
+		t.Fatal(err)
+	}
+	e, ok := f.entry("qemu-aarch64")
+	if !ok {
+		t.Fatalf("entry not registered: %v", f.names())
+	}
+	if e.interpreter != filepath.Join(dir, "qemu-aarch64") {
+		t.Fatalf("unexpected interpreter %q", e.interpreter)
+	}
+	if e.flags != "PCF" {
+		t.Fatalf("unexpected flags %q", e.flags)
+	}
+
+	dt, err := os.ReadFile(filepath.Join(mount, "qemu-aarch64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(dt), "enabled\ninterpreter "+filepath.Join(dir, "qemu-aarch64")+"\nflags: PCF\n") {
+		t.Fatalf("unexpected entry content %q", dt)
+	}
+}
+
+// TestInstallErrors 测试注册失败时的错误信息
+func TestInstallErrors(t *testing.T) {
+	t.Run("unsupported", func(t *testing.T) {
+		newFakeFS(t, true)
+		if err := install("foo"); err == nil || !strings.Contains(err.Error(), "unsupported architecture") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+	t.Run("not mounted", func(t *testing.T) {
+		newFakeFS(t, false)
+		fakeInterpreters(t, "arm64")
+		if err := install("arm64"); err == nil || !strings.Contains(err.Error(), "is it mounted?") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+	t.Run("already registered", func(t *testing.T) {
+		newFakeFS(t, true)
+		fakeInterpreters(t, "arm64")
+		if err := install("arm64"); err != nil {
+			t.Fatal(err)
+		}
+		if err := install("arm64"); err == nil || !strings.Contains(err.Error(), "already registered") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+	t.Run("missing interpreter", func(t *testing.T) {
+		f := newFakeFS(t, true)
+		fakeInterpreters(t)
+		if err := install("arm64"); err == nil || !strings.Contains(err.Error(), "cannot register") {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(f.names()) != 0 {
+			t.Fatalf("unexpected entries %v", f.names())
+		}
+	})
+	t.Run("bad prefix", func(t *testing.T) {
+		newFakeFS(t, true)
+		fakeInterpreters(t, "arm64")
+		t.Setenv("QEMU_BINARY_PREFIX", "a/")
+		if err := install("arm64"); err == nil || !strings.Contains(err.Error(), "path separator") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+}
+
+// TestUninstall 测试通过架构名称和模拟器名称卸载条目
+func TestUninstall(t *testing.T) {
+	f := newFakeFS(t, true)
+	fakeInterpreters(t, "arm64", "riscv64", "s390x")
+	for _, arch := range []string{"arm64", "riscv64", "s390x"} {
+		if err := install(arch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := uninstall("aarch64"); err != nil {
+		t.Fatal(err)
+	}
+	if err := uninstall("qemu-riscv64"); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.names(); !reflect.DeepEqual(got, []string{"qemu-s390x"}) {
+		t.Fatalf("unexpected entries %v", got)
+	}
+	if err := uninstall("aarch64"); err == nil || err.Error() != "not found" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := uninstall("status"); err == nil {
+		t.Fatal("expected status file to be skipped")
+	}
+}
+
+// TestParseUninstall 测试卸载目标的解析和 glob 匹配
+func TestParseUninstall(t *testing.T) {
+	newFakeFS(t, true)
+	fakeInterpreters(t, "arm64", "arm", "riscv64")
+	for _, arch := range []string{"arm64", "arm", "riscv64"} {
+		if err := install(arch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tcs := []struct {
+		in       string
+		expected []string
+	}{
+		{in: "", expected: nil},
+		{in: "arm64", expected: []string{"aarch64"}},
+		{in: "linux/riscv64", expected: []string{"riscv64"}},
+		{in: "qemu-a*", expected: []string{"qemu-aarch64", "qemu-arm"}},
+		{in: "qemu-foo*,qemu-arm", expected: []string{"qemu-foo*", "qemu-arm"}},
+		{in: "../*", expected: []string{"../*"}},
+	}
+	for _, tc := range tcs {
+		if got := parseUninstall(tc.in); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%q: expected %v, got %v", tc.in, tc.expected, got)
+		}
+	}
+}
+
+// TestGetStatus 测试只有启用的条目会出现在状态中
+func TestGetStatus(t *testing.T) {
+	f := newFakeFS(t, true)
+	fakeInterpreters(t, "arm64", "riscv64")
+	for _, arch := range []string{"arm64", "riscv64"} {
+		if err := install(arch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.WriteFile(filepath.Join(mount, "qemu-riscv64"), []byte("0"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := getStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(st.Emulators, []string{"qemu-aarch64"}) {
+		t.Fatalf("unexpected emulators %v", st.Emulators)
+	}
+	if len(st.Supported) == 0 {
+		t.Fatal("expected native platform in supported list")
+	}
+}
+
+// TestFakeStatusFile 测试向 status 文件写入 "-1" 会删除所有条目
+func TestFakeStatusFile(t *testing.T) {
+	f := newFakeFS(t, true)
+	fakeInterpreters(t, "arm64")
+	if err := install("arm64"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteFile(filepath.Join(mount, "status"), []byte("0"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dt, err := f.ReadFile(filepath.Join(mount, "status"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dt) != "disabled\n" {
+		t.Fatalf("unexpected status %q", dt)
+	}
+	if err := f.WriteFile(filepath.Join(mount, "status"), []byte("-1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.names()) != 0 {
+		t.Fatalf("unexpected entries %v", f.names())
+	}
+	err = f.WriteFile(filepath.Join(mount, "status"), []byte("2"), 0600)
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || pathErr.Err != syscall.EINVAL {
+		t.Fatalf("expected EINVAL, got %v", err)
+	}
+}
+
+// TestRunMount 测试 run 在 binfmt_misc 未挂载时挂载并在结束后卸载
+func TestRunMount(t *testing.T) {
+	f := newFakeFS(t, false)
+	fakeInterpreters(t, "arm64")
+
+	defer func(old string) { toInstall = old }(toInstall)
+	toInstall = "arm64"
+
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	if f.mounts != 1 || f.unmounts != 1 {
+		t.Fatalf("expected one mount and unmount, got %d and %d", f.mounts, f.unmounts)
+	}
+	if got := f.names(); !reflect.DeepEqual(got, []string{"qemu-aarch64"}) {
+		t.Fatalf("unexpected entries %v", got)
+	}
+
+	f.mountErr = syscall.EPERM
+	if err := run(); err == nil || !strings.Contains(err.Error(), "cannot mount binfmt_misc") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/platforms"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// probeTimeout 是单次探测模拟器的超时时间
+const probeTimeout = 10 * time.Second
+
+// probeResult 结构体：单个平台的探测结果
+type probeResult struct {
+	duration time.Duration // 探测耗时
+	err      error         // 探测失败时的错误
+}
+
+// metrics 结构体：守护进程模式下的指标和健康状态
+//
+// 指标以 Prometheus 文本格式通过 /metrics 暴露，
+// 健康检查通过 /healthz（进程存活且协调在正常进行）和 /readyz（所有期望的模拟器可用）暴露。
+// 数据来源于每次协调的结果和 getStatus 收集的状态。
+type metrics struct {
+	mu sync.Mutex
+
+	interval      time.Duration          // 协调间隔，用于判断协调是否停滞
+	lastReconcile time.Time              // 上次协调完成的时间
+	desired       []string               // 期望注册的架构
+	registered    map[string]bool        // 每个架构的条目是否已注册并启用
+	supported     map[string]bool        // 每个平台是否被系统支持
+	probes        map[string]probeResult // 每个平台的解释器探测结果
+	actions       map[[2]string]uint64   // 按架构和操作统计的重新注册次数
+	failures      map[string]uint64      // 按架构统计的失败次数
+}
+
+// newMetrics 创建指标收集器
+//
+// 参数:
+//
+//	archs: 期望注册的架构列表
+//	interval: 协调间隔
+//
+// 返回值:
+//
+//	*metrics: 指标收集器
+func newMetrics(archs []string, interval time.Duration) *metrics {
+	return &metrics{
+		interval:   interval,
+		desired:    archs,
+		registered: map[string]bool{},
+		supported:  map[string]bool{},
+		probes:     map[string]probeResult{},
+		actions:    map[[2]string]uint64{},
+		failures:   map[string]uint64{},
+	}
+}
+
+// archPlatform 返回架构对应的平台（如 "arm64" 对应 "linux/arm64"）
+// 每个结果都根据自己的架构计算，通过控制套接字后来添加的架构也有正确的平台
+func archPlatform(arch string) string {
+	return platforms.FormatAll(platforms.Normalize(ocispecs.Platform{OS: "linux", Architecture: arch}))
+}
+
+// update 根据一次协调的结果更新指标
+//
+// 参数:
+//
+//	results: 协调结果
+//	st: 协调后由 getStatus 收集的状态
+//
+// 工作原理:
+// 1. 统计重新注册和失败的次数
+// 2. 根据状态获取已注册的模拟器和系统支持的平台
+// 3. 对每个协调的架构运行已注册的解释器的版本参数进行探测，记录耗时
+func (m *metrics) update(results []reconcileResult, st *status) {
+	enabled := map[string]bool{}
+	for _, name := range st.Emulators {
+		enabled[name] = true
+	}
+	supported := map[string]bool{}
+	for _, p := range st.Supported {
+		supported[p] = true
+	}
+
+	registered := map[string]bool{}
+	probes := map[string]probeResult{}
+	for _, res := range results {
+		if res.name == "" {
+			continue
+		}
+		registered[res.arch] = enabled[res.name]
+		probes[archPlatform(res.arch)] = probeEntry(res.name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, res := range results {
+		switch res.action {
+		case actionOK:
+		case actionFailed:
+			m.failures[res.arch]++
+		default:
+			m.actions[[2]string{res.arch, res.action}]++
+		}
+	}
+	m.registered = registered
+	m.supported = supported
+	m.probes = probes
+	m.lastReconcile = time.Now()
+}
+
+// probeEntry 运行条目中注册的解释器的版本参数，确认解释器本身可以执行
+//
+// 只说明解释器文件存在且可以运行，不经过 binfmt_misc 执行其他架构的程序；
+// 平台是否真正可以执行由 binfmt_platform_supported 反映
+//
+// 参数:
+//
+//	name: 条目名称
+//
+// 返回值:
+//
+//	probeResult: 探测结果和耗时
+func probeEntry(name string) probeResult {
+	start := time.Now()
+	e, err := readEntry(name)
+	if err != nil {
+		return probeResult{duration: time.Since(start), err: err}
+	}
+	// 通过文件描述符注册的解释器只存在于内核中，无法单独运行
+	if isFDInterpreter(e.interpreter) {
+		return probeResult{duration: time.Since(start)}
+	}
+	b, _, ok := entryBackend(name)
+	if !ok {
+		b = backends[backendQEMU]
+	}
+	_, err = probeInterpreter(e.interpreter, b.versionArg)
+	return probeResult{duration: time.Since(start), err: err}
+}
+
+// probeInterpreter 运行解释器的版本参数（如 QEMU 的 -version）并返回输出
+//
+// 参数:
+//
+//	interpreter: 解释器路径
+//	arg: 输出版本的参数
+//
+// 返回值:
+//
+//	string: 解释器的输出
+//	error: 如果运行失败或超时返回错误
+func probeInterpreter(interpreter, arg string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, interpreter, arg).CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "%s %s: %s", interpreter, arg, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// healthy 判断守护进程是否存活
+//
+// 返回值:
+//
+//	error: 如果协调已经超过三个间隔没有完成返回错误
+func (m *metrics) healthy() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lastReconcile.IsZero() {
+		return errors.New("no reconcile completed yet")
+	}
+	if d := time.Since(m.lastReconcile); d > 3*m.interval {
+		return errors.Errorf("last reconcile completed %s ago", d.Round(time.Second))
+	}
+	return nil
+}
+
+// ready 判断所有期望的模拟器是否可用
+//
+// 返回值:
+//
+//	error: 如果任何期望的架构未注册、未被系统支持或探测失败返回错误
+func (m *metrics) ready() error {
+	if err := m.healthy(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var errs []string
+	for _, arch := range m.desired {
+		p := archPlatform(arch)
+		switch {
+		case !m.registered[arch]:
+			errs = append(errs, arch+": not registered")
+		case m.probes[p].err != nil:
+			errs = append(errs, arch+": "+m.probes[p].err.Error())
+		case !m.supported[p]:
+			errs = append(errs, arch+": "+p+" not supported")
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// writeTo 以 Prometheus 文本格式输出所有指标
+//
+// 参数:
+//
+//	w: 输出目标
+//
+// 输出的指标:
+//   - binfmt_handler_desired{arch}: 架构是否在期望列表中
+//   - binfmt_handler_registered{arch}: 架构的条目是否已注册并启用
+//   - binfmt_reregistrations_total{arch,action}: 重新注册、替换和重新启用的次数
+//   - binfmt_reconcile_failures_total{arch}: 协调失败的次数
+//   - binfmt_interpreter_probe_duration_seconds{platform}: 上次运行解释器版本参数的耗时
+//   - binfmt_interpreter_probe_success{platform}: 上次运行解释器版本参数是否成功
+//   - binfmt_platform_supported{platform}: 平台是否被系统支持
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	archs := append([]string{}, m.desired...)
+	sort.Strings(archs)
+
+	header(w, "binfmt_handler_desired", "gauge", "Whether a handler for the architecture is desired.")
+	for _, arch := range archs {
+		fmt.Fprintf(w, "binfmt_handler_desired{arch=%q} 1\n", arch)
+	}
+
+	header(w, "binfmt_handler_registered", "gauge", "Whether the handler for the architecture is registered and enabled.")
+	for _, arch := range archs {
+		fmt.Fprintf(w, "binfmt_handler_registered{arch=%q} %d\n", arch, boolValue(m.registered[arch]))
+	}
+
+	header(w, "binfmt_reregistrations_total", "counter", "Number of corrections made to handlers by the daemon.")
+	keys := make([][2]string, 0, len(m.actions))
+	for k := range m.actions {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0]+"/"+keys[i][1] < keys[j][0]+"/"+keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "binfmt_reregistrations_total{arch=%q,action=%q} %d\n", k[0], k[1], m.actions[k])
+	}
+
+	header(w, "binfmt_reconcile_failures_total", "counter", "Number of failed attempts to reconcile a handler.")
+	for _, arch := range archs {
+		fmt.Fprintf(w, "binfmt_reconcile_failures_total{arch=%q} %d\n", arch, m.failures[arch])
+	}
+
+	ps := make([]string, 0, len(m.probes))
+	for p := range m.probes {
+		ps = append(ps, p)
+	}
+	sort.Strings(ps)
+
+	header(w, "binfmt_interpreter_probe_duration_seconds", "gauge", "Duration of the last run of the registered interpreter's version check.")
+	for _, p := range ps {
+		fmt.Fprintf(w, "binfmt_interpreter_probe_duration_seconds{platform=%q} %g\n", p, m.probes[p].duration.Seconds())
+	}
+
+	header(w, "binfmt_interpreter_probe_success", "gauge", "Whether the registered interpreter ran its version check. This does not execute a program through binfmt_misc.")
+	for _, p := range ps {
+		fmt.Fprintf(w, "binfmt_interpreter_probe_success{platform=%q} %d\n", p, boolValue(m.probes[p].err == nil))
+	}
+
+	sp := make([]string, 0, len(m.supported))
+	for p := range m.supported {
+		sp = append(sp, p)
+	}
+	sort.Strings(sp)
+
+	header(w, "binfmt_platform_supported", "gauge", "Whether the platform can be executed on this node.")
+	for _, p := range sp {
+		fmt.Fprintf(w, "binfmt_platform_supported{platform=%q} 1\n", p)
+	}
+}
+
+// handler 返回提供 /metrics、/healthz 和 /readyz 的 HTTP 处理器
+func (m *metrics) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.writeTo(w)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		checkHandler(w, m.healthy())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		checkHandler(w, m.ready())
+	})
+	return mux
+}
+
+// serve 在指定地址上提供指标和健康检查，直到 ctx 被取消
+//
+// 参数:
+//
+//	ctx: 上下文，取消时关闭监听
+//	addr: 监听地址（如 "127.0.0.1:9253"）
+//
+// 返回值:
+//
+//	error: 如果无法监听返回错误
+func (m *metrics) serve(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: m.handler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			slog.Error("metrics server failed", "error", err)
+		}
+	}()
+	slog.Info("metrics: listening", "addr", l.Addr().String())
+	return nil
+}
+
+// checkHandler 根据检查结果返回 200 或 503
+func checkHandler(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// header 输出指标的 HELP 和 TYPE 行
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// boolValue 将布尔值转换为指标值
+func boolValue(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMetrics 测试协调结果被正确地反映到指标和健康检查中
+func TestMetrics(t *testing.T) {
+	newFakeFS(t, true)
+	fakeInterpreters(t, "riscv64", "s390x")
+
+	m := newMetrics([]string{"riscv64", "s390x"}, time.Hour)
+	d := newDaemon([]string{"riscv64", "s390x"}, time.Hour)
+	d.hooks = append(d.hooks, m.update)
+
+	srv := httptest.NewServer(m.handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected healthz to fail before first reconcile, got %d", resp.StatusCode)
+	}
+
+	d.reconcile()
+	if err := writeEntry("qemu-s390x", "-1"); err != nil {
+		t.Fatal(err)
+	}
+	d.reconcile()
+
+	var buf bytes.Buffer
+	m.writeTo(&buf)
+	for _, l := range []string{
+		`binfmt_handler_desired{arch="riscv64"} 1`,
+		`binfmt_handler_registered{arch="s390x"} 1`,
+		`binfmt_reregistrations_total{arch="riscv64",action="registered"} 1`,
+		`binfmt_reregistrations_total{arch="s390x",action="registered"} 2`,
+		`binfmt_reconcile_failures_total{arch="s390x"} 0`,
+		`binfmt_interpreter_probe_success{platform="linux/riscv64"} 1`,
+	} {
+		if !strings.Contains(buf.String(), l+"\n") {
+			t.Errorf("missing %q in metrics:\n%s", l, buf.String())
+		}
+	}
+
+	resp, err = http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected healthz to succeed, got %d", resp.StatusCode)
+	}
+
+	// 模拟的解释器无法真正运行 riscv64 程序，所以平台不会出现在支持列表中
+	m.mu.Lock()
+	m.supported["linux/riscv64"] = true
+	m.supported["linux/s390x"] = true
+	m.mu.Unlock()
+	if err := m.ready(); err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	delete(m.supported, "linux/s390x")
+	m.mu.Unlock()
+	if err := m.ready(); err == nil || !strings.Contains(err.Error(), "linux/s390x not supported") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+// TestMetricsPlatformPerArch 测试启动后才添加的架构（如通过控制套接字）使用自己的平台标签，不会互相覆盖
+func TestMetricsPlatformPerArch(t *testing.T) {
+	newFakeFS(t, true)
+	fakeInterpreters(t, "riscv64", "s390x", "arm64")
+	for _, arch := range []string{"riscv64", "s390x", "arm64"} {
+		if err := install(arch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := newMetrics([]string{"riscv64"}, time.Hour)
+	m.update([]reconcileResult{
+		{arch: "riscv64", name: "qemu-riscv64", action: actionOK},
+		{arch: "s390x", name: "qemu-s390x", action: actionOK},
+		{arch: "arm64", name: "qemu-aarch64", action: actionOK},
+	}, &status{})
+
+	var buf bytes.Buffer
+	m.writeTo(&buf)
+	for _, p := range []string{"linux/riscv64", "linux/s390x", "linux/arm64"} {
+		if l := `binfmt_interpreter_probe_success{platform="` + p + `"} 1`; !strings.Contains(buf.String(), l+"\n") {
+			t.Errorf("missing %q in metrics:\n%s", l, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), `platform="unknown`) || strings.Contains(buf.String(), `platform=""`) {
+		t.Errorf("unexpected empty platform in metrics:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// binfmt_misc 的挂载模式
+const (
+	// mountModeAuto 复用已有的挂载；如果没有挂载则临时挂载，退出时卸载
+	mountModeAuto = "auto"
+	// mountModeRequireExisting 只使用已有的挂载，未挂载时返回错误
+	mountModeRequireExisting = "require-existing"
+	// mountModePersistent 复用已有的挂载；如果没有挂载则挂载，退出时不卸载
+	mountModePersistent = "persistent"
+)
+
+// statusUnmounted 为 true 表示只查询状态时 binfmt_misc 没有挂载，ensureMount 没有挂载它
+var statusUnmounted bool
+
+// mountInfo 结构体：/proc/self/mountinfo 中的一个挂载项
+type mountInfo struct {
+	mountPoint string // 挂载点
+	fsType     string // 文件系统类型
+	source     string // 挂载源
+	readOnly   bool   // 是否为只读挂载
+	dev        string // 超级块的设备号（major:minor）
+}
+
+// findMount 在 /proc/self/mountinfo 中查找挂载点上的 binfmt_misc 挂载
+//
+// 参数:
+//
+//	p: 挂载点路径
+//
+// 返回值:
+//
+//	*mountInfo: 找到的挂载项，未挂载时为 nil
+//	error: 如果无法读取 mountinfo 返回错误
+//
+// 注意:
+//   - 同一个挂载点上有多个挂载时，使用最后一个（最上层）
+//   - 挂载点上最上层的挂载不是 binfmt_misc 时视为未挂载
+//   - systemd 主机上挂载点是尚未触发的 autofs 自动挂载点，
+//     访问 status 文件触发挂载后重新读取 mountinfo，不会在其上再挂载一个 binfmt_misc
+func findMount(p string) (*mountInfo, error) {
+	target := filepath.Clean(p)
+	if resolved, err := filepath.EvalSymlinks(target); err == nil {
+		target = resolved
+	}
+
+	found, err := topMount(target)
+	if err != nil {
+		return nil, err
+	}
+	if found != nil && found.fsType == "autofs" {
+		fsys.Stat(filepath.Join(target, "status"))
+		if found, err = topMount(target); err != nil {
+			return nil, err
+		}
+	}
+	if found == nil || found.fsType != "binfmt_misc" {
+		return nil, nil
+	}
+	return found, nil
+}
+
+// topMount 返回 mountinfo 中挂载点上最上层的挂载，没有挂载时为 nil
+func topMount(target string) (*mountInfo, error) {
+	dt, err := fsys.MountInfo()
+	if err != nil {
+		return nil, err
+	}
+	var found *mountInfo
+	s := bufio.NewScanner(bytes.NewReader(dt))
+	for s.Scan() {
+		mi, ok := parseMountInfoLine(s.Text())
+		if !ok || mi.mountPoint != target {
+			continue
+		}
+		found = mi
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// parseMountInfoLine 解析 mountinfo 中的一行
+//
+// 格式:
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// 第 5 个字段为挂载点，第 6 个字段为挂载选项，"-" 之后依次为文件系统类型、挂载源和超级块选项
+func parseMountInfoLine(l string) (*mountInfo, bool) {
+	fields := strings.Fields(l)
+	if len(fields) < 10 {
+		return nil, false
+	}
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep == -1 || sep+3 > len(fields) {
+		return nil, false
+	}
+	mi := &mountInfo{
+		dev:        fields[2],
+		mountPoint: unescapeMountInfo(fields[4]),
+		fsType:     fields[sep+1],
+		source:     unescapeMountInfo(fields[sep+2]),
+	}
+	for _, opts := range []string{fields[5], fields[len(fields)-1]} {
+		for _, o := range strings.Split(opts, ",") {
+			if o == "ro" {
+				mi.readOnly = true
+			}
+		}
+	}
+	return mi, true
+}
+
+// unescapeMountInfo 解码 mountinfo 中的八进制转义（如 \040 表示空格）
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// isMounted 判断挂载点上是否已经挂载了 binfmt_misc
+//
+// 返回值:
+//
+//	*mountInfo: 找到的挂载项，无法读取 mountinfo 时为 nil
+//	bool: 是否已挂载
+//
+// 注意:
+//   - 无法读取 mountinfo 时（如 /proc 未挂载），退而检查 status 文件是否存在
+func isMounted() (*mountInfo, bool) {
+	mi, err := findMount(mount)
+	if err != nil {
+		_, err := fsys.Stat(filepath.Join(mount, "status"))
+		return nil, err == nil
+	}
+	return mi, mi != nil
+}
+
+// ensureMount 根据 -mount-mode 确保 binfmt_misc 已挂载
+//
+// 参数:
+//
+//	statusOnly: 是否只查询状态，不修改任何条目
+//
+// 返回值:
+//
+//	func(): 退出时调用的清理函数，auto 模式下临时挂载时会卸载 binfmt_misc
+//	error: 如果未挂载且无法挂载返回错误
+//
+// 挂载模式:
+//   - auto: 复用已有的挂载；未挂载时临时挂载，退出时卸载
+//   - require-existing: 只使用已有的挂载，未挂载时返回错误
+//   - persistent: 复用已有的挂载；未挂载时挂载，退出时保留挂载
+//
+// 注意:
+//   - auto 模式下只查询状态时不会挂载，状态中报告未挂载（statusUnmounted）
+func ensureMount(statusOnly bool) (func(), error) {
+	noop := func() {}
+
+	switch mountMode {
+	case mountModeAuto, mountModeRequireExisting, mountModePersistent:
+	default:
+		return nil, errors.Errorf("invalid mount mode %q", mountMode)
+	}
+
+	if mi, ok := isMounted(); ok {
+		if mi != nil && mi.readOnly {
+			slog.Warn("binfmt_misc is mounted read-only", "mount", mount)
+		}
+		return noop, nil
+	}
+
+	if mountMode == mountModeRequireExisting {
+		return nil, errors.Errorf("binfmt_misc is not mounted at %s", mount)
+	}
+	if mountMode == mountModeAuto && statusOnly {
+		statusUnmounted = true
+		return noop, nil
+	}
+	if err := mountBinfmt(); err != nil {
+		return nil, err
+	}
+	if mountMode == mountModePersistent {
+		return noop, nil
+	}
+	return func() {
+		fsys.Unmount(mount, 0)
+	}, nil
+}
+
+// mountBinfmt 在挂载点上挂载 binfmt_misc，失败时给出具体的原因
+//
+// 返回值:
+//
+//	error: 如果挂载失败返回错误
+//
+// 错误诊断:
+//   - ENODEV: 内核不支持 binfmt_misc 文件系统（模块未加载）
+//   - ENOENT/ENOTDIR: 挂载点不存在
+//   - EPERM/EACCES: 没有挂载权限（容器需要 --privileged）
+//   - EBUSY: 挂载点正忙
+func mountBinfmt() error {
+	// fsys.Mount 参数（与 syscall.Mount 相同）:
+	//   - "binfmt_misc": 源设备名称
+	//   - mount: 目标挂载点
+	//   - "binfmt_misc": 文件系统类型
+	//   - 0: 挂载标志
+	//   - "": 挂载选项
+	err := fsys.Mount("binfmt_misc", mount, "binfmt_misc", 0, "")
+	if err == nil {
+		mountedNamespaced = !inInitialUserNS()
+		return nil
+	}
+	switch {
+	case errors.Is(err, syscall.ENODEV):
+		return errors.Wrapf(err, "cannot mount binfmt_misc filesystem at %s: filesystem type not available, is the binfmt_misc kernel module loaded?", mount)
+	case errors.Is(err, syscall.ENOENT), errors.Is(err, syscall.ENOTDIR):
+		return errors.Wrapf(err, "cannot mount binfmt_misc filesystem at %s: mount point does not exist", mount)
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		return errors.Wrapf(err, "cannot mount binfmt_misc filesystem at %s: insufficient privileges, run as root or in a --privileged container", mount)
+	case errors.Is(err, syscall.EBUSY):
+		return errors.Wrapf(err, "cannot mount binfmt_misc filesystem at %s: mount point is busy", mount)
+	}
+	return errors.Wrapf(err, "cannot mount binfmt_misc filesystem at %s", mount)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// TestParseMountInfoLine 测试 mountinfo 行的解析，包括只读挂载和可选字段
+func TestParseMountInfoLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want *mountInfo
+	}{
+		{
+			line: "36 25 0:30 / /proc/sys/fs/binfmt_misc rw,relatime shared:13 - binfmt_misc binfmt_misc rw",
+			want: &mountInfo{mountPoint: "/proc/sys/fs/binfmt_misc", fsType: "binfmt_misc", source: "binfmt_misc", dev: "0:30"},
+		},
+		{
+			line: "36 25 0:30 / /proc/sys/fs/binfmt_misc ro,relatime - binfmt_misc binfmt_misc ro",
+			want: &mountInfo{mountPoint: "/proc/sys/fs/binfmt_misc", fsType: "binfmt_misc", source: "binfmt_misc", readOnly: true, dev: "0:30"},
+		},
+		{
+			line: `40 25 0:31 / /mnt/with\040space rw master:1 shared:2 - binfmt_misc binfmt_misc rw`,
+			want: &mountInfo{mountPoint: "/mnt/with space", fsType: "binfmt_misc", source: "binfmt_misc", dev: "0:31"},
+		},
+		{
+			line: "30 25 0:40 / /proc/sys/fs/binfmt_misc rw,relatime shared:14 - autofs systemd-1 rw,fd=32,pgrp=1,timeout=0,minproto=5,maxproto=5,direct",
+			want: &mountInfo{mountPoint: "/proc/sys/fs/binfmt_misc", fsType: "autofs", source: "systemd-1", dev: "0:40"},
+		},
+		{line: "36 25 0:30 / /proc rw"},
+		{line: "36 25 0:30 / /proc rw shared:1 master:2 proc proc rw"},
+	}
+	for _, tc := range tests {
+		got, ok := parseMountInfoLine(tc.line)
+		if tc.want == nil {
+			if ok {
+				t.Errorf("%q: expected parse failure, got %+v", tc.line, got)
+			}
+			continue
+		}
+		if !ok || *got != *tc.want {
+			t.Errorf("%q: expected %+v, got %+v", tc.line, tc.want, got)
+		}
+	}
+}
+
+// TestEnsureMount 测试每种挂载模式下是否挂载、复用或卸载 binfmt_misc
+func TestEnsureMount(t *testing.T) {
+	defer func(old string) { mountMode = old }(mountMode)
+
+	defer func(old bool) { statusUnmounted = old }(statusUnmounted)
+
+	tests := []struct {
+		mode       string
+		mounted    bool
+		statusOnly bool
+		mounts     int
+		unmounts   int
+		unmounted  bool
+		expectErr  string
+	}{
+		{mode: mountModeAuto, mounted: true},
+		{mode: mountModeAuto, mounts: 1, unmounts: 1},
+		{mode: mountModeAuto, mounted: true, statusOnly: true},
+		{mode: mountModeAuto, statusOnly: true, unmounted: true},
+		{mode: mountModeRequireExisting, mounted: true},
+		{mode: mountModeRequireExisting, expectErr: "is not mounted"},
+		{mode: mountModeRequireExisting, statusOnly: true, expectErr: "is not mounted"},
+		{mode: mountModePersistent, mounted: true},
+		{mode: mountModePersistent, mounts: 1},
+		{mode: mountModePersistent, statusOnly: true, mounts: 1},
+		{mode: "bogus", mounted: true, expectErr: "invalid mount mode"},
+	}
+	for _, tc := range tests {
+		f := newFakeFS(t, tc.mounted)
+		mountMode = tc.mode
+		statusUnmounted = false
+
+		unmount, err := ensureMount(tc.statusOnly)
+		if tc.expectErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+				t.Errorf("%s mounted=%v: expected error %q, got %v", tc.mode, tc.mounted, tc.expectErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s mounted=%v: %v", tc.mode, tc.mounted, err)
+			continue
+		}
+		unmount()
+		if f.mounts != tc.mounts || f.unmounts != tc.unmounts {
+			t.Errorf("%s mounted=%v: expected %d mounts and %d unmounts, got %d and %d", tc.mode, tc.mounted, tc.mounts, tc.unmounts, f.mounts, f.unmounts)
+		}
+		if statusUnmounted != tc.unmounted {
+			t.Errorf("%s mounted=%v status=%v: expected unmounted=%v", tc.mode, tc.mounted, tc.statusOnly, tc.unmounted)
+		}
+	}
+}
+
+// TestStatusUnmounted 测试只查询状态且未挂载时报告未挂载，而不是挂载 binfmt_misc
+func TestStatusUnmounted(t *testing.T) {
+	defer func(old string) { mountMode = old }(mountMode)
+	defer func(old bool) { statusUnmounted = old }(statusUnmounted)
+	mountMode = mountModeAuto
+
+	f := newFakeFS(t, false)
+	unmount, err := ensureMount(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmount()
+
+	st, err := getStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Instance.Unmounted || len(st.Emulators) != 0 {
+		t.Fatalf("expected unmounted instance without emulators, got %+v", st)
+	}
+	if f.mounts != 0 {
+		t.Fatalf("expected status not to mount binfmt_misc, got %d mounts", f.mounts)
+	}
+}
+
+// TestEnsureMountFallback 测试无法读取 mountinfo 时通过 status 文件判断是否已挂载
+func TestEnsureMountFallback(t *testing.T) {
+	defer func(old string) { mountMode = old }(mountMode)
+	mountMode = mountModeAuto
+
+	// 无法读取 mountinfo 时通过 status 文件判断
+	f := newFakeFS(t, true)
+	f.mountInfoErr = syscall.ENOENT
+	unmount, err := ensureMount(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmount()
+	if f.mounts != 0 || f.unmounts != 0 {
+		t.Fatalf("expected existing mount to be reused, got %d mounts and %d unmounts", f.mounts, f.unmounts)
+	}
+}
+
+// TestEnsureMountAutofs 测试 systemd 的 autofs 自动挂载点被触发后复用，不会在其上再挂载
+func TestEnsureMountAutofs(t *testing.T) {
+	defer func(old string) { mountMode = old }(mountMode)
+
+	for _, mode := range []string{mountModeAuto, mountModeRequireExisting} {
+		f := newFakeFS(t, false)
+		f.automount = true
+		mountMode = mode
+
+		unmount, err := ensureMount(false)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		unmount()
+		if !f.mounted || f.mounts != 0 || f.unmounts != 0 {
+			t.Fatalf("%s: expected automount to be reused, got mounted=%v %d mounts and %d unmounts", mode, f.mounted, f.mounts, f.unmounts)
+		}
+	}
+}
+
+// TestMountDiagnosis 测试挂载失败时根据错误码给出的诊断
+func TestMountDiagnosis(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{syscall.ENODEV, "kernel module loaded"},
+		{syscall.ENOENT, "mount point does not exist"},
+		{syscall.EPERM, "insufficient privileges"},
+		{syscall.EACCES, "insufficient privileges"},
+		{syscall.EBUSY, "busy"},
+		{syscall.EIO, "cannot mount binfmt_misc filesystem"},
+	}
+	for _, tc := range tests {
+		f := newFakeFS(t, false)
+		f.mountErr = tc.err
+		err := mountBinfmt()
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: expected error containing %q, got %v", tc.err, tc.want, err)
+		}
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%v: expected error to wrap errno, got %v", tc.err, err)
+		}
+	}
+}
+
+// TestRegisterReadOnly 测试只读挂载时报告实例状态并拒绝注册
+func TestRegisterReadOnly(t *testing.T) {
+	f := newFakeFS(t, true)
+	fakeInterpreters(t, "arm64")
+	f.readOnly = true
+
+	if inst := detectInstance(); !inst.ReadOnly {
+		t.Fatalf("expected read-only instance, got %+v", inst)
+	}
+	if err := install("arm64"); err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	_ "crypto/sha256" // go-digest 使用的 sha256 实现
+	_ "crypto/sha512" // go-digest 使用的 sha512 实现
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/platforms"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Docker 镜像使用的媒体类型，与 OCI 媒体类型一样支持
+const (
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar"
+	mediaTypeDockerLayerGzip    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// ociLayout 结构体：本地的 OCI 镜像布局目录
+//
+// 目录结构:
+//
+//	oci-layout              布局版本
+//	index.json              入口索引
+//	blobs/<alg>/<encoded>   按摘要存储的内容
+//
+// 读取的每个 blob 都会校验大小和摘要，不一致时返回错误。
+type ociLayout struct {
+	root string
+}
+
+// openOCILayout 打开本地的 OCI 镜像布局目录
+//
+// 参数:
+//
+//	root: 布局目录
+//
+// 返回值:
+//
+//	*ociLayout: 布局
+//	error: 如果目录不是 OCI 镜像布局返回错误
+func openOCILayout(root string) (*ociLayout, error) {
+	dt, err := os.ReadFile(filepath.Join(root, ocispecs.ImageLayoutFile))
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s is not an OCI image layout", root)
+	}
+	var l ocispecs.ImageLayout
+	if err := json.Unmarshal(dt, &l); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", ocispecs.ImageLayoutFile)
+	}
+	if l.Version != ocispecs.ImageLayoutVersion {
+		return nil, errors.Errorf("unsupported OCI image layout version %q", l.Version)
+	}
+	return &ociLayout{root: root}, nil
+}
+
+// open 打开 blob，读取完成后由调用者调用 verify 校验
+func (l *ociLayout) open(desc ocispecs.Descriptor) (*verifiedReader, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid digest %q", desc.Digest)
+	}
+	f, err := os.Open(filepath.Join(l.root, ocispecs.ImageBlobsDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open blob %s", desc.Digest)
+	}
+	v := desc.Digest.Verifier()
+	return &verifiedReader{
+		f:        f,
+		r:        io.TeeReader(io.LimitReader(f, desc.Size+1), v),
+		verifier: v,
+		desc:     desc,
+	}, nil
+}
+
+// readJSON 读取并校验 blob，解析为 JSON
+func (l *ociLayout) readJSON(desc ocispecs.Descriptor, v interface{}) error {
+	r, err := l.open(desc)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	dt, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := r.verify(); err != nil {
+		return err
+	}
+	return errors.Wrapf(json.Unmarshal(dt, v), "invalid blob %s", desc.Digest)
+}
+
+// verifiedReader 结构体：读取 blob 的同时计算摘要
+type verifiedReader struct {
+	f        *os.File
+	r        io.Reader
+	n        int64
+	verifier digest.Verifier
+	desc     ocispecs.Descriptor
+}
+
+func (r *verifiedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *verifiedReader) Close() error {
+	return r.f.Close()
+}
+
+// verify 读取剩余的内容，并校验 blob 的大小和摘要
+func (r *verifiedReader) verify() error {
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	if r.n != r.desc.Size {
+		return errors.Errorf("blob %s: expected size %d, got %d", r.desc.Digest, r.desc.Size, r.n)
+	}
+	if !r.verifier.Verified() {
+		return errors.Errorf("blob %s: digest mismatch", r.desc.Digest)
+	}
+	return nil
+}
+
+// platformManifest 结构体：镜像布局中一个平台的镜像清单
+type platformManifest struct {
+	platform ocispecs.Platform
+	manifest ocispecs.Manifest
+}
+
+// platformManifests 列出布局中每个平台的镜像清单
+//
+// 返回值:
+//
+//	[]platformManifest: 按索引中的顺序排列的平台和镜像清单
+//	error: 如果读取或校验失败返回错误
+//
+// 注意:
+//   - 平台为 unknown/unknown 的清单（如构建证明）会被跳过
+//   - 没有平台信息的清单从镜像配置中读取平台
+func (l *ociLayout) platformManifests() ([]platformManifest, error) {
+	dt, err := os.ReadFile(filepath.Join(l.root, ocispecs.ImageIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	var idx ocispecs.Index
+	if err := json.Unmarshal(dt, &idx); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", ocispecs.ImageIndexFile)
+	}
+	var out []platformManifest
+	return out, l.walkManifests(idx, 0, &out)
+}
+
+// walkManifests 遍历索引中的清单，depth 用于防止循环引用
+func (l *ociLayout) walkManifests(idx ocispecs.Index, depth int, out *[]platformManifest) error {
+	if depth > 4 {
+		return errors.New("image index nested too deeply")
+	}
+	for _, desc := range idx.Manifests {
+		if desc.Platform != nil && desc.Platform.OS == "unknown" {
+			continue
+		}
+		switch desc.MediaType {
+		case ocispecs.MediaTypeImageIndex, mediaTypeDockerManifestList:
+			var sub ocispecs.Index
+			if err := l.readJSON(desc, &sub); err != nil {
+				return err
+			}
+			if err := l.walkManifests(sub, depth+1, out); err != nil {
+				return err
+			}
+		case ocispecs.MediaTypeImageManifest, mediaTypeDockerManifest:
+			var mfst ocispecs.Manifest
+			if err := l.readJSON(desc, &mfst); err != nil {
+				return err
+			}
+			var p ocispecs.Platform
+			if desc.Platform != nil {
+				p = *desc.Platform
+			} else {
+				var img ocispecs.Image
+				if err := l.readJSON(mfst.Config, &img); err != nil {
+					return err
+				}
+				p = img.Platform
+			}
+			*out = append(*out, platformManifest{platform: platforms.Normalize(p), manifest: mfst})
+		}
+	}
+	return nil
+}
+
+// resolveManifest 选择与平台匹配的镜像清单
+//
+// 参数:
+//
+//	p: 要匹配的平台
+//
+// 返回值:
+//
+//	ocispecs.Manifest: 选中的镜像清单
+//	error: 如果没有匹配的清单返回错误
+//
+// 注意:
+//   - 与 smoke-test 一样通过 platformManifests 遍历索引，支持嵌套的索引
+//   - 多个清单匹配时选择最接近平台的一个（如 linux/arm/v7 优先于 linux/arm/v6）
+func (l *ociLayout) resolveManifest(p ocispecs.Platform) (ocispecs.Manifest, error) {
+	pms, err := l.platformManifests()
+	if err != nil {
+		return ocispecs.Manifest{}, err
+	}
+	m := platforms.Only(p)
+	var best *platformManifest
+	for i := range pms {
+		if !m.Match(pms[i].platform) {
+			continue
+		}
+		if best == nil || m.Less(pms[i].platform, best.platform) {
+			best = &pms[i]
+		}
+	}
+	if best == nil {
+		return ocispecs.Manifest{}, errors.New("no manifest for the host platform")
+	}
+	return best.manifest, nil
+}
+
+// ociBinaryDir 是 binfmt 镜像中存放模拟器的目录
+const ociBinaryDir = "usr/bin"
+
+// isEmulatorFile 判断镜像中的文件是否为 QEMU 模拟器
+//
+// 只有 ociBinaryDir 中名称为某个架构的二进制文件名称的文件才是模拟器，
+// 如 "usr/bin/qemu-aarch64"，或带 QEMU_BINARY_PREFIX 前缀的 "usr/bin/buildkit-qemu-aarch64"。
+// 其他目录中的文件（如手册页和 etc/qemu-ifup）不会被当作模拟器
+func isEmulatorFile(name string) bool {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if path.Dir(name) != ociBinaryDir {
+		return false
+	}
+	base := path.Base(name)
+	prefix := os.Getenv("QEMU_BINARY_PREFIX")
+	for _, cfg := range configs {
+		if base == cfg.binary || (prefix != "" && base == prefix+cfg.binary) {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmulatorEntry 判断解压模拟器时是否需要层中的条目
+// 除了模拟器本身，还需要 usr 和 usr/bin 目录（可能是符号链接）以及所有删除标记
+func isEmulatorEntry(name string) bool {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "usr" || name == ociBinaryDir || strings.HasPrefix(path.Base(name), ".wh.") {
+		return true
+	}
+	return isEmulatorFile(name)
+}
+
+// extractEmulators 从 OCI 镜像布局中解压与主机平台匹配的 QEMU 模拟器
+//
+// 参数:
+//
+//	root: OCI 镜像布局目录
+//	target: 解压模拟器的目录
+//
+// 返回值:
+//
+//	[]string: 解压出的模拟器名称
+//	error: 如果读取、校验或解压失败返回错误
+//
+// 工作原理:
+// 1. 从 index.json 开始选择与主机平台匹配的镜像清单
+// 2. 与 smoke-test 一样通过 unpackRootfs 把每一层应用到暂存的根文件系统中，只保留 isEmulatorEntry 需要的条目
+// 3. 每一层读取完成后校验大小和摘要，任何一层校验失败时不使用任何内容
+// 4. 在暂存的根文件系统中解析 usr/bin 中的模拟器，复制到目标目录中
+//
+// 注意:
+//   - 删除标记、不透明目录和符号链接都在暂存目录中处理，不会写到暂存目录之外
+//   - 只支持未压缩和 gzip 压缩的层
+//   - 指向其他模拟器的符号链接会被解析为文件的副本
+func extractEmulators(root, target string) ([]string, error) {
+	l, err := openOCILayout(root)
+	if err != nil {
+		return nil, err
+	}
+	mfst, err := l.resolveManifest(platforms.DefaultSpec())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return nil, err
+	}
+	staging, err := os.MkdirTemp(target, ".oci-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	if err := l.unpackRootfs(mfst, staging, isEmulatorEntry); err != nil {
+		return nil, err
+	}
+
+	dir, err := resolveInRoot(staging, "/"+ociBinaryDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var entries []os.DirEntry
+	if err == nil {
+		if entries, err = os.ReadDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	for _, e := range entries {
+		name := path.Join(ociBinaryDir, e.Name())
+		if !isEmulatorFile(name) {
+			continue
+		}
+		// 指向不存在的文件的符号链接被忽略
+		src, err := resolveInRoot(staging, "/"+name)
+		if err != nil {
+			continue
+		}
+		if fi, err := os.Stat(src); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if err := copyFile(src, filepath.Join(target, e.Name())); err != nil {
+			return nil, err
+		}
+		names = append(names, e.Name())
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no emulators found in image")
+	}
+	return names, nil
+}
+
+// unpackRootfs 按顺序解压镜像的所有层到目录中
+//
+// 参数:
+//
+//	mfst: 镜像清单
+//	dir: 根文件系统目录
+//	filter: 判断是否解压层中的条目，为 nil 时解压所有条目
+//
+// 返回值:
+//
+//	error: 如果读取、校验或解压失败返回错误
+//
+// 注意:
+//   - 处理 .wh.<name> 和 .wh..wh..opq 删除标记
+//   - 路径和链接都在 dir 中解析，不会写到 dir 之外
+//   - 设备文件和文件所有者不会被还原
+func (l *ociLayout) unpackRootfs(mfst ocispecs.Manifest, dir string, filter func(name string) bool) error {
+	for i, layer := range mfst.Layers {
+		if err := l.unpackLayer(layer, dir, filter); err != nil {
+			return errors.Wrapf(err, "layer %d", i)
+		}
+	}
+	return nil
+}
+
+// unpackLayer 解压一层到根文件系统中，读取完成后校验大小和摘要
+func (l *ociLayout) unpackLayer(desc ocispecs.Descriptor, root string, filter func(name string) bool) error {
+	var compressed bool
+	switch desc.MediaType {
+	case ocispecs.MediaTypeImageLayer, mediaTypeDockerLayer:
+	case ocispecs.MediaTypeImageLayerGzip, mediaTypeDockerLayerGzip:
+		compressed = true
+	default:
+		return errors.Errorf("unsupported layer media type %s", desc.MediaType)
+	}
+
+	r, err := l.open(desc)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var tr *tar.Reader
+	if compressed {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return errors.Wrapf(err, "blob %s", desc.Digest)
+		}
+		defer zr.Close()
+		tr = tar.NewReader(zr)
+	} else {
+		tr = tar.NewReader(r)
+	}
+
+	added := map[string]struct{}{} // 本层中出现的路径，不受本层的 .wh..wh..opq 影响
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "blob %s", desc.Digest)
+		}
+		if filter != nil && !filter(hdr.Name) {
+			continue
+		}
+		if err := unpackEntry(root, hdr, tr, added); err != nil {
+			return errors.Wrapf(err, "%s", hdr.Name)
+		}
+	}
+	return r.verify()
+}
+
+// unpackEntry 解压一个 tar 条目
+func unpackEntry(root string, hdr *tar.Header, r io.Reader, added map[string]struct{}) error {
+	name := path.Clean("/" + hdr.Name)
+	if name == "/" {
+		return nil
+	}
+	dir, base := path.Split(name)
+	parent, err := mkdirAllInRoot(root, dir)
+	if err != nil {
+		return err
+	}
+
+	if base == ".wh..wh..opq" {
+		entries, err := os.ReadDir(parent)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if _, ok := added[path.Join(dir, e.Name())]; !ok {
+				if err := os.RemoveAll(filepath.Join(parent, e.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if strings.HasPrefix(base, ".wh.") {
+		return os.RemoveAll(filepath.Join(parent, strings.TrimPrefix(base, ".wh.")))
+	}
+
+	p := filepath.Join(parent, base)
+	mode := os.FileMode(hdr.Mode).Perm()
+	if fi, err := os.Lstat(p); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(p, mode); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, p); err != nil {
+			return err
+		}
+		added[name] = struct{}{}
+		return nil
+	case tar.TypeLink:
+		target, err := resolveInRoot(root, path.Clean("/"+hdr.Linkname))
+		if err != nil {
+			return err
+		}
+		if err := os.Link(target, p); err != nil {
+			return err
+		}
+	default:
+		// 设备文件和 FIFO 不需要还原，chroot 时绑定挂载宿主机的 /dev
+		return nil
+	}
+	added[name] = struct{}{}
+	// 不受 umask 影响，并保留 setuid 等位
+	return os.Chmod(p, os.FileMode(hdr.Mode)&os.ModePerm|tarSpecialBits(hdr.Mode))
+}
+
+// tarSpecialBits 将 tar 中的 setuid、setgid 和 sticky 位转换为 os.FileMode
+func tarSpecialBits(mode int64) os.FileMode {
+	var m os.FileMode
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// mkdirAllInRoot 在根文件系统中创建目录及其父目录，返回目录的实际路径
+// 已经存在的符号链接在根文件系统中解析
+func mkdirAllInRoot(root, dir string) (string, error) {
+	current, logical := root, "/"
+	for _, part := range strings.Split(dir, "/") {
+		if part == "" {
+			continue
+		}
+		logical = path.Join(logical, part)
+		p, err := resolveInRoot(root, logical)
+		if os.IsNotExist(err) {
+			p = filepath.Join(current, part)
+			// 指向不存在的目录的符号链接，创建链接的目标
+			if target, err := os.Readlink(p); err == nil {
+				if !path.IsAbs(target) {
+					target = path.Join(path.Dir(logical), target)
+				}
+				p, err = mkdirAllInRoot(root, target)
+				if err != nil {
+					return "", err
+				}
+			} else if err := os.Mkdir(p, 0755); err != nil {
+				return "", err
+			}
+		} else if err != nil {
+			return "", err
+		}
+		if fi, err := os.Stat(p); err != nil || !fi.IsDir() {
+			return "", errors.Errorf("%s is not a directory", logical)
+		}
+		current = p
+	}
+	return current, nil
+}
+
+// copyFile 将暂存的模拟器复制到目标路径，先写入临时文件再重命名
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeFileAtomicFrom(dst, in, 0755)
+}
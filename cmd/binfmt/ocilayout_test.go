@@ -0,0 +1,354 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/containerd/platforms"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testLayout 结构体：在临时目录中构造 OCI 镜像布局
+type testLayout struct {
+	t    *testing.T
+	root string
+}
+
+// newTestLayout 创建空的 OCI 镜像布局
+func newTestLayout(t *testing.T) *testLayout {
+	t.Helper()
+	root := t.TempDir()
+	l := &testLayout{t: t, root: root}
+	l.writeJSON(filepath.Join(root, ocispecs.ImageLayoutFile), ocispecs.ImageLayout{Version: ocispecs.ImageLayoutVersion})
+	return l
+}
+
+// writeJSON 将值序列化为 JSON 写入文件
+func (l *testLayout) writeJSON(p string, v interface{}) {
+	dt, err := json.Marshal(v)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	if err := os.WriteFile(p, dt, 0644); err != nil {
+		l.t.Fatal(err)
+	}
+}
+
+// blob 写入 blob 并返回其描述符
+func (l *testLayout) blob(mediaType string, dt []byte) ocispecs.Descriptor {
+	dgst := digest.FromBytes(dt)
+	dir := filepath.Join(l.root, ocispecs.ImageBlobsDir, dgst.Algorithm().String())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		l.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, dgst.Encoded()), dt, 0644); err != nil {
+		l.t.Fatal(err)
+	}
+	return ocispecs.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(dt))}
+}
+
+// layer 写入 gzip 压缩的层，files 的值以 "->" 开头时创建指向该名称的符号链接
+func (l *testLayout) layer(files map[string]string) ocispecs.Descriptor {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		content := files[name]
+		hdr := &tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeReg, Size: int64(len(content))}
+		if strings.HasPrefix(content, "->") {
+			hdr = &tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: strings.TrimPrefix(content, "->")}
+			content = ""
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			l.t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			l.t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		l.t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		l.t.Fatal(err)
+	}
+	return l.blob(ocispecs.MediaTypeImageLayerGzip, buf.Bytes())
+}
+
+// manifest 写入包含指定层的镜像清单
+func (l *testLayout) manifest(p ocispecs.Platform, layers ...ocispecs.Descriptor) ocispecs.Descriptor {
+	mfst := ocispecs.Manifest{
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Config:    l.blob(ocispecs.MediaTypeImageConfig, []byte("{}")),
+		Layers:    layers,
+	}
+	mfst.SchemaVersion = 2
+	dt, err := json.Marshal(mfst)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	desc := l.blob(ocispecs.MediaTypeImageManifest, dt)
+	desc.Platform = &p
+	return desc
+}
+
+// index 写入 index.json
+func (l *testLayout) index(manifests ...ocispecs.Descriptor) {
+	idx := ocispecs.Index{MediaType: ocispecs.MediaTypeImageIndex, Manifests: manifests}
+	idx.SchemaVersion = 2
+	l.writeJSON(filepath.Join(l.root, ocispecs.ImageIndexFile), idx)
+}
+
+// TestExtractEmulators 测试只解压与主机平台匹配的镜像中 usr/bin 下的模拟器，并应用删除标记和符号链接
+func TestExtractEmulators(t *testing.T) {
+	t.Setenv("QEMU_BINARY_PREFIX", "buildkit-")
+	l := newTestLayout(t)
+	host := platforms.DefaultSpec()
+	other := ocispecs.Platform{OS: "linux", Architecture: "s390x"}
+	if host.Architecture == other.Architecture {
+		other.Architecture = "ppc64le"
+	}
+
+	l.index(
+		l.manifest(other, l.layer(map[string]string{"usr/bin/qemu-aarch64": "other"})),
+		l.manifest(host,
+			l.layer(map[string]string{
+				"usr/bin/qemu-aarch64": "old",
+				"usr/bin/qemu-arm":     "arm",
+				"usr/bin/qemu-mips":    "mips",
+				"etc/passwd":           "root",
+				// 不是模拟器的文件不会被解压，也不会覆盖同名的模拟器
+				"etc/qemu-ifup":                       "ifup",
+				"usr/share/man/man1/qemu-aarch64":     "man",
+				"usr/local/bin/qemu-arm":              "local",
+				"usr/bin/qemu-img":                    "img",
+				"usr/share/doc/qemu-arm/qemu-aarch64": "doc",
+				"usr/bin/other-qemu-aarch64":          "other",
+			}),
+			l.layer(map[string]string{
+				"usr/bin/qemu-aarch64":          "new",
+				"usr/bin/.wh.qemu-mips":         "",
+				"usr/bin/buildkit-qemu-aarch64": "->qemu-aarch64",
+			}),
+		),
+	)
+
+	target := filepath.Join(t.TempDir(), "bin")
+	names, err := extractEmulators(l.root, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, ","); got != "buildkit-qemu-aarch64,qemu-aarch64,qemu-arm" {
+		t.Fatalf("unexpected emulators %s", got)
+	}
+	for name, want := range map[string]string{"qemu-aarch64": "new", "buildkit-qemu-aarch64": "new", "qemu-arm": "arm"} {
+		dt, err := os.ReadFile(filepath.Join(target, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dt) != want {
+			t.Errorf("%s: expected %q, got %q", name, want, dt)
+		}
+	}
+}
+
+// TestExtractEmulatorsVerifiesDigest 测试摘要不一致的层不会被使用
+func TestExtractEmulatorsVerifiesDigest(t *testing.T) {
+	l := newTestLayout(t)
+	layer := l.layer(map[string]string{"usr/bin/qemu-aarch64": "good"})
+	l.index(l.manifest(platforms.DefaultSpec(), layer))
+
+	// 替换层的内容但保持大小不变
+	p := filepath.Join(l.root, ocispecs.ImageBlobsDir, layer.Digest.Algorithm().String(), layer.Digest.Encoded())
+	evil := l.layer(map[string]string{"usr/bin/qemu-aarch64": "evil"})
+	dt, err := os.ReadFile(filepath.Join(l.root, ocispecs.ImageBlobsDir, evil.Digest.Algorithm().String(), evil.Digest.Encoded()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(dt)) != layer.Size {
+		t.Skip("layers have different sizes")
+	}
+	if err := os.WriteFile(p, dt, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	target := t.TempDir()
+	if _, err := extractEmulators(l.root, target); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "qemu-aarch64")); !os.IsNotExist(err) {
+		t.Fatalf("unverified emulator extracted: %v", err)
+	}
+}
+
+// TestExtractEmulatorsNoPlatform 测试没有与主机平台匹配的清单时返回错误
+func TestExtractEmulatorsNoPlatform(t *testing.T) {
+	l := newTestLayout(t)
+	l.index(l.manifest(ocispecs.Platform{OS: "windows", Architecture: "amd64"}, l.layer(map[string]string{"usr/bin/qemu-aarch64": "x"})))
+	if _, err := extractEmulators(l.root, t.TempDir()); err == nil || !strings.Contains(err.Error(), "no manifest") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+// TestExtractEmulatorsSafeApply 测试解压模拟器时处理不透明目录，且符号链接不会读取暂存目录之外的文件
+func TestExtractEmulatorsSafeApply(t *testing.T) {
+	l := newTestLayout(t)
+	outside := filepath.Join(t.TempDir(), "qemu-ppc64le")
+	if err := os.WriteFile(outside, []byte("host"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	l.index(l.manifest(platforms.DefaultSpec(),
+		l.layer(map[string]string{
+			"usr/bin/qemu-aarch64": "aarch64",
+			"usr/bin/qemu-arm":     "arm",
+		}),
+		l.layer(map[string]string{
+			"usr/bin/.wh..wh..opq":  "",
+			"usr/bin/qemu-riscv64":  "riscv64",
+			"usr/bin/qemu-ppc64le":  "->" + outside,
+			"usr/bin/qemu-s390x":    "->../../../../../../../../" + outside,
+			"usr/bin/qemu-mips64el": "->qemu-missing",
+		}),
+	))
+
+	target := filepath.Join(t.TempDir(), "bin")
+	names, err := extractEmulators(l.root, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(names, ","); got != "qemu-riscv64" {
+		t.Fatalf("unexpected emulators %s", got)
+	}
+}
+
+// TestPlatformManifests 测试遍历嵌套的索引，跳过 unknown/unknown 的清单，并从镜像配置中读取缺少的平台
+func TestPlatformManifests(t *testing.T) {
+	l := newTestLayout(t)
+	layer := l.layer(map[string]string{"bin/sh": "sh"})
+
+	// 没有平台信息的清单从镜像配置中读取平台
+	cfg, err := json.Marshal(ocispecs.Image{Platform: ocispecs.Platform{OS: "linux", Architecture: "riscv64"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfst := ocispecs.Manifest{
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Config:    l.blob(ocispecs.MediaTypeImageConfig, cfg),
+		Layers:    []ocispecs.Descriptor{layer},
+	}
+	mfst.SchemaVersion = 2
+	dt, err := json.Marshal(mfst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	riscv := l.blob(ocispecs.MediaTypeImageManifest, dt)
+
+	nested := ocispecs.Index{MediaType: ocispecs.MediaTypeImageIndex, Manifests: []ocispecs.Descriptor{
+		l.manifest(ocispecs.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, layer),
+		l.manifest(ocispecs.Platform{OS: "unknown", Architecture: "unknown"}, layer),
+	}}
+	nested.SchemaVersion = 2
+	dt, err = json.Marshal(nested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.index(
+		l.manifest(ocispecs.Platform{OS: "linux", Architecture: "arm64"}, layer),
+		l.blob(ocispecs.MediaTypeImageIndex, dt),
+		riscv,
+	)
+
+	lo, err := openOCILayout(l.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pms, err := lo.platformManifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, pm := range pms {
+		got = append(got, platforms.Format(pm.platform))
+		if len(pm.manifest.Layers) != 1 {
+			t.Errorf("%s: unexpected layers %v", platforms.Format(pm.platform), pm.manifest.Layers)
+		}
+	}
+	if expected := []string{"linux/arm64", "linux/arm/v6", "linux/riscv64"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected platforms %v", got)
+	}
+}
+
+// TestUnpackRootfs 测试删除标记、不透明目录以及符号链接不会跳出根文件系统
+func TestUnpackRootfs(t *testing.T) {
+	l := newTestLayout(t)
+	mfst := ocispecs.Manifest{Layers: []ocispecs.Descriptor{
+		l.layer(map[string]string{
+			"bin/sh":      "sh",
+			"etc/passwd":  "root",
+			"opt/a/x":     "x",
+			"opt/a/y":     "y",
+			"usr/lib/lib": "lib",
+		}),
+		l.layer(map[string]string{
+			"etc/.wh.passwd":     "",
+			"opt/a/.wh..wh..opq": "",
+			"opt/a/z":            "z",
+			"lib":                "->/usr/lib",
+			"escape":             "->../../../../tmp",
+			"escape/evil":        "evil",
+		}),
+	}}
+	lo, err := openOCILayout(l.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := lo.unpackRootfs(mfst, root, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for p, expected := range map[string]string{"bin/sh": "sh", "opt/a/z": "z", "lib/lib": "lib", "tmp/evil": "evil"} {
+		// 绝对路径的链接需要在根文件系统中解析
+		rp, err := resolveInRoot(root, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dt, err := os.ReadFile(rp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dt) != expected {
+			t.Errorf("%s: expected %q, got %q", p, expected, dt)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/passwd")); !os.IsNotExist(err) {
+		t.Errorf("whiteout not applied: %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "opt/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"z"}) {
+		t.Errorf("opaque whiteout not applied: %v", names)
+	}
+}
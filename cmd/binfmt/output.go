@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// 状态的输出格式
+const (
+	outputJSON     = "json"     // 缩进的 JSON，默认格式，与之前的输出一致
+	outputCompact  = "compact"  // 单行 JSON，便于逐行处理
+	outputYAML     = "yaml"     // YAML，字段顺序与 JSON 一致
+	outputTable    = "table"    // 每个平台一行的表格，便于人类阅读
+	outputPlatform = "platform" // 用 "," 分隔的平台列表，可以直接用于 buildx 的 --platform
+)
+
+// outputFormats 列出 -output 支持的所有格式
+var outputFormats = []string{outputJSON, outputCompact, outputYAML, outputTable, outputPlatform}
+
+// checkOutputFormat 检查 -output 指定的格式是否有效
+// 在执行安装等操作之前检查，避免操作完成后才发现无法输出状态
+func checkOutputFormat(format string) error {
+	for _, f := range outputFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return errors.Errorf("invalid output format %q, expected one of %s", format, strings.Join(outputFormats, ", "))
+}
+
+// writeStatus 按指定的格式输出状态
+//
+// 参数:
+//
+//	w: 输出目标（通常为标准输出）
+//	st: getStatus 收集的状态
+//	format: 输出格式（json、compact、yaml、table 或 platform）
+//
+// 返回值:
+//
+//	error: 如果格式无效或写入失败返回错误
+func writeStatus(w io.Writer, st *status, format string) error {
+	switch format {
+	case outputJSON:
+		dt, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", dt)
+		return err
+	case outputCompact:
+		return json.NewEncoder(w).Encode(st)
+	case outputYAML:
+		dt, err := statusYAML(st)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(dt)
+		return err
+	case outputTable:
+		return writeStatusTable(w, st)
+	case outputPlatform:
+		_, err := fmt.Fprintln(w, strings.Join(st.Supported, ","))
+		return err
+	}
+	return checkOutputFormat(format)
+}
+
+// writeStatusTable 输出每个支持的平台及其执行方式和模拟器
+//
+// 列:
+//   - PLATFORM: 平台（如 "linux/arm64"）
+//   - MODE: 执行方式（native 或 emulated）
+//   - HANDLER: 执行该平台的条目名称
+//   - INTERPRETER: 条目中注册的解释器路径
+//   - FLAGS: 条目的标志位
+//   - VERSION: 解释器报告的版本号，与 binfmt 附带的 QEMU 版本不一致时标记 mismatch
+//
+// 原生平台和无法获取的值显示为 "-"
+func writeStatusTable(w io.Writer, st *status) error {
+	versions := map[string]emulatorVersion{}
+	for _, v := range st.Versions {
+		versions[v.Name] = v
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PLATFORM\tMODE\tHANDLER\tINTERPRETER\tFLAGS\tVERSION")
+	for _, pm := range classifyPlatforms(st) {
+		handler, interpreter, flags, version := "-", "-", "-", "-"
+		if pm.emulator != "" {
+			handler = pm.emulator
+			if e, err := readEntry(pm.emulator); err == nil {
+				interpreter = e.interpreter
+				if e.flags != "" {
+					flags = e.flags
+				}
+			}
+			if v, ok := versions[pm.emulator]; ok && v.Version != "" {
+				version = v.Version
+				if v.Mismatch {
+					version += " (mismatch)"
+				}
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", pm.platform, pm.mode, handler, interpreter, flags, version)
+	}
+	return tw.Flush()
+}
+
+// statusYAML 将状态转换为 YAML
+//
+// 先序列化为 JSON，再按 JSON 的字段顺序转换为 YAML，
+// 使 YAML 与 JSON 的字段名称、顺序和省略规则保持一致，不需要额外的 YAML 库
+func statusYAML(st *status) ([]byte, error) {
+	dt, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(dt))
+	dec.UseNumber()
+	v, err := decodeOrdered(dec)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writeYAML(&buf, v, 0)
+	return buf.Bytes(), nil
+}
+
+// yamlField 结构体：保持顺序的 JSON 对象字段
+type yamlField struct {
+	key   string
+	value interface{}
+}
+
+// decodeOrdered 解码一个 JSON 值，对象解码为保持字段顺序的 []yamlField
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		fields := []yamlField{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, yamlField{key: key.(string), value: v})
+		}
+		_, err = dec.Token()
+		return fields, err
+	case json.Delim('['):
+		items := []interface{}{}
+		for dec.More() {
+			v, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		_, err = dec.Token()
+		return items, err
+	}
+	return tok, nil
+}
+
+// writeYAML 以块格式写入一个值，indent 为当前的缩进空格数
+// 空对象和空数组写为 {} 和 []，数组中的对象从 "- " 之后开始
+func writeYAML(buf *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch v := v.(type) {
+	case []yamlField:
+		for _, f := range v {
+			buf.WriteString(pad + yamlString(f.key) + ":")
+			writeYAMLChild(buf, f.value, indent+2)
+		}
+	case []interface{}:
+		for _, item := range v {
+			if isYAMLScalar(item) {
+				buf.WriteString(pad + "- " + yamlScalar(item) + "\n")
+				continue
+			}
+			// 先按更深一级缩进写入，再把第一行的缩进替换为 "- "
+			var sub bytes.Buffer
+			writeYAML(&sub, item, indent+2)
+			buf.WriteString(pad + "- ")
+			buf.Write(sub.Bytes()[indent+2:])
+		}
+	default:
+		buf.WriteString(pad + yamlScalar(v) + "\n")
+	}
+}
+
+// writeYAMLChild 写入对象字段的值，标量写在同一行，其他值从下一行开始
+func writeYAMLChild(buf *bytes.Buffer, v interface{}, indent int) {
+	if isYAMLScalar(v) {
+		buf.WriteString(" " + yamlScalar(v) + "\n")
+		return
+	}
+	buf.WriteString("\n")
+	writeYAML(buf, v, indent)
+}
+
+// isYAMLScalar 判断值是否写在一行，空对象和空数组也写在一行
+func isYAMLScalar(v interface{}) bool {
+	switch v := v.(type) {
+	case []yamlField:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return true
+}
+
+// yamlScalar 返回标量的 YAML 表示
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case json.Number:
+		return v.String()
+	case string:
+		return yamlString(v)
+	case []yamlField:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	}
+	return fmt.Sprint(v)
+}
+
+// yamlPlain 匹配可以不加引号的字符串，如 "linux/arm64"、"qemu-aarch64" 和 "/usr/bin/qemu-aarch64"
+var yamlPlain = regexp.MustCompile(`^[A-Za-z/_][A-Za-z0-9/_.+-]*$`)
+
+// yamlString 返回字符串的 YAML 表示
+// 可能被解析为布尔值、空值或数字的字符串以及包含特殊字符的字符串使用双引号，
+// JSON 的字符串转义与 YAML 双引号字符串兼容
+func yamlString(s string) string {
+	if yamlPlain.MatchString(s) {
+		switch strings.ToLower(s) {
+		case "true", "false", "yes", "no", "on", "off", "y", "n", "null":
+		default:
+			return s
+		}
+	}
+	dt, _ := json.Marshal(s)
+	return string(dt)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testStatus 返回用于测试输出格式的状态，arm64 由已注册的条目模拟执行
+func testStatus(t *testing.T) (*status, string) {
+	t.Helper()
+	newFakeFS(t, true)
+	dir := fakeInterpreters(t, "arm64")
+	if err := install("arm64"); err != nil {
+		t.Fatal(err)
+	}
+	return &status{
+		Supported: []string{"linux/amd64", "linux/arm64"},
+		Emulators: []string{"qemu-aarch64"},
+		Instance:  instance{Mount: mount},
+		Qemu:      "9.2.0",
+		Versions: []emulatorVersion{
+			{Name: "qemu-aarch64", Interpreter: filepath.Join(dir, "qemu-aarch64"), Version: "8.1.5", Mismatch: true},
+		},
+		Profiles: []handlerProfile{
+			{Name: "qemu-aarch64", Interpreter: "/usr/bin/qemu-aarch64", Env: map[string]string{"QEMU_CPU": "max"}},
+		},
+	}, dir
+}
+
+// TestWriteStatusJSON 测试默认的缩进 JSON 与单行 JSON 的内容相同，以及无效的格式
+func TestWriteStatusJSON(t *testing.T) {
+	st, _ := testStatus(t)
+	var indented, compact bytes.Buffer
+	if err := writeStatus(&indented, st, outputJSON); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStatus(&compact, st, outputCompact); err != nil {
+		t.Fatal(err)
+	}
+	// 默认格式保持缩进，两种格式的内容相同
+	if !strings.HasPrefix(indented.String(), "{\n  \"supported\": [") {
+		t.Errorf("unexpected default output %q", indented.String())
+	}
+	if strings.Count(compact.String(), "\n") != 1 {
+		t.Errorf("expected single line, got %q", compact.String())
+	}
+	var a, b map[string]interface{}
+	if err := json.Unmarshal(indented.Bytes(), &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(compact.Bytes(), &b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("compact output differs: %v != %v", a, b)
+	}
+
+	if err := writeStatus(&compact, st, "xml"); err == nil {
+		t.Error("expected error for invalid format")
+	}
+}
+
+// TestWriteStatusYAML 测试 YAML 的字段顺序和引号与 JSON 一致
+func TestWriteStatusYAML(t *testing.T) {
+	st, dir := testStatus(t)
+	var buf bytes.Buffer
+	if err := writeStatus(&buf, st, outputYAML); err != nil {
+		t.Fatal(err)
+	}
+	expected := `supported:
+  - linux/amd64
+  - linux/arm64
+emulators:
+  - qemu-aarch64
+instance:
+  mount: ` + mount + `
+  userns: ""
+  namespaced: false
+qemu: "9.2.0"
+versions:
+  - name: qemu-aarch64
+    interpreter: ` + filepath.Join(dir, "qemu-aarch64") + `
+    version: "8.1.5"
+    mismatch: true
+profiles:
+  - name: qemu-aarch64
+    interpreter: /usr/bin/qemu-aarch64
+    env:
+      QEMU_CPU: max
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected yaml:\n%s", buf.String())
+	}
+}
+
+// TestWriteStatusTable 测试表格中原生和模拟的平台，以及 platform 格式
+func TestWriteStatusTable(t *testing.T) {
+	st, dir := testStatus(t)
+	var buf bytes.Buffer
+	if err := writeStatus(&buf, st, outputTable); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("unexpected table:\n%s", buf.String())
+	}
+	if got := strings.Fields(lines[0]); !reflect.DeepEqual(got, []string{"PLATFORM", "MODE", "HANDLER", "INTERPRETER", "FLAGS", "VERSION"}) {
+		t.Errorf("unexpected header %v", got)
+	}
+	if got := strings.Fields(lines[1]); !reflect.DeepEqual(got, []string{"linux/amd64", "native", "-", "-", "-", "-"}) {
+		t.Errorf("unexpected native row %v", got)
+	}
+	e, err := readEntry("qemu-aarch64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"linux/arm64", "emulated", "qemu-aarch64", filepath.Join(dir, "qemu-aarch64"), e.flags, "8.1.5", "(mismatch)"}
+	if got := strings.Fields(lines[2]); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected emulated row %v", got)
+	}
+
+	buf.Reset()
+	if err := writeStatus(&buf, st, outputPlatform); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "linux/amd64,linux/arm64\n" {
+		t.Errorf("unexpected platform output %q", buf.String())
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// persistMarker 是 binfmt 生成的文件的第一行，unpersist 只删除带有此标记的文件
+const persistMarker = "# generated by binfmt"
+
+// checksumsFile 是持久化目录中记录模拟器校验和的文件，格式与 sha256sum 一致
+const checksumsFile = "SHA256SUMS"
+
+// persister 结构体：将模拟器持久化到宿主机，使注册在重启后恢复
+//
+// 写入的文件:
+//   - <dir>/<name>: 模拟器的副本
+//   - <dir>/SHA256SUMS: 模拟器的校验和
+//   - <binfmtD>/<name>.conf: systemd-binfmt 在启动时读取的注册字符串
+//   - <unit>（可选）: 在 systemd-binfmt.service 之前校验模拟器的 systemd 单元
+//
+// 所有路径都是宿主机上的路径，实际写入 root 下的对应位置，
+// 这样在容器中可以通过挂载宿主机的根目录（如 -v /:/host）写入。
+type persister struct {
+	root    string // 宿主机根目录在当前进程中的路径
+	dir     string // 模拟器的持久化目录
+	binfmtD string // binfmt.d 目录
+	unit    string // systemd 单元路径，为空时不写入
+}
+
+// newPersister 根据命令行参数创建 persister
+func newPersister() *persister {
+	return &persister{
+		root:    persistRoot,
+		dir:     persistDir,
+		binfmtD: binfmtDDir,
+		unit:    systemdUnit,
+	}
+}
+
+// hostPath 返回宿主机路径在当前进程中的路径
+func (p *persister) hostPath(elem ...string) string {
+	return filepath.Join(append([]string{p.root}, elem...)...)
+}
+
+// persist 将架构的模拟器复制到持久化目录，并写入 binfmt.d 文件
+//
+// 参数:
+//
+//	arch: 架构名称（如 "arm64"）
+//
+// 返回值:
+//
+//	error: 如果复制或写入失败返回错误
+//
+// 注意:
+//   - binfmt.d 文件中的注册字符串与 install 使用的一致，只是解释器指向持久化目录中的副本
+//   - 使用 -embedded 时复制内嵌的模拟器
+//   - 包装程序和配置不会被持久化，-profile 为该架构指定了配置时返回错误，
+//     而不是持久化一个没有这些设置的条目
+func (p *persister) persist(arch string) error {
+	r, err := getRegistration(arch)
+	if err != nil {
+		return err
+	}
+	if r.profile != nil {
+		return errors.Errorf("cannot persist %s with QEMU settings from -profile, the wrapper and its profile are not persisted", arch)
+	}
+	src, err := openInterpreter(r)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(p.hostPath(p.dir), 0755); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if err := writeFileAtomicFrom(p.hostPath(p.dir, r.name), io.TeeReader(src, h), 0755); err != nil {
+		return errors.Wrapf(err, "cannot copy %s", r.name)
+	}
+
+	r.embedded = ""
+	r.interpreter = filepath.Join(p.dir, r.name)
+	line, err := r.line()
+	if err != nil {
+		return errors.Wrapf(err, "invalid registration for %s", r.name)
+	}
+	conf := fmt.Sprintf("%s\n%s\n", persistMarker, line)
+	if err := os.MkdirAll(p.hostPath(p.binfmtD), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(p.hostPath(p.binfmtD, r.name+".conf"), []byte(conf)); err != nil {
+		return err
+	}
+
+	sums, err := p.readChecksums()
+	if err != nil {
+		return err
+	}
+	sums[r.name] = hex.EncodeToString(h.Sum(nil))
+	return p.writeChecksums(sums)
+}
+
+// unpersist 删除架构的持久化模拟器和 binfmt.d 文件
+//
+// 参数:
+//
+//	name: 架构名称（如 "arm64"）或模拟器名称（如 "qemu-aarch64"）
+//
+// 返回值:
+//
+//	error: 如果删除失败返回错误
+//
+// 注意:
+//   - 不是由 binfmt 生成的 binfmt.d 文件不会被删除
+//   - 最后一个模拟器被删除时，同时删除校验和文件、systemd 单元和空的持久化目录
+//   - 不会卸载已经注册的条目，需要时使用 -uninstall
+func (p *persister) unpersist(name string) error {
+	if _, ok := configs[name]; ok {
+		cfg, err := archConfig(name)
+		if err != nil {
+			return err
+		}
+		basename, _, err := getBinaryNames(cfg)
+		if err != nil {
+			return err
+		}
+		name = basename
+	}
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	sums, err := p.readChecksums()
+	if err != nil {
+		return err
+	}
+	if _, ok := sums[name]; !ok {
+		return errors.Errorf("%s is not persisted", name)
+	}
+
+	conf := p.hostPath(p.binfmtD, name+".conf")
+	if dt, err := os.ReadFile(conf); err == nil {
+		if !bytes.HasPrefix(dt, []byte(persistMarker+"\n")) {
+			return errors.Errorf("%s was not generated by binfmt", conf)
+		}
+		if err := os.Remove(conf); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(p.hostPath(p.dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(sums, name)
+	return p.writeChecksums(sums)
+}
+
+// persisted 返回所有已持久化的模拟器名称，用于 -unpersist all
+func (p *persister) persisted() ([]string, error) {
+	sums, err := p.readChecksums()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(sums))
+	for name := range sums {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// readChecksums 读取持久化目录中的校验和，文件不存在时返回空映射
+func (p *persister) readChecksums() (map[string]string, error) {
+	sums := map[string]string{}
+	dt, err := os.ReadFile(p.hostPath(p.dir, checksumsFile))
+	if os.IsNotExist(err) {
+		return sums, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := bufio.NewScanner(bytes.NewReader(dt))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		sums[fields[1]] = fields[0]
+	}
+	return sums, s.Err()
+}
+
+// writeChecksums 写入校验和文件，并更新 systemd 单元
+// 没有任何模拟器时删除校验和文件、systemd 单元和空的持久化目录
+func (p *persister) writeChecksums(sums map[string]string) error {
+	if len(sums) == 0 {
+		if err := os.Remove(p.hostPath(p.dir, checksumsFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := p.removeUnit(); err != nil {
+			return err
+		}
+		// 目录中还有其他文件时保留目录
+		os.Remove(p.hostPath(p.dir))
+		return nil
+	}
+
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s  %s\n", sums[name], name)
+	}
+	if err := writeFileAtomic(p.hostPath(p.dir, checksumsFile), buf.Bytes()); err != nil {
+		return err
+	}
+	return p.writeUnit()
+}
+
+// systemdRequiresDir 是启用单元时创建链接的目录，使 systemd-binfmt.service 依赖于该单元
+const systemdRequiresDir = "/etc/systemd/system/systemd-binfmt.service.requires"
+
+// writeUnit 写入在 systemd-binfmt.service 之前校验模拟器的 systemd 单元，并启用它
+//
+// 校验失败时单元失败，由于 systemd-binfmt.service 依赖该单元，被篡改的模拟器不会被注册。
+// 单元通过在 systemd-binfmt.service.requires 中创建链接启用，与 systemctl enable 的效果一致。
+func (p *persister) writeUnit() error {
+	if p.unit == "" {
+		return nil
+	}
+	unit := fmt.Sprintf(`%s
+[Unit]
+Description=Verify emulators persisted by binfmt
+DefaultDependencies=no
+Before=systemd-binfmt.service
+RequiresMountsFor=%s
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+WorkingDirectory=%s
+ExecStart=/usr/bin/sha256sum --check --quiet %s
+
+[Install]
+RequiredBy=systemd-binfmt.service
+`, persistMarker, p.dir, p.dir, checksumsFile)
+	if err := os.MkdirAll(filepath.Dir(p.hostPath(p.unit)), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(p.hostPath(p.unit), []byte(unit)); err != nil {
+		return err
+	}
+
+	link := p.hostPath(systemdRequiresDir, filepath.Base(p.unit))
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+	if target, err := os.Readlink(link); err == nil && target == p.unit {
+		return nil
+	}
+	os.Remove(link)
+	return os.Symlink(p.unit, link)
+}
+
+// removeUnit 删除由 binfmt 生成的 systemd 单元和启用它的链接
+func (p *persister) removeUnit() error {
+	if p.unit == "" {
+		return nil
+	}
+	if err := os.Remove(p.hostPath(systemdRequiresDir, filepath.Base(p.unit))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dt, err := os.ReadFile(p.hostPath(p.unit))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(dt, []byte(persistMarker+"\n")) {
+		return errors.Errorf("%s was not generated by binfmt", p.unit)
+	}
+	return os.Remove(p.hostPath(p.unit))
+}
+
+// openInterpreter 打开注册信息对应的解释器文件，内嵌的模拟器会被解压
+// 使用 -profile 时打开真正的模拟器而不是包装程序
+func openInterpreter(r registration) (io.ReadCloser, error) {
+	if r.embedded != "" {
+		return readEmbedded(r.embedded)
+	}
+	if r.profile != nil {
+		return os.Open(r.profile.Interpreter)
+	}
+	return os.Open(r.interpreter)
+}
+
+// writeFileAtomicFrom 从 r 读取内容，通过临时文件和重命名原子地写入文件
+func writeFileAtomicFrom(path string, r io.Reader, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
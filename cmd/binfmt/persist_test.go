@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestPersist 测试持久化时复制模拟器并写入 binfmt.d 文件和校验和
+func TestPersist(t *testing.T) {
+	dir := fakeInterpreters(t, "arm64", "riscv64")
+	p := &persister{
+		root:    t.TempDir(),
+		dir:     "/usr/local/lib/binfmt",
+		binfmtD: "/etc/binfmt.d",
+		unit:    "/etc/systemd/system/binfmt-verify.service",
+	}
+
+	for _, arch := range []string{"arm64", "riscv64"} {
+		if err := p.persist(arch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src, err := os.ReadFile(filepath.Join(dir, "qemu-aarch64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := os.ReadFile(p.hostPath(p.dir, "qemu-aarch64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(copied) != string(src) {
+		t.Fatalf("unexpected copy %q", copied)
+	}
+
+	sum := sha256.Sum256(src)
+	sums, err := os.ReadFile(p.hostPath(p.dir, checksumsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(sums), hex.EncodeToString(sum[:])+"  qemu-aarch64\n") {
+		t.Fatalf("unexpected checksums %q", sums)
+	}
+
+	conf, err := os.ReadFile(p.hostPath(p.binfmtD, "qemu-aarch64.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(conf)), "\n")
+	if len(lines) != 2 || lines[0] != persistMarker || !strings.HasPrefix(lines[1], ":qemu-aarch64:M:0:") || !strings.HasSuffix(lines[1], ":/usr/local/lib/binfmt/qemu-aarch64:CF") {
+		t.Fatalf("unexpected binfmt.d file %q", conf)
+	}
+
+	unit, err := os.ReadFile(p.hostPath(p.unit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(unit), "WorkingDirectory=/usr/local/lib/binfmt\n") {
+		t.Fatalf("unexpected unit %q", unit)
+	}
+	if target, err := os.Readlink(p.hostPath(systemdRequiresDir, "binfmt-verify.service")); err != nil || target != p.unit {
+		t.Fatalf("unit not enabled: %s %v", target, err)
+	}
+
+	if err := p.unpersist("arm64"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{p.hostPath(p.binfmtD, "qemu-aarch64.conf"), p.hostPath(p.dir, "qemu-aarch64")} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Fatalf("%s not removed: %v", f, err)
+		}
+	}
+	if names, err := p.persisted(); err != nil || strings.Join(names, ",") != "qemu-riscv64" {
+		t.Fatalf("unexpected persisted %v %v", names, err)
+	}
+
+	if err := p.unpersist("qemu-riscv64"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{p.hostPath(p.dir), p.hostPath(p.unit), p.hostPath(systemdRequiresDir, "binfmt-verify.service")} {
+		if _, err := os.Lstat(f); !os.IsNotExist(err) {
+			t.Fatalf("%s not removed: %v", f, err)
+		}
+	}
+	if err := p.unpersist("arm64"); err == nil {
+		t.Fatal("expected error for unpersisted architecture")
+	}
+}
+
+// TestUnpersistForeignConf 测试不会删除不是由 binfmt 生成的 binfmt.d 文件
+func TestUnpersistForeignConf(t *testing.T) {
+	fakeInterpreters(t, "arm64")
+	p := &persister{root: t.TempDir(), dir: "/usr/local/lib/binfmt", binfmtD: "/etc/binfmt.d"}
+	if err := p.persist("arm64"); err != nil {
+		t.Fatal(err)
+	}
+	conf := p.hostPath(p.binfmtD, "qemu-aarch64.conf")
+	if err := os.WriteFile(conf, []byte(":qemu-aarch64:M::\\x7fELF::/usr/bin/qemu-aarch64:F\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.unpersist("arm64"); err == nil || !strings.Contains(err.Error(), "not generated by binfmt") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := os.Stat(conf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPersistProfile 测试需要包装程序的 QEMU 设置不会被静默丢弃
+func TestPersistProfile(t *testing.T) {
+	defer func(spec, dir string, variants map[string]string) {
+		profileSpec, profileDir, installVariants = spec, dir, variants
+	}(profileSpec, profileDir, installVariants)
+	profileDir = t.TempDir()
+	fakeInterpreters(t, "arm64", "amd64")
+	p := &persister{root: t.TempDir(), dir: "/usr/local/lib/binfmt", binfmtD: "/etc/binfmt.d"}
+
+	profileSpec = "arm64.cpu=max"
+	if err := p.persist("arm64"); err == nil || !strings.Contains(err.Error(), "not persisted") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	profileSpec = ""
+
+	var err error
+	if installVariants, err = parseVariants("linux/amd64/v3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.persist("amd64"); err == nil || !strings.Contains(err.Error(), "not persisted") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := os.Stat(p.hostPath(p.binfmtD)); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing persisted: %v", err)
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// wrapperMagic 标记包装程序文件的尾部，长度为 16 字节
+const wrapperMagic = "binfmt-wrapper/1"
+
+// wrapperTrailerSize 是包装程序文件尾部的大小：模拟器和配置的长度各 8 字节，以及 wrapperMagic
+const wrapperTrailerSize = 8 + 8 + len(wrapperMagic)
+
+// profileKeys 映射：-profile 中的键到 QEMU 环境变量的映射
+// binfmt_misc 不能向解释器传递参数，这些设置只能通过环境变量传给 QEMU
+var profileKeys = map[string]string{
+	"cpu":         "QEMU_CPU",
+	"stack-size":  "QEMU_STACK_SIZE",
+	"reserved-va": "QEMU_RESERVED_VA",
+	"guest-base":  "QEMU_GUEST_BASE",
+	"sysroot":     "QEMU_LD_PREFIX",
+}
+
+// profile 结构体：包装程序执行真正的模拟器时使用的配置
+type profile struct {
+	Interpreter   string            `json:"interpreter"`             // 真正的模拟器路径
+	Env           map[string]string `json:"env"`                     // 执行模拟器时设置的环境变量
+	PreserveArgv0 bool              `json:"preserveArgv0,omitempty"` // 条目是否使用 P 标志注册
+	Trace         *traceConfig      `json:"trace,omitempty"`         // 跟踪模式的配置，见 runTrace
+	Debug         *debugConfig      `json:"debug,omitempty"`         // 调试模式的配置，见 runDebug
+}
+
+// handlerProfile 结构体：已注册条目使用的配置，用于在状态中报告
+type handlerProfile struct {
+	Name        string            `json:"name"`              // 条目名称
+	Interpreter string            `json:"interpreter"`       // 包装程序执行的模拟器
+	Env         map[string]string `json:"env"`               // 设置的环境变量
+	Sysroot     string            `json:"sysroot,omitempty"` // QEMU_LD_PREFIX 指定的根文件系统
+}
+
+// parseProfiles 解析 -profile，返回每个架构的环境变量
+//
+// 参数:
+//
+//	in: 用 "," 分隔的 "arch.key=value" 列表（如 "arm64.cpu=max,amd64.cpu=Haswell"）
+//
+// 返回值:
+//
+//	map[string]map[string]string: 架构到环境变量的映射
+//	error: 如果格式不合法、架构不支持或键未知返回错误
+func parseProfiles(in string) (map[string]map[string]string, error) {
+	out := map[string]map[string]string{}
+	for _, v := range strings.Split(in, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		kv, value, ok := strings.Cut(v, "=")
+		if !ok || value == "" {
+			return nil, errors.Errorf("invalid profile %q, expected arch.key=value", v)
+		}
+		arch, key, ok := strings.Cut(kv, ".")
+		if !ok {
+			return nil, errors.Errorf("invalid profile %q, expected arch.key=value", v)
+		}
+		if _, ok := configs[arch]; !ok {
+			return nil, errors.Errorf("unsupported architecture %q in profile %q", arch, v)
+		}
+		env, ok := profileKeys[key]
+		if !ok {
+			return nil, errors.Errorf("unknown profile key %q in %q", key, v)
+		}
+		// QEMU 相对于当前目录解析相对路径，每个程序的当前目录都不同
+		if env == "QEMU_LD_PREFIX" && !filepath.IsAbs(value) {
+			return nil, errors.Errorf("sysroot %q in %q must be an absolute path", value, v)
+		}
+		if out[arch] == nil {
+			out[arch] = map[string]string{}
+		}
+		out[arch][env] = value
+	}
+	return out, nil
+}
+
+// applyProfile 如果 -profile 或安装的平台变体为架构指定了配置，让注册信息使用包装程序作为解释器
+//
+// 参数:
+//
+//	arch: 架构名称
+//	r: 注册信息，interpreter 为真正的模拟器路径
+//
+// 返回值:
+//
+//	registration: 解释器替换为 <profileDir>/<name> 的注册信息，没有配置时原样返回
+//	error: 如果 -profile 不合法或与其他选项冲突返回错误
+//
+// 注意:
+//   - 只修改注册信息，包装程序和配置文件在 register 时才写入
+//   - 安装的变体（如 linux/amd64/v3）需要的 CPU 型号写入 QEMU_CPU，-profile 中明确指定的 cpu 优先
+func applyProfile(arch string, r registration) (registration, error) {
+	profiles, err := parseProfiles(profileSpec)
+	if err != nil {
+		return r, err
+	}
+	env := profiles[arch]
+	if variant, ok := installVariants[arch]; ok {
+		cpu, err := variantCPUFor(arch, variant)
+		if err != nil {
+			return r, err
+		}
+		if _, ok := env["QEMU_CPU"]; !ok && cpu != "" {
+			if env == nil {
+				env = map[string]string{}
+			}
+			env["QEMU_CPU"] = cpu
+		}
+	}
+	if len(env) == 0 {
+		return r, nil
+	}
+	if sysroot, ok := env["QEMU_LD_PREFIX"]; ok {
+		if fi, err := os.Stat(sysroot); err != nil || !fi.IsDir() {
+			return r, errors.Errorf("sysroot %s for %s is not a directory", sysroot, arch)
+		}
+	}
+	if r.embedded != "" {
+		return r, errors.Errorf("QEMU settings for %s cannot be used with embedded emulators", arch)
+	}
+	if r.backend != "" {
+		return r, errors.Errorf("QEMU settings for %s are only supported by the qemu backend", arch)
+	}
+	r.profile = &profile{
+		Interpreter:   r.interpreter,
+		Env:           env,
+		PreserveArgv0: strings.Contains(r.flags, "P"),
+	}
+	r.interpreter = filepath.Join(profileDir, r.name)
+	return r, nil
+}
+
+// writeProfile 为条目写入包装程序
+//
+// 工作原理:
+// 1. 复制当前的 binfmt，之后依次追加真正的模拟器、配置和记录两者长度的尾部（见 readWrapper）
+// 2. 每个条目有自己的包装程序，以条目名称命名，这个路径作为解释器注册
+//
+// 注意:
+//   - 包装程序不依赖任何其他文件：使用 F 标志注册后，其他挂载命名空间（如容器）中的程序，
+//     以及 binfmt 所在的容器退出后，包装程序仍然可以运行
+func writeProfile(r registration) error {
+	if err := os.MkdirAll(filepath.Dir(r.interpreter), 0755); err != nil {
+		return err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	sf, err := os.Open(self)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	// binfmt 本身是包装程序时只复制其中的 binfmt
+	w, _, err := readWrapper(sf)
+	if err != nil {
+		return err
+	}
+
+	ef, err := os.Open(r.profile.Interpreter)
+	if err != nil {
+		return err
+	}
+	defer ef.Close()
+	fi, err := ef.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.Errorf("emulator %s is not a regular file", r.profile.Interpreter)
+	}
+
+	dt, err := json.Marshal(r.profile)
+	if err != nil {
+		return err
+	}
+	src := io.MultiReader(w.exe, io.NewSectionReader(ef, 0, fi.Size()), bytes.NewReader(dt),
+		bytes.NewReader(wrapperTrailer(fi.Size(), int64(len(dt)))))
+	if err := writeFileAtomicFrom(r.interpreter, src, 0755); err != nil {
+		return errors.Wrap(err, "cannot write binfmt wrapper")
+	}
+	return nil
+}
+
+// wrapperTrailer 返回包装程序文件的尾部
+func wrapperTrailer(emulatorSize, profileSize int64) []byte {
+	b := make([]byte, 0, wrapperTrailerSize)
+	b = binary.LittleEndian.AppendUint64(b, uint64(emulatorSize))
+	b = binary.LittleEndian.AppendUint64(b, uint64(profileSize))
+	return append(b, wrapperMagic...)
+}
+
+// wrapperFile 结构体：包装程序文件的各个部分
+type wrapperFile struct {
+	exe      *io.SectionReader // binfmt 本身
+	emulator *io.SectionReader // 内嵌的模拟器
+	profile  *profile          // 内嵌的配置
+}
+
+// readWrapper 读取包装程序文件
+//
+// 参数:
+//
+//	f: 要读取的文件
+//
+// 返回值:
+//
+//	*wrapperFile: 文件的各个部分，不是包装程序时只有 exe，为整个文件
+//	bool: 文件末尾是否有包装程序的尾部，为 true 时即使返回错误也说明文件是包装程序
+//	error: 如果读取失败，或包装程序的尾部或配置损坏返回错误
+//
+// 包装程序文件的格式:
+//
+//	binfmt | 模拟器 | 配置（JSON） | 模拟器长度 | 配置长度 | wrapperMagic
+//
+// 长度为 8 字节的小端序整数
+func readWrapper(f *os.File) (*wrapperFile, bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	size := fi.Size()
+	plain := &wrapperFile{exe: io.NewSectionReader(f, 0, size)}
+	if size < int64(wrapperTrailerSize) {
+		return plain, false, nil
+	}
+	trailer := make([]byte, wrapperTrailerSize)
+	if _, err := f.ReadAt(trailer, size-int64(wrapperTrailerSize)); err != nil {
+		return nil, false, err
+	}
+	if string(trailer[16:]) != wrapperMagic {
+		return plain, false, nil
+	}
+
+	emulatorSize := binary.LittleEndian.Uint64(trailer[0:8])
+	profileSize := binary.LittleEndian.Uint64(trailer[8:16])
+	rest := uint64(size) - uint64(wrapperTrailerSize)
+	if profileSize > rest || emulatorSize > rest-profileSize {
+		return nil, true, errors.Errorf("corrupt binfmt wrapper %s", f.Name())
+	}
+	profileOff := int64(rest - profileSize)
+	emulatorOff := profileOff - int64(emulatorSize)
+
+	dt := make([]byte, profileSize)
+	if _, err := f.ReadAt(dt, profileOff); err != nil {
+		return nil, true, errors.Wrapf(err, "cannot read binfmt wrapper profile from %s", f.Name())
+	}
+	var p profile
+	if err := json.Unmarshal(dt, &p); err != nil {
+		return nil, true, errors.Wrapf(err, "invalid binfmt wrapper profile in %s", f.Name())
+	}
+	if p.Interpreter == "" {
+		return nil, true, errors.Errorf("binfmt wrapper profile in %s has no interpreter", f.Name())
+	}
+	return &wrapperFile{
+		exe:      io.NewSectionReader(f, 0, emulatorOff),
+		emulator: io.NewSectionReader(f, emulatorOff, int64(emulatorSize)),
+		profile:  &p,
+	}, true, nil
+}
+
+// loadWrapper 在 binfmt 作为包装程序被内核执行时，读取自身内嵌的配置和模拟器
+//
+// 返回值:
+//
+//	*profile: 内嵌的配置，Interpreter 替换为内嵌的模拟器所在的 memfd
+//	bool: binfmt 是否作为包装程序运行
+//	error: 如果读取配置或准备模拟器失败返回错误
+//
+// 注意:
+//   - 通过 /proc/self/exe 读取自身，而不是 argv0：使用 F 标志注册时，内核执行的是注册时打开的文件，
+//     argv0 是注册的路径，在其他挂载命名空间（如容器）中可能不存在
+//   - 模拟器复制到 memfd 中执行，同样不依赖宿主机上的路径
+//   - 无法打开 /proc/self/exe 时（如 /proc 未挂载）视为不是包装程序
+func loadWrapper() (*profile, bool, error) {
+	f, err := os.Open("/proc/self/exe")
+	if err != nil {
+		return nil, false, nil
+	}
+	defer f.Close()
+	w, ok, err := readWrapper(f)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+
+	mf, err := createMemfd(filepath.Base(w.profile.Interpreter))
+	if err != nil {
+		return nil, true, err
+	}
+	if _, err := io.Copy(mf, w.emulator); err != nil {
+		mf.Close()
+		return nil, true, errors.Wrapf(err, "cannot copy embedded %s", w.profile.Interpreter)
+	}
+	// memfd 在执行模拟器时关闭（CLOEXEC）
+	p := *w.profile
+	p.Interpreter = procSelfFD + strconv.Itoa(int(mf.Fd()))
+	dropHiddenSysroot(&p)
+	return &p, true, nil
+}
+
+// dropHiddenSysroot 在当前挂载命名空间中看不到 sysroot 时删除 QEMU_LD_PREFIX
+//
+// sysroot 是宿主机上的目录，无法内嵌到包装程序中。其他挂载命名空间（如容器）中的程序
+// 使用自己的根文件系统，不设置 QEMU_LD_PREFIX，而不是让 QEMU 在不存在的目录中查找动态链接器和库。
+func dropHiddenSysroot(p *profile) {
+	sysroot, ok := p.Env["QEMU_LD_PREFIX"]
+	if !ok {
+		return
+	}
+	if fi, err := os.Stat(sysroot); err == nil && fi.IsDir() {
+		return
+	}
+	env := make(map[string]string, len(p.Env))
+	for k, v := range p.Env {
+		if k != "QEMU_LD_PREFIX" {
+			env[k] = v
+		}
+	}
+	p.Env = env
+}
+
+// readProfile 读取解释器内嵌的配置，解释器不是包装程序时返回 false
+func readProfile(interpreter string) (*profile, bool) {
+	if !filepath.IsAbs(interpreter) || isFDInterpreter(interpreter) {
+		return nil, false
+	}
+	f, err := os.Open(interpreter)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	w, ok, err := readWrapper(f)
+	if err != nil || !ok {
+		return nil, false
+	}
+	return w.profile, true
+}
+
+// registrationProfile 返回与注册信息等效的包装程序配置
+// 注册信息没有配置时，直接执行模拟器并按 P 标志保留 argv0
+func registrationProfile(r registration) profile {
+	if r.profile != nil {
+		return *r.profile
+	}
+	return profile{
+		Interpreter:   r.interpreter,
+		PreserveArgv0: strings.Contains(r.flags, "P"),
+	}
+}
+
+// runWrapper 在 binfmt 作为包装程序被内核执行时，执行真正的模拟器
+// 只有执行失败时返回错误
+func runWrapper(p *profile, args []string) error {
+	argv, env, err := wrapperCommand(p, args, os.Environ())
+	if err != nil {
+		return err
+	}
+	// 跟踪模式下 QEMU 的日志通过管道交给 binfmt -trace
+	var extra []string
+	if p.Trace != nil {
+		extra = append(extra, traceArgs(p.Trace, args[1])...)
+	}
+	// 调试模式下匹配的程序在 gdbstub 下启动
+	if p.Debug != nil {
+		extra = append(extra, debugArgs(p.Debug, args[1])...)
+	}
+	if len(extra) > 0 {
+		argv = append(append([]string{argv[0]}, extra...), argv[1:]...)
+	}
+	return syscall.Exec(p.Interpreter, argv, env)
+}
+
+// wrapperCommand 根据配置构建执行真正的模拟器的参数和环境变量
+//
+// 参数:
+//
+//	p: argv0 对应的配置
+//	args: 内核传入的参数
+//	environ: 当前的环境变量
+//
+// 返回值:
+//
+//	[]string: 模拟器的参数
+//	[]string: 模拟器的环境变量
+//	error: 如果没有要运行的程序返回错误
+//
+// 内核传入的参数:
+//   - 没有 P 标志时: [解释器, 程序路径, 参数...]
+//   - 有 P 标志时: [解释器, 程序路径, 原始 argv0, 参数...]
+//
+// QEMU 通过辅助向量中的 AT_FLAGS 识别 P 标志，而重新执行后辅助向量不再包含它，
+// 因此使用 QEMU 的 -0 参数显式传递原始 argv0。
+// 环境变量中已经存在的设置优先，可以在单次执行时覆盖配置。
+func wrapperCommand(p *profile, args, environ []string) ([]string, []string, error) {
+	if len(args) < 2 {
+		return nil, nil, errors.New("binfmt wrapper requires a program to run")
+	}
+	argv := []string{p.Interpreter}
+	if p.PreserveArgv0 && len(args) >= 3 {
+		argv = append(argv, "-0", args[2], args[1])
+		argv = append(argv, args[3:]...)
+	} else {
+		argv = append(argv, args[1:]...)
+	}
+
+	set := map[string]struct{}{}
+	for _, kv := range environ {
+		if k, _, ok := strings.Cut(kv, "="); ok {
+			set[k] = struct{}{}
+		}
+	}
+	keys := make([]string, 0, len(p.Env))
+	for k := range p.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	env := append([]string{}, environ...)
+	for _, k := range keys {
+		if _, ok := set[k]; !ok {
+			env = append(env, k+"="+p.Env[k])
+		}
+	}
+	return argv, env, nil
+}
+
+// getHandlerProfiles 返回已注册条目使用的配置
+func getHandlerProfiles(names []string) []handlerProfile {
+	var out []handlerProfile
+	for _, name := range names {
+		e, err := readEntry(name)
+		if err != nil {
+			continue
+		}
+		if p, ok := readProfile(e.interpreter); ok {
+			out = append(out, handlerProfile{Name: name, Interpreter: p.Interpreter, Env: p.Env, Sysroot: p.Env["QEMU_LD_PREFIX"]})
+		}
+	}
+	return out
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseProfiles 测试 -profile 的解析和错误
+func TestParseProfiles(t *testing.T) {
+	got, err := parseProfiles("arm64.cpu=max, arm64.stack-size=8M,amd64.reserved-va=0x10000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]string{
+		"arm64": {"QEMU_CPU": "max", "QEMU_STACK_SIZE": "8M"},
+		"amd64": {"QEMU_RESERVED_VA": "0x10000000"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected profiles %v", got)
+	}
+
+	for _, in := range []string{"arm64.cpu", "arm64=max", "sparc.cpu=max", "arm64.smp=4", "arm64.cpu="} {
+		if _, err := parseProfiles(in); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+// TestInstallProfile 测试有配置的架构通过包装程序注册，其他架构不受影响
+func TestInstallProfile(t *testing.T) {
+	defer func(spec, dir string) { profileSpec, profileDir = spec, dir }(profileSpec, profileDir)
+	profileSpec = "arm64.cpu=cortex-a76"
+	profileDir = t.TempDir()
+
+	f := newFakeFS(t, true)
+	dir := fakeInterpreters(t, "arm64", "riscv64")
+	for _, arch := range []string{"arm64", "riscv64"} {
+		if err := install(arch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wrapper := filepath.Join(profileDir, "qemu-aarch64")
+	e, ok := f.entry("qemu-aarch64")
+	if !ok || e.interpreter != wrapper {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	// 包装程序是内嵌了模拟器和配置的 binfmt 副本，不依赖其他文件
+	wf, err := os.Open(wrapper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wf.Close()
+	w, ok, err := readWrapper(wf)
+	if err != nil || !ok {
+		t.Fatalf("expected a wrapper: %v", err)
+	}
+	emulator, err := io.ReadAll(w.emulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, _ := os.ReadFile(filepath.Join(dir, "qemu-aarch64")); !bytes.Equal(emulator, expected) {
+		t.Fatalf("unexpected embedded emulator %q", emulator)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(self); err != nil || fi.Size() != w.exe.Size() {
+		t.Fatalf("expected binfmt copy of %d bytes, got %d: %v", fi.Size(), w.exe.Size(), err)
+	}
+	if e, _ := f.entry("qemu-riscv64"); e.interpreter != filepath.Join(dir, "qemu-riscv64") {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	got := getHandlerProfiles(f.names())
+	expected := []handlerProfile{{
+		Name:        "qemu-aarch64",
+		Interpreter: filepath.Join(dir, "qemu-aarch64"),
+		Env:         map[string]string{"QEMU_CPU": "cortex-a76"},
+	}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected profiles %+v", got)
+	}
+}
+
+// TestWrapperCommand 测试包装程序执行模拟器的参数和环境变量
+func TestWrapperCommand(t *testing.T) {
+	p := &profile{
+		Interpreter: "/usr/bin/qemu-aarch64",
+		Env:         map[string]string{"QEMU_CPU": "max", "QEMU_STACK_SIZE": "8M"},
+	}
+	argv, env, err := wrapperCommand(p, []string{"/profiles/qemu-aarch64", "/bin/ls", "-l"}, []string{"PATH=/bin", "QEMU_STACK_SIZE=1M"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"/usr/bin/qemu-aarch64", "/bin/ls", "-l"}; !reflect.DeepEqual(argv, expected) {
+		t.Errorf("unexpected argv %v", argv)
+	}
+	// 已经存在的环境变量优先
+	if expected := []string{"PATH=/bin", "QEMU_STACK_SIZE=1M", "QEMU_CPU=max"}; !reflect.DeepEqual(env, expected) {
+		t.Errorf("unexpected env %v", env)
+	}
+
+	p.PreserveArgv0 = true
+	argv, _, err = wrapperCommand(p, []string{"/profiles/qemu-aarch64", "/bin/busybox", "ls", "-l"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"/usr/bin/qemu-aarch64", "-0", "ls", "/bin/busybox", "-l"}; !reflect.DeepEqual(argv, expected) {
+		t.Errorf("unexpected argv %v", argv)
+	}
+
+	if _, _, err := wrapperCommand(p, []string{"/profiles/qemu-aarch64"}, nil); err == nil || !strings.Contains(err.Error(), "requires a program") {
+		t.Errorf("expected error, got %v", err)
+	}
+}
+
+// TestReadWrapper 测试根据文件末尾的尾部识别包装程序，尾部或配置损坏时返回错误
+func TestReadWrapper(t *testing.T) {
+	dir := t.TempDir()
+	write := func(dt []byte) *os.File {
+		p := filepath.Join(dir, "qemu-aarch64")
+		if err := os.WriteFile(p, dt, 0755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	wrapper := func(exe, emulator, profile string) []byte {
+		dt := []byte(exe + emulator + profile)
+		return append(dt, wrapperTrailer(int64(len(emulator)), int64(len(profile)))...)
+	}
+
+	// 普通的文件不是包装程序，整个文件都是 binfmt
+	w, ok, err := readWrapper(write([]byte("\x7fELF binfmt")))
+	if err != nil || ok || w.exe.Size() != 11 {
+		t.Fatalf("unexpected result for plain file %+v %v %v", w, ok, err)
+	}
+
+	w, ok, err = readWrapper(write(wrapper("\x7fELF binfmt", "qemu", `{"interpreter":"/usr/bin/qemu-aarch64","env":{"QEMU_CPU":"max"}}`)))
+	if err != nil || !ok {
+		t.Fatalf("expected a wrapper: %v", err)
+	}
+	emulator, _ := io.ReadAll(w.emulator)
+	if w.exe.Size() != 11 || string(emulator) != "qemu" || w.profile.Interpreter != "/usr/bin/qemu-aarch64" || w.profile.Env["QEMU_CPU"] != "max" {
+		t.Fatalf("unexpected wrapper %+v %q", w.profile, emulator)
+	}
+
+	// 尾部或配置损坏时不能回退到命令行
+	for _, tc := range []struct {
+		dt        []byte
+		expectErr string
+	}{
+		{append([]byte("x"), wrapperTrailer(100, 1)...), "corrupt binfmt wrapper"},
+		{wrapper("binfmt", "qemu", "{"), "invalid binfmt wrapper profile"},
+		{wrapper("binfmt", "qemu", "{}"), "has no interpreter"},
+	} {
+		if _, ok, err := readWrapper(write(tc.dt)); !ok || err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+			t.Errorf("expected error %q, got %v %v", tc.expectErr, ok, err)
+		}
+	}
+}
+
+// TestInstallSysroot 测试 sysroot 必须是已存在目录的绝对路径，通过 QEMU_LD_PREFIX 传给模拟器，看不到时不设置
+func TestInstallSysroot(t *testing.T) {
+	defer func(spec, dir string) { profileSpec, profileDir = spec, dir }(profileSpec, profileDir)
+	profileDir = t.TempDir()
+	sysroot := t.TempDir()
+
+	f := newFakeFS(t, true)
+	fakeInterpreters(t, "arm64")
+
+	profileSpec = "arm64.sysroot=crossarch"
+	if _, err := getRegistration("arm64"); err == nil || !strings.Contains(err.Error(), "absolute path") {
+		t.Fatalf("expected error for relative sysroot, got %v", err)
+	}
+	profileSpec = "arm64.sysroot=" + filepath.Join(sysroot, "missing")
+	if _, err := getRegistration("arm64"); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Fatalf("expected error for missing sysroot, got %v", err)
+	}
+
+	profileSpec = "arm64.sysroot=" + sysroot
+	if err := install("arm64"); err != nil {
+		t.Fatal(err)
+	}
+	got := getHandlerProfiles(f.names())
+	if len(got) != 1 || got[0].Sysroot != sysroot || got[0].Env["QEMU_LD_PREFIX"] != sysroot {
+		t.Fatalf("unexpected profiles %+v", got)
+	}
+
+	// 看不到 sysroot 的挂载命名空间（如容器）中不设置 QEMU_LD_PREFIX，其他设置不受影响
+	p := &profile{Env: map[string]string{"QEMU_LD_PREFIX": sysroot, "QEMU_CPU": "max"}}
+	dropHiddenSysroot(p)
+	if p.Env["QEMU_LD_PREFIX"] != sysroot {
+		t.Fatalf("visible sysroot dropped %+v", p.Env)
+	}
+	env := map[string]string{"QEMU_LD_PREFIX": filepath.Join(sysroot, "missing"), "QEMU_CPU": "max"}
+	p = &profile{Env: env}
+	dropHiddenSysroot(p)
+	if !reflect.DeepEqual(p.Env, map[string]string{"QEMU_CPU": "max"}) || len(env) != 2 {
+		t.Fatalf("unexpected env %+v, original %+v", p.Env, env)
+	}
+}
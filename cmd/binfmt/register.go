@@ -0,0 +1,310 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 内核 binfmt_misc 的限制
+// 参考：https://github.com/torvalds/linux/blob/master/fs/binfmt_misc.c
+const (
+	// maxRegisterLength 是写入 register 文件的单行最大长度（MAX_REGISTER_LENGTH）
+	maxRegisterLength = 1920
+
+	// maxMagicLength 是 offset + magic 长度的上限（BINPRM_BUF_SIZE）
+	// 内核只会读取可执行文件开头的 BINPRM_BUF_SIZE 字节用于匹配
+	maxMagicLength = 256
+
+	// maxNameLength 是条目名称的最大长度
+	// 名称会成为 binfmt_misc 目录中的文件名，受 NAME_MAX 限制
+	maxNameLength = 255
+)
+
+// delimiterCandidates 是注册字符串可以使用的分隔符，按优先级排列
+// 内核把注册字符串的第一个字符当作分隔符，所以只要字段中不包含该字符即可
+// 默认使用 ":"，只有当字段中包含 ":" 时才会退而使用其他字符
+const delimiterCandidates = ":#|!%@^~,;="
+
+// registration 结构体：描述一条 binfmt_misc 注册信息
+//
+// 注册字符串格式:
+//
+//	:name:type:offset:magic:mask:interpreter:flags
+//
+// 字段说明:
+//   - name: 条目名称，成为 binfmt_misc 目录下的文件名
+//   - offset: 魔数在文件中的偏移量
+//   - magic: 转义后的魔数（如 \x7fELF...）
+//   - mask: 转义后的掩码，长度必须与魔数一致
+//   - interpreter: 解释器的绝对路径
+//   - flags: 标志位（P、O、C、F）
+type registration struct {
+	name        string
+	offset      int
+	magic       string
+	mask        string
+	interpreter string
+	flags       string
+
+	// backend 模拟器后端名称，为空时为 QEMU
+	backend string
+
+	// profile 不为空时，interpreter 为包装程序，注册时写入包装程序和配置
+	profile *profile
+
+	// embedded 不为空时，解释器为内嵌的模拟器（如 "qemu-aarch64"），
+	// 注册时才解压到 memfd 中，interpreter 在此之前为空
+	embedded string
+}
+
+// newRegistration 根据架构配置创建注册信息
+//
+// 参数:
+//
+//	cfg: 架构配置信息
+//	name: 条目名称（通常为 QEMU 模拟器名称）
+//	interpreter: 解释器的完整路径
+//	flags: 标志位
+//
+// 返回值:
+//
+//	registration: 注册信息
+func newRegistration(cfg config, name, interpreter, flags string) registration {
+	return registration{
+		name:        name,
+		magic:       cfg.magic,
+		mask:        cfg.mask,
+		interpreter: interpreter,
+		flags:       flags,
+		backend:     cfg.backend,
+	}
+}
+
+// line 构建写入 register 文件的注册字符串
+//
+// 返回值:
+//
+//	string: 注册字符串
+//	error: 如果任何字段不合法或超过内核限制返回错误
+//
+// 工作原理:
+// 1. 校验名称、魔数、掩码、解释器路径和标志位
+// 2. 选择一个不出现在任何字段中的分隔符
+// 3. 拼接注册字符串并检查总长度
+//
+// 注意:
+//   - 默认分隔符为 ":"，与之前的格式完全一致
+//   - 如果路径中包含 ":"，会自动改用其他分隔符而不是生成错误的注册字符串
+//   - 如果找不到可用的分隔符，返回错误
+func (r registration) line() (string, error) {
+	if err := validateName(r.name); err != nil {
+		return "", err
+	}
+	magicLen, err := escapedLength(r.magic)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid magic")
+	}
+	maskLen, err := escapedLength(r.mask)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid mask")
+	}
+	if magicLen == 0 {
+		return "", errors.New("magic must not be empty")
+	}
+	if r.mask != "" && maskLen != magicLen {
+		return "", errors.Errorf("mask length %d does not match magic length %d", maskLen, magicLen)
+	}
+	if r.offset < 0 || r.offset+magicLen > maxMagicLength {
+		return "", errors.Errorf("offset %d and magic length %d exceed kernel limit of %d bytes", r.offset, magicLen, maxMagicLength)
+	}
+	if err := validateInterpreter(r.interpreter); err != nil {
+		return "", err
+	}
+	if err := validateFlags(r.flags); err != nil {
+		return "", err
+	}
+
+	fields := []string{r.name, "M", strconv.Itoa(r.offset), r.magic, r.mask, r.interpreter, r.flags}
+
+	// 选择不出现在任何字段中的分隔符
+	var del string
+	for _, c := range delimiterCandidates {
+		d := string(c)
+		ok := true
+		for _, f := range fields {
+			if strings.Contains(f, d) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			del = d
+			break
+		}
+	}
+	if del == "" {
+		return "", errors.Errorf("cannot find a delimiter that does not appear in registration for %s", r.name)
+	}
+
+	line := del + strings.Join(fields, del)
+	if len(line) > maxRegisterLength {
+		return "", errors.Errorf("registration for %s is %d bytes, exceeds kernel limit of %d", r.name, len(line), maxRegisterLength)
+	}
+	return line, nil
+}
+
+// validateName 校验 binfmt_misc 条目名称
+//
+// 参数:
+//
+//	name: 条目名称
+//
+// 返回值:
+//
+//	error: 如果名称不合法返回错误
+//
+// 注意:
+//   - 名称会直接成为 binfmt_misc 挂载点下的文件名
+//   - 不能为空、不能是 "." 或 ".."、不能包含路径分隔符或控制字符
+//   - 同时用于校验卸载目标，防止通过 "../" 写入挂载点之外的文件
+func validateName(name string) error {
+	if name == "" {
+		return errors.New("name must not be empty")
+	}
+	if name == "." || name == ".." {
+		return errors.Errorf("invalid name %q", name)
+	}
+	if len(name) > maxNameLength {
+		return errors.Errorf("name %q exceeds %d bytes", name, maxNameLength)
+	}
+	if strings.ContainsRune(name, '/') || strings.ContainsRune(name, os.PathSeparator) {
+		return errors.Errorf("name %q must not contain path separator", name)
+	}
+	if hasControl(name) {
+		return errors.Errorf("name %q must not contain control characters", name)
+	}
+	return nil
+}
+
+// validateInterpreter 校验解释器路径
+//
+// 参数:
+//
+//	p: 解释器路径
+//
+// 返回值:
+//
+//	error: 如果路径不合法返回错误
+//
+// 注意:
+//   - 路径必须为绝对路径，因为内核不会解析相对路径
+//   - 路径中不能包含控制字符（如换行符），否则注册字符串会被截断
+func validateInterpreter(p string) error {
+	if p == "" {
+		return errors.New("interpreter path must not be empty")
+	}
+	if !filepath.IsAbs(p) {
+		return errors.Errorf("interpreter path %q must be absolute", p)
+	}
+	if hasControl(p) {
+		return errors.Errorf("interpreter path %q must not contain control characters", p)
+	}
+	return nil
+}
+
+// validateFlags 校验标志位
+//
+// 参数:
+//
+//	flags: 标志位字符串
+//
+// 返回值:
+//
+//	error: 如果包含内核不支持的标志位返回错误
+//
+// 支持的标志位:
+//   - P: 保留 argv0
+//   - O: 传递打开的文件描述符
+//   - C: 使用解释器的凭据
+//   - F: 注册时立即打开解释器
+func validateFlags(flags string) error {
+	for _, c := range flags {
+		switch c {
+		case 'P', 'O', 'C', 'F':
+		default:
+			return errors.Errorf("invalid flag %q", c)
+		}
+	}
+	return nil
+}
+
+// escapedLength 计算转义字符串解码后的字节长度
+//
+// 参数:
+//
+//	s: 使用 \xHH 转义的字符串（如 \x7fELF）
+//
+// 返回值:
+//
+//	int: 解码后的字节数
+//	error: 如果转义序列不完整返回错误
+func escapedLength(s string) (int, error) {
+	dt, err := unescape(s)
+	if err != nil {
+		return 0, err
+	}
+	return len(dt), nil
+}
+
+// unescape 解码使用 \xHH 转义的字符串
+//
+// 参数:
+//
+//	s: 使用 \xHH 转义的字符串（如 \x7fELF）
+//
+// 返回值:
+//
+//	[]byte: 解码后的字节
+//	error: 如果转义序列不完整或不合法返回错误
+//
+// 注意:
+//   - 内核使用 string_unescape 的 UNESCAPE_HEX 模式，只处理 \xHH 一种转义，
+//     其他反斜杠（包括 \\）会原样保留，与预期的魔数不符，因此这里一律拒绝
+func unescape(s string) ([]byte, error) {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+		if i+3 >= len(s) {
+			return nil, errors.Errorf("incomplete escape sequence at offset %d", i)
+		}
+		if s[i+1] != 'x' || !isHex(s[i+2]) || !isHex(s[i+3]) {
+			return nil, errors.Errorf("invalid escape sequence at offset %d", i)
+		}
+		v, _ := strconv.ParseUint(s[i+2:i+4], 16, 8)
+		out = append(out, byte(v))
+		i += 3
+	}
+	return out, nil
+}
+
+// isHex 判断字符是否为十六进制数字
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// hasControl 判断字符串中是否包含控制字符
+func hasControl(s string) bool {
+	for _, c := range s {
+		if c < 0x20 || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
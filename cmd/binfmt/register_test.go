@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestRegistrationLine 测试注册字符串的构建、分隔符选择和内核限制校验
+func TestRegistrationLine(t *testing.T) {
+	cfg := configs["arm64"]
+
+	tcs := []struct {
+		name        string
+		reg         registration
+		expected    string
+		expectedErr string
+	}{
+		{
+			name:     "default",
+			reg:      newRegistration(cfg, "qemu-aarch64", "/usr/bin/qemu-aarch64", "CF"),
+			expected: ":qemu-aarch64:M:0:" + cfg.magic + ":" + cfg.mask + ":/usr/bin/qemu-aarch64:CF",
+		},
+		{
+			name:     "colon in path",
+			reg:      newRegistration(cfg, "qemu-aarch64", "/opt/a:b/qemu-aarch64", "CFP"),
+			expected: "#qemu-aarch64#M#0#" + cfg.magic + "#" + cfg.mask + "#/opt/a:b/qemu-aarch64#CFP",
+		},
+		{
+			name:        "all delimiters used",
+			reg:         newRegistration(cfg, "qemu-aarch64", "/opt/"+delimiterCandidates+"/qemu", "CF"),
+			expectedErr: "cannot find a delimiter",
+		},
+		{
+			name:        "relative interpreter",
+			reg:         newRegistration(cfg, "qemu-aarch64", "qemu-aarch64", "CF"),
+			expectedErr: "must be absolute",
+		},
+		{
+			name:        "newline in interpreter",
+			reg:         newRegistration(cfg, "qemu-aarch64", "/usr/bin/qemu\n", "CF"),
+			expectedErr: "control characters",
+		},
+		{
+			name:        "path in name",
+			reg:         newRegistration(cfg, "../qemu-aarch64", "/usr/bin/qemu-aarch64", "CF"),
+			expectedErr: "path separator",
+		},
+		{
+			name:        "dot name",
+			reg:         newRegistration(cfg, "..", "/usr/bin/qemu-aarch64", "CF"),
+			expectedErr: "invalid name",
+		},
+		{
+			name:        "invalid flag",
+			reg:         newRegistration(cfg, "qemu-aarch64", "/usr/bin/qemu-aarch64", "CFX"),
+			expectedErr: "invalid flag",
+		},
+		{
+			name:        "mask length mismatch",
+			reg:         registration{name: "x", magic: `\x7fELF`, mask: `\xff`, interpreter: "/x"},
+			expectedErr: "does not match",
+		},
+		{
+			name:        "magic too long",
+			reg:         registration{name: "x", offset: 251, magic: `\x7fELF\x02\x01`, interpreter: "/x"},
+			expectedErr: "exceed kernel limit",
+		},
+		{
+			name:     "magic at end of buffer",
+			reg:      registration{name: "x", offset: 250, magic: `\x7fELF\x02\x01`, interpreter: "/x"},
+			expected: ":x:M:250:\\x7fELF\\x02\\x01::/x:",
+		},
+		{
+			name:        "line too long",
+			reg:         newRegistration(cfg, "qemu-aarch64", "/"+strings.Repeat("a", maxRegisterLength), "CF"),
+			expectedErr: "exceeds kernel limit",
+		},
+		{
+			name:        "broken escape",
+			reg:         registration{name: "x", magic: `\x7`, interpreter: "/x"},
+			expectedErr: "invalid magic",
+		},
+		{
+			name:        "escaped backslash",
+			reg:         registration{name: "x", magic: `\\ELF`, interpreter: "/x"},
+			expectedErr: "invalid magic",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			line, err := tc.reg.line()
+			if tc.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+					t.Fatalf("expected error containing %q, got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, line)
+			}
+		})
+	}
+}
+
+// TestConfigsValid 验证所有内置架构配置都能生成合法的注册字符串
+func TestConfigsValid(t *testing.T) {
+	for arch, cfg := range configs {
+		if _, err := newRegistration(cfg, cfg.binary, "/usr/bin/"+cfg.binary, "CFP").line(); err != nil {
+			t.Errorf("%s: %v", arch, err)
+		}
+	}
+}
+
+// TestParseUninstallConfined 验证卸载目标被限制在挂载点目录内
+func TestParseUninstallConfined(t *testing.T) {
+	defer func(old string) { mount = old }(mount)
+	mount = t.TempDir()
+
+	out := parseUninstall("../*,qemu-*")
+	if len(out) != 2 || out[0] != "../*" || out[1] != "qemu-*" {
+		t.Fatalf("unexpected targets %v", out)
+	}
+	if err := uninstall("../etc"); err == nil {
+		t.Fatal("expected error for path outside mount")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// runCommand 实现 binfmt run 子命令：不注册 binfmt_misc 条目，直接在模拟器下执行命令
+//
+// 参数:
+//
+//	args: run 之后的命令行参数（如 ["--platform", "linux/arm64", "--", "ls", "-l"]）
+//
+// 返回值:
+//
+//	error: 如果找不到模拟器或执行失败返回错误，成功时不返回
+//
+// 用于不能写入 binfmt_misc 的环境（如 rootless CI）。模拟器的查找方式与 -install 相同，
+// 并按注册条目时的方式应用 QEMU_PRESERVE_ARGV0、-profile 和平台变体。
+// 配置通过环境变量传给 QEMU，带有 buildkit-direct-execve 补丁的 QEMU 通过 /proc/self/exe
+// 执行子进程时会继承这些设置，因此子进程同样在模拟器下运行。
+func runCommand(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	var platform string
+	fs.StringVar(&platform, "platform", "", "platform to run the command as (e.g. linux/arm64)")
+	fs.StringVar(&profileSpec, "profile", "", "comma-separated QEMU settings, e.g. arm64.cpu=max")
+	fs.BoolVar(&useEmbedded, "embedded", false, "use the emulator embedded in this binary")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	p, kargs, err := commandProfile(platform, fs.Args())
+	if err != nil {
+		return err
+	}
+	return runWrapper(p, kargs)
+}
+
+// commandProfile 解析 run 子命令要使用的模拟器配置
+//
+// 参数:
+//
+//	platform: 平台（如 "linux/arm64" 或 "linux/arm/v6"）
+//	cmd: 要运行的命令及其参数
+//
+// 返回值:
+//
+//	*profile: 执行模拟器的配置
+//	[]string: 与内核执行已注册条目时相同格式的参数，交给 runWrapper
+//	error: 如果平台不受支持、找不到模拟器或命令不存在返回错误
+func commandProfile(platform string, cmd []string) (*profile, []string, error) {
+	if platform == "" {
+		return nil, nil, errors.New("run requires --platform")
+	}
+	if len(cmd) == 0 {
+		return nil, nil, errors.New("run requires a command")
+	}
+	p, err := platformProfile(platform)
+	if err != nil {
+		return nil, nil, err
+	}
+	path, err := exec.LookPath(cmd[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, wrapperArgs(p, path, cmd), nil
+}
+
+// platformProfile 按注册条目时的方式解析平台的模拟器和设置
+//
+// 参数:
+//
+//	platform: 平台（如 "linux/arm64" 或 "linux/arm/v6"）
+//
+// 返回值:
+//
+//	*profile: 执行模拟器的配置，内嵌的模拟器已经解压到 memfd 中
+//	error: 如果平台不受支持或找不到模拟器返回错误
+func platformProfile(platform string) (*profile, error) {
+	arch := parseArch(platform)
+	if len(arch) != 1 {
+		return nil, errors.Errorf("expected exactly one platform, got %q", platform)
+	}
+	variants, err := parseVariants(platform)
+	if err != nil {
+		return nil, err
+	}
+	installVariants = variants
+
+	r, err := getRegistration(arch[0])
+	if err != nil {
+		return nil, err
+	}
+	if r.backend != "" {
+		return nil, errors.Errorf("only the qemu backend can run commands directly, %s uses %s", arch[0], r.backend)
+	}
+	p := registrationProfile(r)
+
+	// 内嵌的模拟器解压到 memfd 中，通过 /proc/self/fd/N 执行，执行后不再需要该文件描述符
+	if r.embedded != "" {
+		interpreter, _, err := openEmbedded(r.embedded)
+		if err != nil {
+			return nil, err
+		}
+		p.Interpreter = interpreter
+		return &p, nil
+	}
+	// 注册条目时内核会检查解释器，这里需要自己检查
+	if _, err := os.Stat(p.Interpreter); err != nil {
+		return nil, errors.Wrapf(err, "no emulator for %s", arch[0])
+	}
+	return &p, nil
+}
+
+// wrapperArgs 构建与内核执行已注册条目时相同格式的参数
+// 与内核一样使用程序的完整路径，原始 argv0 只在保留 argv0 时传递
+func wrapperArgs(p *profile, path string, cmd []string) []string {
+	args := []string{p.Interpreter, path}
+	if p.PreserveArgv0 {
+		args = append(args, cmd[0])
+	}
+	return append(args, cmd[1:]...)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestCommandProfile 测试 run 子命令为平台选择模拟器、配置和 CPU 型号，以及无效的平台和命令
+func TestCommandProfile(t *testing.T) {
+	defer func(spec string, variants map[string]string) {
+		profileSpec, installVariants = spec, variants
+	}(profileSpec, installVariants)
+	profileSpec = "arm64.stack-size=8M"
+	t.Setenv("QEMU_PRESERVE_ARGV0", "1")
+
+	dir := fakeInterpreters(t, "arm64", "arm")
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	p, kargs, err := commandProfile("linux/arm64", []string{"sh", "-c", "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	argv, env, err := wrapperCommand(p, kargs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{filepath.Join(dir, "qemu-aarch64"), "-0", "sh", sh, "-c", "true"}; !reflect.DeepEqual(argv, expected) {
+		t.Errorf("unexpected argv %v", argv)
+	}
+	if expected := []string{"QEMU_STACK_SIZE=8M"}; !reflect.DeepEqual(env, expected) {
+		t.Errorf("unexpected env %v", env)
+	}
+
+	// 平台变体与 -install 一样选择 CPU 型号
+	p, _, err = commandProfile("linux/arm/v6", []string{"sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Interpreter != filepath.Join(dir, "qemu-arm") || p.Env["QEMU_CPU"] != "arm1176" {
+		t.Errorf("unexpected profile %+v", p)
+	}
+
+	for _, tc := range []struct {
+		platform string
+		cmd      []string
+	}{
+		{platform: "", cmd: []string{"sh"}},
+		{platform: "linux/arm64", cmd: nil},
+		{platform: "linux/arm64,linux/arm", cmd: []string{"sh"}},
+		{platform: "linux/riscv64", cmd: []string{"sh"}},
+	} {
+		if _, _, err := commandProfile(tc.platform, tc.cmd); err == nil {
+			t.Errorf("%q %v: expected error", tc.platform, tc.cmd)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/containerd/platforms"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// smokeResult 结构体：一个平台的冒烟测试结果
+type smokeResult struct {
+	Platform string   `json:"platform"`          // 平台（如 "linux/arm64"）
+	Command  []string `json:"command,omitempty"` // 运行的命令
+	OK       bool     `json:"ok"`                // 命令是否成功退出
+	Output   string   `json:"output,omitempty"`  // 命令的标准输出和标准错误
+	Duration string   `json:"duration"`          // 解压根文件系统并运行命令的耗时
+	Error    string   `json:"error,omitempty"`   // 失败原因
+}
+
+// runSmokeTest 实现 binfmt smoke-test 子命令：离线验证多平台镜像能否在模拟器下运行
+//
+// 参数:
+//
+//	args: smoke-test 之后的命令行参数（如 ["--timeout", "30s", "./layout", "--", "uname", "-m"]）
+//
+// 返回值:
+//
+//	error: 如果布局无效或有平台失败返回错误
+//
+// 工作原理:
+// 1. 列出布局中每个平台的镜像清单
+// 2. 为每个平台解压根文件系统到临时目录
+// 3. 通过 binfmt chroot 在对应的模拟器下运行镜像配置的 Entrypoint 和 Cmd，或者指定的命令
+// 4. 以 JSON 输出每个平台的结果、输出和耗时
+//
+// 注意:
+//   - 与 chroot 子命令一样需要 root 权限
+func runSmokeTest(args []string) error {
+	fs := flag.NewFlagSet("smoke-test", flag.ExitOnError)
+	var timeout time.Duration
+	var only string
+	fs.DurationVar(&timeout, "timeout", time.Minute, "timeout for each platform")
+	fs.StringVar(&only, "platform", "", "comma-separated platforms to test (default all platforms in the layout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("smoke-test requires an OCI image layout directory")
+	}
+	cmd := fs.Args()[1:]
+	if len(cmd) > 0 && cmd[0] == "--" {
+		cmd = cmd[1:]
+	}
+
+	l, err := openOCILayout(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	pms, err := l.platformManifests()
+	if err != nil {
+		return err
+	}
+	if only != "" {
+		var filtered []platformManifest
+		for _, v := range strings.Split(only, ",") {
+			p, err := platforms.Parse(strings.TrimSpace(v))
+			if err != nil {
+				return err
+			}
+			m := platforms.Only(p)
+			for _, pm := range pms {
+				if m.Match(pm.platform) {
+					filtered = append(filtered, pm)
+				}
+			}
+		}
+		pms = filtered
+	}
+	if len(pms) == 0 {
+		return errors.New("no platforms to test")
+	}
+
+	var results []smokeResult
+	var failed int
+	for _, pm := range pms {
+		res := l.smokeTest(pm, cmd, timeout)
+		if !res.OK {
+			failed++
+		}
+		results = append(results, res)
+	}
+	dt, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", dt)
+	if failed > 0 {
+		return errors.Errorf("%d of %d platforms failed", failed, len(results))
+	}
+	return nil
+}
+
+// smokeTest 解压一个平台的根文件系统并在模拟器下运行命令
+func (l *ociLayout) smokeTest(pm platformManifest, cmd []string, timeout time.Duration) smokeResult {
+	start := time.Now()
+	res := smokeResult{Platform: platforms.Format(pm.platform)}
+	fail := func(err error) smokeResult {
+		res.Error = err.Error()
+		res.Duration = time.Since(start).Round(time.Millisecond).String()
+		return res
+	}
+	if pm.platform.OS != "linux" {
+		return fail(errors.Errorf("unsupported OS %s", pm.platform.OS))
+	}
+
+	var img ocispecs.Image
+	if err := l.readJSON(pm.manifest.Config, &img); err != nil {
+		return fail(err)
+	}
+	cmd, err := imageCommand(img, cmd)
+	if err != nil {
+		return fail(err)
+	}
+	res.Command = cmd
+
+	rootfs, err := os.MkdirTemp("", "binfmt-smoke-")
+	if err != nil {
+		return fail(err)
+	}
+	defer os.RemoveAll(rootfs)
+	if err := l.unpackRootfs(pm.manifest, rootfs, nil); err != nil {
+		return fail(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	workdir := img.Config.WorkingDir
+	if workdir == "" {
+		workdir = "/"
+	}
+	chrootArgs := []string{"chroot", "--platform", res.Platform, "--workdir", workdir, rootfs, "--"}
+	c := exec.CommandContext(ctx, "/proc/self/exe", append(chrootArgs, cmd...)...)
+	// 镜像的环境变量覆盖宿主机的同名变量，宿主机的 QEMU_* 等设置仍然用于查找模拟器
+	c.Env = append(os.Environ(), img.Config.Env...)
+	var out bytes.Buffer
+	c.Stdout, c.Stderr = &out, &out
+	err = c.Run()
+	res.Output = out.String()
+	if ctx.Err() != nil {
+		err = errors.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	res.OK = true
+	res.Duration = time.Since(start).Round(time.Millisecond).String()
+	return res
+}
+
+// imageCommand 返回要运行的命令：指定的命令，或者镜像配置的 Entrypoint 和 Cmd
+func imageCommand(img ocispecs.Image, cmd []string) ([]string, error) {
+	if len(cmd) > 0 {
+		return cmd, nil
+	}
+	cmd = append(append([]string{}, img.Config.Entrypoint...), img.Config.Cmd...)
+	if len(cmd) == 0 {
+		return nil, errors.New("image has no entrypoint or command, specify a command")
+	}
+	return cmd, nil
+}
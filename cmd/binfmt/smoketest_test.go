@@ -0,0 +1,22 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestImageCommand 测试指定的命令优先于镜像配置的 Entrypoint 和 Cmd
+func TestImageCommand(t *testing.T) {
+	img := ocispecs.Image{Config: ocispecs.ImageConfig{Entrypoint: []string{"/bin/sh", "-c"}, Cmd: []string{"uname -m"}}}
+	if got, _ := imageCommand(img, nil); !reflect.DeepEqual(got, []string{"/bin/sh", "-c", "uname -m"}) {
+		t.Errorf("unexpected command %v", got)
+	}
+	if got, _ := imageCommand(img, []string{"true"}); !reflect.DeepEqual(got, []string{"true"}) {
+		t.Errorf("unexpected command %v", got)
+	}
+	if _, err := imageCommand(ocispecs.Image{}, nil); err == nil {
+		t.Error("expected error for image without a command")
+	}
+}
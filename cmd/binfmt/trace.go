@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// traceSuffix 是跟踪模式下包装程序名称的后缀，与正常的配置区分
+const traceSuffix = "-trace"
+
+// traceSocket 是跟踪目录中收集日志的 Unix 套接字名称
+const traceSocket = ".binfmt-trace.sock"
+
+// traceConfig 结构体：跟踪模式下包装程序使用的配置
+type traceConfig struct {
+	Dir   string `json:"dir"`   // 日志目录，其中的套接字由 binfmt -trace 监听
+	Flags string `json:"flags"` // 传给 QEMU -d 的日志项（如 "strace" 或 "strace,unimp"）
+}
+
+// traceTarget 检查 -trace 与其他参数的组合
+//
+// 返回值:
+//
+//	string: 要跟踪的架构，没有指定 -trace 时为空
+//	error: 如果 -trace 与 -debug、-userns 或 -daemon 同时使用，或没有指定恰好一个架构返回错误
+//
+// 注意:
+//   - 在卸载、持久化、升级或安装之前调用，参数冲突时不修改任何条目
+//   - -userns 模式下剩余参数由 runUserNS 执行，不能同时用作跟踪的命令
+func traceTarget() (string, error) {
+	if traceArch == "" {
+		return "", nil
+	}
+	if debugArch != "" {
+		return "", errors.New("-trace cannot be used with -debug")
+	}
+	if flUserNS {
+		return "", errors.New("-trace cannot be used with -userns")
+	}
+	if flDaemon {
+		return "", errors.New("-trace cannot be used with -daemon")
+	}
+	arch := parseArch(traceArch)
+	if len(arch) != 1 {
+		return "", errors.Errorf("-trace accepts exactly one architecture, got %q", traceArch)
+	}
+	return arch[0], nil
+}
+
+// runTrace 通过跟踪包装程序重新注册一个架构，结束后恢复原来的条目
+//
+// 参数:
+//
+//	arch: 架构名称（如 "arm64"）
+//	args: 要运行的命令，为空时一直跟踪到收到中断信号或 -trace-duration 到期
+//
+// 返回值:
+//
+//	error: 如果注册或恢复失败，或命令运行失败返回错误
+//
+// 工作原理:
+// 1. 在跟踪目录中监听 Unix 套接字，收集每个被模拟进程的日志
+// 2. 通过 wrapHandler 临时替换条目，等待命令结束、中断信号或 -trace-duration 到期
+//
+// 包装程序连接套接字并传递一个管道，QEMU 通过 -D 把日志写入管道，
+// binfmt 把管道中的内容写入 <dir>/<program>-<pid>.log。
+// 每个日志最多写入 -trace-max-size 字节，最多记录 -trace-max-procs 个进程，超过的进程不跟踪。
+// 连接不到套接字时（如程序以其他用户运行且没有指定 -trace-all-users）包装程序不跟踪，直接执行 QEMU。
+//
+// 注意:
+//   - 其他挂载命名空间（如容器）中的程序连接不到跟踪目录中的套接字，照常运行但不跟踪
+func runTrace(arch string, args []string) error {
+	dir, err := filepath.Abs(traceDir)
+	if err != nil {
+		return err
+	}
+	c, err := startTraceCollector(dir, traceMaxSize, traceMaxProcs, traceAllUsers)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	err = wrapHandler("trace", arch, traceSuffix, func(p *profile) {
+		p.Trace = &traceConfig{Dir: dir, Flags: traceFlags}
+	}, func(name string) error {
+		slog.Info("tracing", "action", "trace", "arch", arch, "handler", name, "dir", dir)
+		return waitCommand(args, traceDuration)
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("tracing: restored handler", "action", "trace", "arch", arch, "processes", c.count())
+	return nil
+}
+
+// wrapHandler 临时通过包装程序重新注册一个架构，fn 返回后恢复原来的条目
+//
+// 参数:
+//
+//	mode: 用于错误信息的模式名称（如 "trace"）
+//	arch: 架构名称（如 "arm64"）
+//	suffix: 包装程序名称的后缀，与正常的配置区分
+//	set: 修改包装程序的配置
+//	fn: 包装程序注册后调用，参数为条目名称
+//
+// 返回值:
+//
+//	error: 如果注册或恢复失败返回错误，否则返回 fn 的错误
+//
+// 工作原理:
+// 1. 不中断地将条目替换为包装程序（见 swapEntry）；已经使用 -profile 的条目保留其配置
+// 2. 调用 fn
+// 3. 不中断地恢复原来的条目；原来没有注册时删除条目
+// 4. 删除临时的包装程序
+func wrapHandler(mode, arch, suffix string, set func(*profile), fn func(name string) error) error {
+	normal, err := getRegistration(arch)
+	if err != nil {
+		return err
+	}
+	if normal.embedded != "" {
+		return errors.Errorf("cannot %s %s: embedded emulators cannot be wrapped", mode, arch)
+	}
+	if normal.backend != "" {
+		return errors.Errorf("cannot %s %s: only the qemu backend can be wrapped", mode, arch)
+	}
+	previous, err := previousRegistration(normal)
+	if err != nil {
+		return err
+	}
+
+	wrapped := wrappedRegistration(normal, suffix, set)
+	if previous != nil {
+		err = swapEntry(wrapped)
+	} else {
+		err = registerVerified(wrapped)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "cannot register %s handler for %s", mode, arch)
+	}
+
+	fnErr := fn(normal.name)
+
+	if previous != nil {
+		err = swapEntry(*previous)
+	} else {
+		err = removeEntry(wrapped.name)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "cannot restore handler for %s", arch)
+	}
+	if err := os.Remove(wrapped.interpreter); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "cannot remove %s wrapper for %s", mode, arch)
+	}
+	return fnErr
+}
+
+// wrappedRegistration 返回通过包装程序注册的注册信息
+// 已经使用 -profile 的条目保留其配置
+func wrappedRegistration(r registration, suffix string, set func(*profile)) registration {
+	p := registrationProfile(r)
+	set(&p)
+	r.profile = &p
+	r.interpreter = filepath.Join(profileDir, r.name+suffix)
+	return r
+}
+
+// previousRegistration 返回当前已注册的条目，用于跟踪结束后恢复
+//
+// 返回值:
+//
+//	*registration: 与已注册的条目完全一致的注册信息，条目不存在时为 nil
+//	error: 如果读取条目失败返回错误
+//
+// 注意:
+//   - 通过文件描述符注册的条目无法按路径重新注册，恢复为 normal
+func previousRegistration(normal registration) (*registration, error) {
+	e, err := readEntry(normal.name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isFDInterpreter(e.interpreter) {
+		return &normal, nil
+	}
+	r, err := entryRegistration(e)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// entryRegistration 将已注册的条目转换为可以重新注册的注册信息
+func entryRegistration(e *entry) (registration, error) {
+	magic, err := hex.DecodeString(e.magic)
+	if err != nil {
+		return registration{}, errors.Wrapf(err, "invalid magic in %s", e.name)
+	}
+	mask, err := hex.DecodeString(e.mask)
+	if err != nil {
+		return registration{}, errors.Wrapf(err, "invalid mask in %s", e.name)
+	}
+	return registration{
+		name:        e.name,
+		offset:      e.offset,
+		magic:       escapeBytes(magic),
+		mask:        escapeBytes(mask),
+		interpreter: e.interpreter,
+		flags:       e.flags,
+	}, nil
+}
+
+// escapeBytes 将字节转义为 \xNN 形式，与 configs 中魔数的写法一致
+func escapeBytes(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		fmt.Fprintf(&sb, `\x%02x`, c)
+	}
+	return sb.String()
+}
+
+// waitCommand 运行命令，或者在没有命令时等待中断信号或 timeout 到期
+// timeout 为 0 时不限制时间
+func waitCommand(args []string, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if len(args) == 0 {
+		<-ctx.Done()
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// traceCollector 结构体：接收包装程序传来的管道，把 QEMU 的日志写入文件
+type traceCollector struct {
+	dir      string
+	maxSize  int64
+	maxProcs int
+	ln       *net.UnixListener
+
+	mu      sync.Mutex
+	procs   int
+	readers map[*os.File]struct{}
+	wg      sync.WaitGroup
+}
+
+// startTraceCollector 在日志目录中监听套接字
+// allUsers 为 true 时任何用户的程序都可以连接套接字，否则只有与 binfmt 相同用户的程序会被跟踪
+func startTraceCollector(dir string, maxSize int64, maxProcs int, allUsers bool) (*traceCollector, error) {
+	if err := prepareTraceDir(dir); err != nil {
+		return nil, err
+	}
+	sock := filepath.Join(dir, traceSocket)
+	os.Remove(sock)
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot listen on %s", sock)
+	}
+	mode := os.FileMode(0600)
+	if allUsers {
+		mode = 0666
+	}
+	if err := os.Chmod(sock, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	c := &traceCollector{
+		dir:      dir,
+		maxSize:  maxSize,
+		maxProcs: maxProcs,
+		ln:       ln,
+		readers:  map[*os.File]struct{}{},
+	}
+	c.wg.Add(1)
+	go c.serve()
+	return c, nil
+}
+
+// prepareTraceDir 创建日志目录，并检查其他用户无法替换其中的套接字和日志
+//
+// 目录必须是当前用户（通常为 root）拥有的真实目录，不能是符号链接，组和其他用户不能写入。
+// binfmt 以 root 身份在其中创建套接字和日志，可写的目录会让其他用户把日志重定向到任意文件。
+func prepareTraceDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return errors.Errorf("trace directory %s must not be a symlink", dir)
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("trace directory %s is not a directory", dir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Geteuid() {
+		return errors.Errorf("trace directory %s must be owned by uid %d", dir, os.Geteuid())
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return errors.Errorf("trace directory %s must not be writable by group or others", dir)
+	}
+	return nil
+}
+
+func (c *traceCollector) serve() {
+	defer c.wg.Done()
+	for {
+		conn, err := c.ln.AcceptUnix()
+		if err != nil {
+			return
+		}
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.handle(conn)
+		}()
+	}
+}
+
+// handle 接收一个包装程序的管道，达到进程数上限时拒绝
+func (c *traceCollector) handle(conn *net.UnixConn) {
+	defer conn.Close()
+	buf := make([]byte, 256)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return
+	}
+	r, err := receiveFile(oob[:oobn])
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	c.mu.Lock()
+	ok := c.readers != nil && (c.maxProcs <= 0 || c.procs < c.maxProcs)
+	if ok {
+		c.procs++
+		c.readers[r] = struct{}{}
+	}
+	c.mu.Unlock()
+	if !ok {
+		conn.Write([]byte{'n'})
+		return
+	}
+	defer func() {
+		c.mu.Lock()
+		delete(c.readers, r)
+		c.mu.Unlock()
+	}()
+
+	name := filepath.Base(string(buf[:n]))
+	f, err := os.OpenFile(filepath.Join(c.dir, name+".log"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		conn.Write([]byte{'n'})
+		return
+	}
+	defer f.Close()
+	if _, err := conn.Write([]byte{'y'}); err != nil {
+		return
+	}
+	copyLimited(f, r, c.maxSize)
+}
+
+// receiveFile 从控制消息中取出传来的文件描述符
+func receiveFile(oob []byte) (*os.File, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, errors.New("expected one control message")
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		return nil, errors.New("expected one file descriptor")
+	}
+	return os.NewFile(uintptr(fds[0]), "trace"), nil
+}
+
+// copyLimited 最多复制 max 字节，之后丢弃剩余的内容，使 QEMU 写入管道时不会阻塞
+// max 为 0 时不限制
+func copyLimited(w io.Writer, r io.Reader, max int64) {
+	if max <= 0 {
+		io.Copy(w, r)
+		return
+	}
+	if _, err := io.CopyN(w, r, max); err != nil {
+		return
+	}
+	fmt.Fprintf(w, "\n[binfmt: log truncated at %d bytes]\n", max)
+	io.Copy(io.Discard, r)
+}
+
+// count 返回已跟踪的进程数
+func (c *traceCollector) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.procs
+}
+
+// close 停止接收新的进程，关闭所有管道并等待日志写完
+func (c *traceCollector) close() {
+	c.ln.Close()
+	c.mu.Lock()
+	for r := range c.readers {
+		r.Close()
+	}
+	c.readers = nil
+	c.mu.Unlock()
+	c.wg.Wait()
+}
+
+// traceArgs 在包装程序中连接 binfmt -trace 的套接字，返回让 QEMU 写入日志的参数
+//
+// 参数:
+//
+//	t: 跟踪配置
+//	program: 要运行的程序路径，用于日志文件名称
+//
+// 返回值:
+//
+//	[]string: QEMU 的 -d 和 -D 参数，不跟踪时为空
+//
+// 注意:
+//   - 管道的写入端以不带 CLOEXEC 的文件描述符传给 QEMU，被模拟的程序也会继承它
+//   - 连接失败或达到进程数上限时不跟踪，程序照常运行
+func traceArgs(t *traceConfig, program string) []string {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: filepath.Join(t.Dir, traceSocket), Net: "unix"})
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil
+	}
+	defer pw.Close()
+	name := fmt.Sprintf("%s-%d", filepath.Base(program), os.Getpid())
+	_, _, err = conn.WriteMsgUnix([]byte(name), unix.UnixRights(int(pr.Fd())), nil)
+	pr.Close()
+	if err != nil {
+		return nil
+	}
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[0] != 'y' {
+		return nil
+	}
+	fd, err := unix.Dup(int(pw.Fd()))
+	if err != nil {
+		return nil
+	}
+	return []string{"-d", t.Flags, "-D", procSelfFD + strconv.Itoa(fd)}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestEntryRegistration 测试已注册的条目可以转换回等效的注册信息
+func TestEntryRegistration(t *testing.T) {
+	newFakeFS(t, true)
+	fakeInterpreters(t, "arm64")
+	if err := install("arm64"); err != nil {
+		t.Fatal(err)
+	}
+	e, err := readEntry("qemu-aarch64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := entryRegistration(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.matches(r) {
+		t.Fatalf("registration %+v does not match entry %+v", r, e)
+	}
+}
+
+// TestTraceCollector 测试包装程序通过套接字传递日志管道，以及日志大小和进程数的限制
+func TestTraceCollector(t *testing.T) {
+	dir := t.TempDir()
+	c, err := startTraceCollector(dir, 16, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	// 默认只有相同用户的程序可以连接套接字
+	if fi, err := os.Stat(filepath.Join(dir, traceSocket)); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket mode %v: %v", fi.Mode(), err)
+	}
+
+	args := traceArgs(&traceConfig{Dir: dir, Flags: "strace"}, "/bin/ls")
+	if len(args) != 4 || args[0] != "-d" || args[1] != "strace" || args[2] != "-D" || !strings.HasPrefix(args[3], procSelfFD) {
+		t.Fatalf("unexpected args %v", args)
+	}
+	w, err := os.OpenFile(args[3], os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteString(strings.Repeat("x", 32)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	// traceArgs 复制的写入端留给 QEMU 继承，这里需要自己关闭
+	fd, err := strconv.Atoi(strings.TrimPrefix(args[3], procSelfFD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(fd)
+
+	// 达到进程数上限后不再跟踪
+	if args := traceArgs(&traceConfig{Dir: dir, Flags: "strace"}, "/bin/ls"); args != nil {
+		t.Fatalf("expected no tracing over the process limit, got %v", args)
+	}
+
+	logFile := filepath.Join(dir, fmt.Sprintf("ls-%d.log", os.Getpid()))
+	var dt []byte
+	for i := 0; i < 100; i++ {
+		dt, _ = os.ReadFile(logFile)
+		if strings.Contains(string(dt), "truncated") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.HasPrefix(string(dt), strings.Repeat("x", 16)+"\n[binfmt: log truncated at 16 bytes]") {
+		t.Fatalf("unexpected log %q", dt)
+	}
+	if c.count() != 1 {
+		t.Fatalf("expected one traced process, got %d", c.count())
+	}
+}
+
+// TestPrepareTraceDir 测试拒绝符号链接、其他用户拥有或可写的日志目录
+func TestPrepareTraceDir(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "trace")
+	if err := prepareTraceDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	c, err := startTraceCollector(dir, 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, traceSocket)); err != nil || fi.Mode().Perm() != 0666 {
+		t.Errorf("unexpected socket mode %v: %v", fi.Mode(), err)
+	}
+	c.close()
+
+	link := filepath.Join(base, "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := prepareTraceDir(link); err == nil || !strings.Contains(err.Error(), "symlink") {
+		t.Errorf("expected symlink error, got %v", err)
+	}
+
+	writable := filepath.Join(base, "writable")
+	if err := os.Mkdir(writable, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(writable, 01777); err != nil {
+		t.Fatal(err)
+	}
+	if err := prepareTraceDir(writable); err == nil || !strings.Contains(err.Error(), "writable") {
+		t.Errorf("expected writable error, got %v", err)
+	}
+
+	if os.Geteuid() != 0 {
+		return
+	}
+	owned := filepath.Join(base, "owned")
+	if err := os.Mkdir(owned, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(owned, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	if err := prepareTraceDir(owned); err == nil || !strings.Contains(err.Error(), "owned by") {
+		t.Errorf("expected owner error, got %v", err)
+	}
+}
+
+// TestTraceTarget 测试 -trace 的参数冲突在安装、卸载等修改之前就被拒绝
+func TestTraceTarget(t *testing.T) {
+	defer func(trace, debug, install, uninstall string, userns, daemon bool) {
+		traceArch, debugArch, toInstall, toUninstall, flUserNS, flDaemon = trace, debug, install, uninstall, userns, daemon
+	}(traceArch, debugArch, toInstall, toUninstall, flUserNS, flDaemon)
+
+	tests := []struct {
+		trace     string
+		debug     string
+		userns    bool
+		daemon    bool
+		expectErr string
+	}{
+		{trace: "arm64", debug: "arm64", expectErr: "cannot be used with -debug"},
+		{trace: "arm64", userns: true, expectErr: "cannot be used with -userns"},
+		{trace: "arm64", daemon: true, expectErr: "cannot be used with -daemon"},
+		{trace: "arm64,riscv64", expectErr: "exactly one architecture"},
+	}
+	for _, tc := range tests {
+		f := newFakeFS(t, true)
+		fakeInterpreters(t, "arm64", "riscv64")
+		if err := install("riscv64"); err != nil {
+			t.Fatal(err)
+		}
+		traceArch, debugArch, flUserNS, flDaemon = tc.trace, tc.debug, tc.userns, tc.daemon
+		toInstall, toUninstall = "arm64", "riscv64"
+
+		if _, err := traceTarget(); err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+			t.Errorf("%+v: expected error %q, got %v", tc, tc.expectErr, err)
+		}
+		// 同时指定的 -install 和 -uninstall 不会被执行
+		if err := run(); err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+			t.Errorf("%+v: expected error %q from run, got %v", tc, tc.expectErr, err)
+		}
+		if got := f.names(); len(got) != 1 || got[0] != "qemu-riscv64" {
+			t.Errorf("%+v: expected entries to be unchanged, got %v", tc, got)
+		}
+	}
+
+	traceArch, debugArch, flUserNS, flDaemon = "arm64", "", false, false
+	if arch, err := traceTarget(); err != nil || arch != "arm64" {
+		t.Fatalf("unexpected target %q %v", arch, err)
+	}
+}
+
+// TestRunTrace 测试跟踪期间注册跟踪包装程序，结束后恢复条目并删除包装程序的链接和配置文件
+func TestRunTrace(t *testing.T) {
+	defer func(dir, tdir string, d time.Duration) {
+		profileDir, traceDir, traceDuration = dir, tdir, d
+	}(profileDir, traceDir, traceDuration)
+	profileDir = t.TempDir()
+	traceDir = t.TempDir()
+	traceDuration = time.Millisecond
+
+	f := newFakeFS(t, true)
+	dir := fakeInterpreters(t, "arm64", "riscv64")
+	if err := install("arm64"); err != nil {
+		t.Fatal(err)
+	}
+
+	traced := filepath.Join(profileDir, "qemu-aarch64"+traceSuffix)
+	var interpreters []string
+	var p *profile
+	f.afterWrite = func() {
+		if e, ok := f.entry("qemu-aarch64"); ok {
+			interpreters = append(interpreters, e.interpreter)
+			if e.interpreter == traced {
+				p, _ = readProfile(traced)
+			}
+		}
+	}
+	if err := runTrace("arm64", nil); err != nil {
+		t.Fatal(err)
+	}
+	f.afterWrite = nil
+
+	var sawTraced bool
+	for _, p := range interpreters {
+		sawTraced = sawTraced || p == traced
+	}
+	if !sawTraced {
+		t.Fatalf("tracing handler never registered, saw %v", interpreters)
+	}
+	if p == nil || p.Trace == nil || p.Trace.Dir != traceDir || p.Interpreter != filepath.Join(dir, "qemu-aarch64") {
+		t.Fatalf("unexpected trace profile %+v", p)
+	}
+	if e, _ := f.entry("qemu-aarch64"); e.interpreter != filepath.Join(dir, "qemu-aarch64") {
+		t.Fatalf("handler not restored: %+v", e)
+	}
+	if _, err := os.Lstat(traced); !os.IsNotExist(err) {
+		t.Errorf("%s left behind after tracing: %v", traced, err)
+	}
+
+	// 原来没有注册的架构在跟踪结束后删除
+	if err := runTrace("riscv64", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.entry("qemu-riscv64"); ok {
+		t.Fatal("qemu-riscv64 left registered after tracing")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// upgradeSuffix 是升级期间临时条目名称的后缀
+// 使用后缀而不是前缀，使临时条目（如 "qemu-aarch64.upgrade"）不会被
+// uninstall 等按 "-"+arch 后缀查找条目的代码当作该架构的条目
+const upgradeSuffix = ".upgrade"
+
+// upgrade 不中断地将架构的模拟器替换为当前的解释器
+//
+// 参数:
+//
+//	arch: 架构名称（如 "arm64"）
+//
+// 返回值:
+//
+//	error: 如果升级失败返回错误
+//
+// 工作原理:
+// 1. 以临时名称（如 "qemu-aarch64.upgrade"）注册新的解释器
+// 2. 删除旧的条目
+// 3. 以原来的名称重新注册新的解释器
+// 4. 删除临时条目
+//
+// 内核按照从新到旧的顺序匹配条目，所以在整个过程中，
+// 任何时刻都至少有一个已启用的条目可以处理该架构的程序，不会出现 "exec format error"。
+// 每一步之后都会读取条目确认结果。
+//
+// 注意:
+//   - 由于使用 F 标志，旧的解释器在条目被删除之前一直被内核持有，
+//     即使解释器文件已经在磁盘上被替换，也需要重新注册才会使用新的文件
+//   - 第 3 步失败时临时条目会保留，保证程序仍然可以执行
+//   - 条目不存在时直接注册
+//   - -install-policy 决定替换已有的条目时也使用同样的方式
+func upgrade(arch string) error {
+	r, err := getRegistration(arch)
+	if err != nil {
+		return err
+	}
+
+	if _, err := readEntry(r.name); errors.Is(err, os.ErrNotExist) {
+		return register(r)
+	} else if err != nil {
+		return err
+	}
+	return swapEntry(r)
+}
+
+// swapEntry 通过临时条目将已有的条目替换为新的注册信息，替换过程中条目始终可用
+func swapEntry(r registration) error {
+	tmp := r
+	tmp.name = r.name + upgradeSuffix
+
+	// 清理上一次升级中断时留下的临时条目
+	if err := removeEntry(tmp.name); err != nil {
+		return err
+	}
+
+	if err := registerVerified(tmp); err != nil {
+		return errors.Wrapf(err, "cannot register temporary entry %s", tmp.name)
+	}
+	if err := removeEntry(r.name); err != nil {
+		return err
+	}
+	if err := registerVerified(r); err != nil {
+		return errors.Wrapf(err, "cannot re-register %s, temporary entry %s left in place", r.name, tmp.name)
+	}
+	return removeEntry(tmp.name)
+}
+
+// registerVerified 注册条目并确认内核中的条目与注册信息一致且已启用
+func registerVerified(r registration) error {
+	if err := register(r); err != nil {
+		return err
+	}
+	e, err := readEntry(r.name)
+	if err != nil {
+		return err
+	}
+	if !e.matches(r) {
+		return errors.Errorf("%s registered with unexpected interpreter %s flags %s", r.name, e.interpreter, e.flags)
+	}
+	if !e.enabled {
+		if err := writeEntry(r.name, "1"); err != nil {
+			return errors.Wrapf(err, "cannot enable %s", r.name)
+		}
+	}
+	return nil
+}
+
+// removeEntry 删除条目并确认条目已不存在，条目本来就不存在时不返回错误
+func removeEntry(name string) error {
+	if err := writeEntry(name, "-1"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "cannot remove %s", name)
+	}
+	if _, err := readEntry(name); !errors.Is(err, os.ErrNotExist) {
+		if err == nil {
+			return errors.Errorf("%s still registered after removal", name)
+		}
+		return err
+	}
+	return nil
+}
+
+// registeredArch 返回已经注册了模拟器的所有架构，用于 -upgrade all
+func registeredArch() []string {
+	var out []string
+	for name := range configs {
+		cfg, err := archConfig(name)
+		if err != nil {
+			continue
+		}
+		binaryBasename, _, err := getBinaryNames(cfg)
+		if err != nil {
+			continue
+		}
+		if _, err := fsys.Stat(filepath.Join(mount, binaryBasename)); err == nil {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestUpgrade 测试升级过程中每次写入之后都有可以处理程序的条目，最后只剩下新的条目
+func TestUpgrade(t *testing.T) {
+	f := newFakeFS(t, true)
+	dir := fakeInterpreters(t, "arm64")
+	if err := install("arm64"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 每次写入之后都必须至少有一个已启用的条目可以处理 arm64 程序
+	var steps []string
+	f.afterWrite = func() {
+		names := f.names()
+		steps = append(steps, strings.Join(names, ","))
+		for _, name := range names {
+			if e, ok := f.entry(name); ok && !e.disabled && strings.HasPrefix(name, "qemu-aarch64") {
+				return
+			}
+		}
+		t.Errorf("no handler for arm64 after write, entries %v", names)
+	}
+
+	// 模拟解释器在磁盘上被替换，路径不变
+	if err := os.WriteFile(filepath.Join(dir, "qemu-aarch64"), []byte("#!/bin/sh\n# new\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := upgrade("arm64"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"qemu-aarch64,qemu-aarch64.upgrade",
+		"qemu-aarch64.upgrade",
+		"qemu-aarch64,qemu-aarch64.upgrade",
+		"qemu-aarch64",
+	}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Fatalf("unexpected steps %q", steps)
+	}
+
+	// 未注册的架构直接注册
+	fakeInterpreters(t, "riscv64")
+	f.afterWrite = nil
+	if err := upgrade("riscv64"); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.names(); !reflect.DeepEqual(got, []string{"qemu-aarch64", "qemu-riscv64"}) {
+		t.Fatalf("unexpected entries %v", got)
+	}
+}
+
+// TestUpgradeKeepsTemporaryEntry 测试无法重新注册时保留临时条目，程序仍然可以运行
+func TestUpgradeKeepsTemporaryEntry(t *testing.T) {
+	f := newFakeFS(t, true)
+	dir := fakeInterpreters(t, "arm64")
+	if err := install("arm64"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 删除旧条目之后解释器消失，重新注册会失败
+	f.afterWrite = func() {
+		if _, ok := f.entry("qemu-aarch64"); !ok {
+			os.Remove(filepath.Join(dir, "qemu-aarch64"))
+		}
+	}
+	err := upgrade("arm64")
+	if err == nil || !strings.Contains(err.Error(), "qemu-aarch64.upgrade left in place") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got := f.names(); !reflect.DeepEqual(got, []string{"qemu-aarch64.upgrade"}) {
+		t.Fatalf("unexpected entries %v", got)
+	}
+}
+
+// TestUninstallSkipsTemporaryEntry 测试按架构卸载时不会把升级的临时条目当作该架构的条目
+func TestUninstallSkipsTemporaryEntry(t *testing.T) {
+	f := newFakeFS(t, true)
+	fakeInterpreters(t, "arm64")
+	r, err := getRegistration("arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := r
+	tmp.name = r.name + upgradeSuffix
+	for _, r := range []registration{tmp, r} {
+		if err := register(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := uninstall("aarch64"); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.names(); !reflect.DeepEqual(got, []string{"qemu-aarch64.upgrade"}) {
+		t.Fatalf("unexpected entries %v", got)
+	}
+	if _, _, ok := entryBackend(tmp.name); ok {
+		t.Errorf("temporary entry %s matched a backend", tmp.name)
+	}
+}
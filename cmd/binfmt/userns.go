@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// usernsChildEnv 是在新的用户命名空间中重新执行自身时设置的环境变量
+const usernsChildEnv = "BINFMT_USERNS_CHILD"
+
+// instance 结构体：描述被检查的 binfmt_misc 实例
+//
+// Linux 6.7 起，在非初始用户命名空间中挂载的 binfmt_misc 是该命名空间独有的实例，
+// 在其中注册的模拟器不会影响宿主机的全局表。
+type instance struct {
+	Mount      string `json:"mount"`               // 实例的挂载点
+	UserNS     string `json:"userns"`              // 实例所属的用户命名空间（如 "user:[4026531837]"）
+	Namespaced bool   `json:"namespaced"`          // 是否为用户命名空间独有的实例
+	PID        int    `json:"pid,omitempty"`       // 通过 -pid 指定的目标进程
+	ReadOnly   bool   `json:"readonly,omitempty"`  // 挂载点是否为只读挂载
+	Unmounted  bool   `json:"unmounted,omitempty"` // 只查询状态时挂载点上没有挂载 binfmt_misc
+}
+
+// mountedNamespaced 为 true 表示本进程在非初始用户命名空间中挂载了 binfmt_misc
+// 在用户命名空间中挂载得到的总是该命名空间独有的实例（Linux 6.7 之前的内核不允许这样挂载）
+var mountedNamespaced bool
+
+// detectInstance 检测 -mount 指定的挂载点属于哪个 binfmt_misc 实例
+//
+// 返回值:
+//
+//	instance: 实例信息
+//
+// 工作原理:
+//   - 读取目标进程（-pid 指定的进程或自身）的 /proc/<pid>/ns/user 获取用户命名空间
+//   - 是否为独有的实例由挂载本身决定，而不是由进程所在的用户命名空间决定：
+//     从父命名空间继承的全局实例，以及 6.7 之前的内核上的挂载，都不是独有的实例
+func detectInstance() instance {
+	proc := "self"
+	if targetPID != 0 {
+		proc = strconv.Itoa(targetPID)
+	}
+	inst := instance{Mount: mount, PID: targetPID, Unmounted: targetPID == 0 && statusUnmounted}
+	if ns, err := os.Readlink(filepath.Join("/proc", proc, "ns/user")); err == nil {
+		inst.UserNS = ns
+	}
+	inst.Namespaced = targetPID == 0 && mountedNamespaced
+	if !inst.Namespaced {
+		inst.Namespaced = isNamespacedMount(mount)
+	}
+	if targetPID == 0 {
+		if mi, err := findMount(mount); err == nil && mi != nil {
+			inst.ReadOnly = mi.readOnly
+		}
+	}
+	return inst
+}
+
+// isNamespacedMount 比较挂载点上的实例与初始用户命名空间中的全局实例的设备号
+//
+// 参数:
+//
+//	p: binfmt_misc 挂载点
+//
+// 返回值:
+//
+//	bool: 设备号与全局实例不同时为 true
+//
+// 注意:
+//   - 每个 binfmt_misc 实例有自己的超级块和匿名设备号，同一个实例的所有挂载设备号相同
+//   - 直接检查内核中的挂载，挂载点不是 binfmt_misc 时返回 false
+//   - 全局实例从 PID 1 的 mountinfo 中读取，只有 PID 1 在初始用户命名空间中时才可信
+//   - 无法确定全局实例时（如在有独立 PID 命名空间的容器中）返回 false，
+//     避免在注册实际影响宿主机全局表时报告为独有的实例
+func isNamespacedMount(p string) bool {
+	var sfs unix.Statfs_t
+	if err := unix.Statfs(p, &sfs); err != nil || sfs.Type != unix.BINFMTFS_MAGIC {
+		return false
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(p, &st); err != nil {
+		return false
+	}
+	uidMap, err := os.ReadFile("/proc/1/uid_map")
+	if err != nil {
+		return false
+	}
+	mountInfo, err := os.ReadFile("/proc/1/mountinfo")
+	if err != nil {
+		return false
+	}
+	return namespacedDevice(st.Dev, string(uidMap), mountInfo)
+}
+
+// namespacedDevice 判断设备号是否属于全局实例以外的 binfmt_misc 实例
+//
+// 参数:
+//
+//	dev: 挂载点上实例的设备号
+//	initUIDMap: PID 1 的 uid_map
+//	initMountInfo: PID 1 的 mountinfo
+//
+// 返回值:
+//
+//	bool: PID 1 在初始用户命名空间中、挂载了全局实例且设备号不同时为 true
+func namespacedDevice(dev uint64, initUIDMap string, initMountInfo []byte) bool {
+	if !isInitialUIDMap(initUIDMap) {
+		return false
+	}
+	var global []string
+	s := bufio.NewScanner(bytes.NewReader(initMountInfo))
+	for s.Scan() {
+		if mi, ok := parseMountInfoLine(s.Text()); ok && mi.fsType == "binfmt_misc" {
+			global = append(global, mi.dev)
+		}
+	}
+	if len(global) == 0 {
+		return false
+	}
+	d := fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev))
+	for _, g := range global {
+		if g == d {
+			return false
+		}
+	}
+	return true
+}
+
+// isInitialUIDMap 判断 uid_map 的内容是否为初始用户命名空间的恒等映射
+func isInitialUIDMap(dt string) bool {
+	return strings.Join(strings.Fields(dt), " ") == "0 0 4294967295"
+}
+
+// inInitialUserNS 判断当前进程是否在初始用户命名空间中，无法判断时视为是
+func inInitialUserNS() bool {
+	dt, err := os.ReadFile("/proc/self/uid_map")
+	return err != nil || isInitialUIDMap(string(dt))
+}
+
+// targetMount 返回 -pid 指定的进程所看到的挂载点路径
+//
+// 参数:
+//
+//	pid: 目标进程 ID
+//	p: 目标进程中的挂载点路径
+//
+// 返回值:
+//
+//	string: 通过 /proc/<pid>/root 访问的路径
+//
+// 注意:
+//   - Go 程序是多线程的，无法通过 setns 进入其他进程的用户和挂载命名空间
+//   - 通过 /proc/<pid>/root 访问的文件属于目标进程的挂载命名空间，
+//     写入其中的 register 文件会注册到目标进程所在的 binfmt_misc 实例
+//   - 由于使用 F 标志，解释器在注册时在当前进程中打开，所以解释器路径相对于当前进程解析
+func targetMount(pid int, p string) string {
+	return filepath.Join("/proc", strconv.Itoa(pid), "root", p)
+}
+
+// runUserNS 在新的用户命名空间中运行 binfmt
+//
+// 返回值:
+//
+//	error: 如果运行失败返回错误
+//
+// 工作原理:
+// 1. 父进程以 CLONE_NEWUSER|CLONE_NEWNS 重新执行自身，将当前用户映射为命名空间中的 root
+// 2. 子进程在新的挂载命名空间中挂载一个新的 binfmt_misc 实例
+// 3. 子进程执行正常的安装、卸载和状态输出
+// 4. 如果命令行中有剩余参数，子进程在同一个命名空间中执行它们
+//
+// 示例:
+//
+//	binfmt -userns -install arm64 -- make test
+//
+// 注意:
+//   - 需要 Linux 6.7 或更高版本的内核，旧内核不允许在用户命名空间中挂载 binfmt_misc
+//   - 注册只在命名空间存在期间有效，不会影响宿主机的全局表
+func runUserNS() error {
+	if os.Getenv(usernsChildEnv) == "" {
+		cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		cmd.Env = append(os.Environ(), usernsChildEnv+"=1")
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+			UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Geteuid(), Size: 1}},
+			GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}},
+		}
+		if err := cmd.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.ExitCode())
+			}
+			return errors.Wrap(err, "cannot create user namespace")
+		}
+		return nil
+	}
+
+	// 子进程：避免挂载事件传播到父命名空间
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return errors.Wrap(err, "cannot make mounts private")
+	}
+	// 总是挂载新的实例，即使挂载点上已经有从父命名空间继承的全局实例
+	if err := mountBinfmt(); err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			return errors.Wrap(err, "binfmt_misc in user namespaces requires Linux 6.7+")
+		}
+		return err
+	}
+
+	if err := run(); err != nil {
+		return err
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		return nil
+	}
+	p, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	env := make([]string, 0, len(os.Environ()))
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, usernsChildEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	return syscall.Exec(p, args, env)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestIsInitialUIDMap 测试识别初始用户命名空间的恒等映射
+func TestIsInitialUIDMap(t *testing.T) {
+	for dt, expected := range map[string]bool{
+		"         0          0 4294967295\n": true,
+		"0 0 4294967295":                     true,
+		"0 1000 1\n":                         false,
+		"0 0 1\n":                            false,
+		"":                                   false,
+	} {
+		if got := isInitialUIDMap(dt); got != expected {
+			t.Errorf("%q: expected %v, got %v", dt, expected, got)
+		}
+	}
+}
+
+// TestNamespacedDevice 测试通过设备号与全局实例比较判断是否为独有的实例
+func TestNamespacedDevice(t *testing.T) {
+	const initial = "0 0 4294967295\n"
+	initMountInfo := []byte("22 1 0:21 / /proc rw - proc proc rw\n" +
+		"36 22 0:30 / /proc/sys/fs/binfmt_misc rw,relatime - binfmt_misc binfmt_misc rw\n")
+
+	tests := []struct {
+		name      string
+		dev       uint64
+		uidMap    string
+		mountInfo []byte
+		expected  bool
+	}{
+		// 从宿主机继承的全局实例，即使进程在用户命名空间中也不是独有的
+		{name: "global", dev: unix.Mkdev(0, 30), uidMap: initial, mountInfo: initMountInfo},
+		{name: "namespaced", dev: unix.Mkdev(0, 52), uidMap: initial, mountInfo: initMountInfo, expected: true},
+		// PID 1 不在初始用户命名空间中，无法确定全局实例
+		{name: "container init", dev: unix.Mkdev(0, 52), uidMap: "0 100000 65536\n", mountInfo: initMountInfo},
+		// 宿主机没有挂载 binfmt_misc
+		{name: "no global mount", dev: unix.Mkdev(0, 52), uidMap: initial, mountInfo: initMountInfo[:strings.Index(string(initMountInfo), "\n")+1]},
+	}
+	for _, tc := range tests {
+		if got := namespacedDevice(tc.dev, tc.uidMap, tc.mountInfo); got != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+// TestDetectInstance 测试不是 binfmt_misc 的挂载点不会被报告为独有的实例
+func TestDetectInstance(t *testing.T) {
+	newFakeFS(t, true)
+	defer func(old bool) { mountedNamespaced = old }(mountedNamespaced)
+
+	mountedNamespaced = false
+	inst := detectInstance()
+	if inst.Mount != mount || inst.Namespaced {
+		t.Fatalf("unexpected instance %+v", inst)
+	}
+	if _, err := os.Readlink("/proc/self/ns/user"); err == nil && inst.UserNS == "" {
+		t.Errorf("expected user namespace in %+v", inst)
+	}
+
+	// 在用户命名空间中挂载的实例总是独有的
+	mountedNamespaced = true
+	if inst := detectInstance(); !inst.Namespaced {
+		t.Fatalf("expected namespaced instance, got %+v", inst)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/containerd/platforms"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	archvariant "github.com/tonistiigi/go-archvariant"
+)
+
+// variantCPU 结构体：平台变体和提供该变体的 QEMU CPU 型号
+type variantCPU struct {
+	variant string
+	cpu     string // 为空时表示 QEMU 默认的 CPU 型号已经提供该变体
+}
+
+// variantCPUs 映射：每个架构可以安装的变体，按从低到高的顺序排列
+//
+// 一个 CPU 型号提供它对应的最高变体以及所有更低的变体。
+// 架构的默认变体（如 amd64/v1、arm64/v8）不需要修改 CPU 型号，因此不在这里列出；
+// arm/v7 是 arm 的默认变体，列出它用于判断默认 CPU 型号支持的变体。
+var variantCPUs = map[string][]variantCPU{
+	// QEMU 7.2 起 TCG 支持 AVX2 等 x86-64-v3 需要的指令，max 型号提供这些特性
+	"amd64": {
+		{variant: "v2", cpu: "max"},
+		{variant: "v3", cpu: "max"},
+	},
+	"arm": {
+		{variant: "v5", cpu: "arm926"},
+		{variant: "v6", cpu: "arm1176"},
+		{variant: "v7", cpu: ""},
+		{variant: "v8", cpu: "max"},
+	},
+	// qemu-aarch64 的默认型号就是 max，这里显式指定以免被其他设置覆盖
+	"arm64": {
+		{variant: "v8.1", cpu: "max"},
+		{variant: "v8.2", cpu: "max"},
+		{variant: "v8.3", cpu: "max"},
+		{variant: "v8.4", cpu: "max"},
+		{variant: "v8.5", cpu: "max"},
+		{variant: "v8.6", cpu: "max"},
+		{variant: "v8.7", cpu: "max"},
+		{variant: "v9", cpu: "max"},
+	},
+}
+
+// baseVariants 映射：架构的基础变体，任何 CPU 型号都提供它，用于在状态中报告完整的变体列表
+var baseVariants = map[string]string{
+	"amd64": "v1",
+	"arm64": "v8",
+}
+
+// unsupportedVariants 映射：QEMU 无法模拟的变体及其原因
+var unsupportedVariants = map[string]string{
+	"amd64/v4": "AVX-512 is not emulated by QEMU",
+}
+
+// platformVariant 结构体：平台支持的变体，用于在状态中报告
+type platformVariant struct {
+	Platform string   `json:"platform"`           // 平台（如 "linux/amd64"）
+	Emulator string   `json:"emulator,omitempty"` // 模拟执行时的条目名称，原生执行时为空
+	Variants []string `json:"variants"`           // 支持的变体，从低到高排列
+}
+
+// installVariants 映射：-install 和 -upgrade 中指定了变体的架构
+// 在 run 中根据命令行参数填写
+var installVariants map[string]string
+
+// parseVariants 从架构列表中提取明确指定的变体
+//
+// 参数:
+//
+//	in: 用 "," 分隔的平台列表（如 "linux/amd64/v3,arm64"）
+//
+// 返回值:
+//
+//	map[string]string: 架构到变体的映射，只包含与架构默认变体不同的变体
+//	error: 如果同一个架构指定了不同的变体返回错误
+//
+// 注意:
+//   - 平台按 containerd 的规则规范化，例如 amd64/v1 和 arm64/v8 等同于没有指定变体，
+//     arm 的默认变体是 v7
+func parseVariants(in string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, v := range strings.Split(in, ",") {
+		p, err := platforms.Parse(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		p = platforms.Normalize(p)
+		if p.Variant == defaultVariant(p.Architecture) {
+			continue
+		}
+		if prev, ok := out[p.Architecture]; ok && prev != p.Variant {
+			return nil, errors.Errorf("conflicting variants %s and %s for %s", prev, p.Variant, p.Architecture)
+		}
+		out[p.Architecture] = p.Variant
+	}
+	return out, nil
+}
+
+// defaultVariant 返回架构规范化后的默认变体（如 arm 为 "v7"，其他大多数架构为空）
+func defaultVariant(arch string) string {
+	return platforms.Normalize(ocispecs.Platform{OS: "linux", Architecture: arch}).Variant
+}
+
+// variantCPUFor 返回提供架构变体的 QEMU CPU 型号
+//
+// 参数:
+//
+//	arch: 架构名称（如 "amd64"）
+//	variant: 变体（如 "v3"）
+//
+// 返回值:
+//
+//	string: CPU 型号，为空时表示使用 QEMU 默认的型号
+//	error: 如果 QEMU 无法提供该变体返回错误
+func variantCPUFor(arch, variant string) (string, error) {
+	if reason, ok := unsupportedVariants[arch+"/"+variant]; ok {
+		return "", errors.Errorf("cannot install %s/%s: %s", arch, variant, reason)
+	}
+	for _, vc := range variantCPUs[arch] {
+		if vc.variant == variant {
+			return vc.cpu, nil
+		}
+	}
+	return "", errors.Errorf("unsupported variant %s/%s", arch, variant)
+}
+
+// variantsForCPU 返回 CPU 型号提供的所有变体，包括架构的基础变体（如 amd64/v1）
+// CPU 型号不在 variantCPUs 中时返回 nil
+func variantsForCPU(arch, cpu string) []string {
+	list := variantCPUs[arch]
+	rank := -1
+	for i, vc := range list {
+		if vc.cpu == cpu {
+			rank = i
+		}
+	}
+	if rank < 0 {
+		return nil
+	}
+	out := make([]string, 0, rank+2)
+	if base, ok := baseVariants[arch]; ok {
+		out = append(out, base)
+	}
+	for _, vc := range list[:rank+1] {
+		out = append(out, vc.variant)
+	}
+	return out
+}
+
+// getPlatformVariants 收集原生和模拟执行的平台支持的变体
+//
+// 参数:
+//
+//	st: getStatus 收集的状态
+//
+// 返回值:
+//
+//	[]platformVariant: 每个平台支持的变体，没有变体信息的平台不包含在内
+//
+// 工作原理:
+//   - 原生的 amd64 通过 go-archvariant 检测 CPU 支持的级别
+//   - 模拟执行的平台根据条目配置中的 QEMU_CPU 确定变体，没有配置时使用 archutil 检测到的变体
+func getPlatformVariants(st *status) []platformVariant {
+	var out []platformVariant
+	if runtime.GOARCH == "amd64" {
+		var variants []string
+		level := archvariant.AMD64Variant()
+		for _, v := range []string{"v1", "v2", "v3", "v4"} {
+			variants = append(variants, v)
+			if v == level {
+				break
+			}
+		}
+		out = append(out, platformVariant{Platform: "linux/amd64", Variants: variants})
+	}
+
+	cpus := map[string]string{}
+	for _, hp := range st.Profiles {
+		cpus[hp.Name] = hp.Env["QEMU_CPU"]
+	}
+	seen := map[string]struct{}{}
+	for _, pm := range classifyPlatforms(st) {
+		if pm.mode != modeEmulated {
+			continue
+		}
+		p, err := platforms.Parse(pm.platform)
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[p.Architecture]; ok {
+			continue
+		}
+		seen[p.Architecture] = struct{}{}
+
+		variants := variantsForCPU(p.Architecture, cpus[pm.emulator])
+		if variants == nil {
+			variants = detectedVariants(st.Supported, p.Architecture)
+		}
+		if len(variants) == 0 {
+			continue
+		}
+		out = append(out, platformVariant{
+			Platform: platforms.Format(ocispecs.Platform{OS: "linux", Architecture: p.Architecture}),
+			Emulator: pm.emulator,
+			Variants: variants,
+		})
+	}
+	return out
+}
+
+// detectedVariants 返回 archutil 检测到的架构的所有变体
+func detectedVariants(supported []string, arch string) []string {
+	var out []string
+	for _, pp := range supported {
+		if p, err := platforms.Parse(pp); err == nil && p.Architecture == arch && p.Variant != "" {
+			out = append(out, p.Variant)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
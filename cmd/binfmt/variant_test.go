@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseVariants 测试平台变体的解析，默认变体不需要修改 CPU 型号
+func TestParseVariants(t *testing.T) {
+	got, err := parseVariants("linux/amd64/v3,arm64/v8,linux/arm,linux/arm/v6,riscv64,all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// arm64/v8 和 arm（即 arm/v7）是默认变体，不需要修改 CPU 型号
+	if expected := map[string]string{"amd64": "v3", "arm": "v6"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected variants %v", got)
+	}
+
+	if _, err := parseVariants("linux/amd64/v2,linux/amd64/v3"); err == nil {
+		t.Fatal("expected error for conflicting variants")
+	}
+}
+
+// TestVariantCPU 测试每个变体对应的 QEMU CPU 型号，以及不支持的变体
+func TestVariantCPU(t *testing.T) {
+	tests := []struct {
+		arch      string
+		variant   string
+		cpu       string
+		expectErr string
+	}{
+		{arch: "amd64", variant: "v2", cpu: "max"},
+		{arch: "amd64", variant: "v3", cpu: "max"},
+		{arch: "amd64", variant: "v4", expectErr: "AVX-512"},
+		{arch: "arm", variant: "v5", cpu: "arm926"},
+		{arch: "arm64", variant: "v8.2", cpu: "max"},
+		{arch: "riscv64", variant: "v2", expectErr: "unsupported variant"},
+	}
+	for _, tc := range tests {
+		cpu, err := variantCPUFor(tc.arch, tc.variant)
+		if tc.expectErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+				t.Errorf("%s/%s: expected error %q, got %v", tc.arch, tc.variant, tc.expectErr, err)
+			}
+			continue
+		}
+		if err != nil || cpu != tc.cpu {
+			t.Errorf("%s/%s: expected %q, got %q %v", tc.arch, tc.variant, tc.cpu, cpu, err)
+		}
+	}
+
+	if got := variantsForCPU("arm", "arm1176"); !reflect.DeepEqual(got, []string{"v5", "v6"}) {
+		t.Errorf("unexpected variants %v", got)
+	}
+	if got := variantsForCPU("arm", ""); !reflect.DeepEqual(got, []string{"v5", "v6", "v7"}) {
+		t.Errorf("unexpected variants %v", got)
+	}
+	// 基础变体总是包含在内
+	if got := variantsForCPU("amd64", "max"); !reflect.DeepEqual(got, []string{"v1", "v2", "v3"}) {
+		t.Errorf("unexpected variants %v", got)
+	}
+	if got := variantsForCPU("arm64", "max"); len(got) == 0 || got[0] != "v8" || got[len(got)-1] != "v9" {
+		t.Errorf("unexpected variants %v", got)
+	}
+	if got := variantsForCPU("amd64", "Haswell"); got != nil {
+		t.Errorf("unexpected variants %v", got)
+	}
+}
+
+// TestInstallVariant 测试安装变体时通过包装程序设置 QEMU_CPU
+func TestInstallVariant(t *testing.T) {
+	defer func(spec, dir string, variants map[string]string) {
+		profileSpec, profileDir, installVariants = spec, dir, variants
+	}(profileSpec, profileDir, installVariants)
+	profileDir = t.TempDir()
+
+	f := newFakeFS(t, true)
+	fakeInterpreters(t, "amd64", "arm")
+
+	var err error
+	installVariants, err = parseVariants("linux/amd64/v3,linux/arm/v6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// -profile 中明确指定的 cpu 优先
+	profileSpec = "arm.cpu=arm1136"
+	for _, arch := range []string{"amd64", "arm"} {
+		if err := install(arch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cpus := map[string]string{}
+	for _, hp := range getHandlerProfiles(f.names()) {
+		cpus[hp.Name] = hp.Env["QEMU_CPU"]
+	}
+	if expected := map[string]string{"qemu-x86_64": "max", "qemu-arm": "arm1136"}; !reflect.DeepEqual(cpus, expected) {
+		t.Fatalf("unexpected profiles %v", cpus)
+	}
+
+	installVariants = map[string]string{"amd64": "v4"}
+	if _, err := getRegistration("amd64"); err == nil || !strings.Contains(err.Error(), "AVX-512") {
+		t.Fatalf("expected error for amd64/v4, got %v", err)
+	}
+}
+
+// TestPlatformVariants 测试根据已注册条目的 CPU 型号报告每个平台支持的变体
+func TestPlatformVariants(t *testing.T) {
+	st := &status{
+		Supported: []string{"linux/arm64", "linux/arm/v7", "linux/arm/v6", "linux/riscv64"},
+		Emulators: []string{"qemu-arm", "qemu-riscv64"},
+		Profiles: []handlerProfile{{
+			Name: "qemu-arm",
+			Env:  map[string]string{"QEMU_CPU": "arm1176"},
+		}},
+	}
+	var got []platformVariant
+	for _, pv := range getPlatformVariants(st) {
+		if pv.Emulator != "" {
+			got = append(got, pv)
+		}
+	}
+	expected := []platformVariant{{Platform: "linux/arm", Emulator: "qemu-arm", Variants: []string{"v5", "v6"}}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected variants %+v", got)
+	}
+}
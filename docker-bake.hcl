@@ -194,6 +194,16 @@ target "binfmt-archive-all" {
   inherits = ["binfmt-archive", "all-arch"]
 }
 
+// 内嵌模拟器目标：构建内嵌所有 QEMU 模拟器的单文件 binfmt
+target "binfmt-embedded" {
+  // 继承 mainline 配置
+  inherits = ["mainline"]
+  // 构建 binfmt-embedded 阶段
+  target = "binfmt-embedded"
+  // 输出到 ./bin 目录
+  output = ["./bin"]
+}
+
 // 完整归档目标：创建包含所有内容的完整归档
 target "archive" {
   // 继承 mainline 配置
@@ -5,16 +5,16 @@ go 1.23.0
 require (
 	github.com/containerd/platforms v1.0.0-rc.1
 	github.com/moby/buildkit v0.19.0
+	github.com/opencontainers/go-digest v1.0.0
 	github.com/opencontainers/image-spec v1.1.0
 	github.com/pkg/errors v0.9.1
+	github.com/tonistiigi/go-archvariant v1.0.0
+	golang.org/x/sys v0.28.0
 )
 
 require (
 	github.com/containerd/log v0.1.0 // indirect
-	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
-	github.com/tonistiigi/go-archvariant v1.0.0 // indirect
 	go.opentelemetry.io/otel v1.31.0 // indirect
 	go.opentelemetry.io/otel/trace v1.31.0 // indirect
-	golang.org/x/sys v0.28.0 // indirect
 )